@@ -1,32 +1,217 @@
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
 
 type AuthenticationHandler struct {
 	Authorized map[string]string
 	PublicRead bool
 	Delegate   http.Handler
+
+	// Roles restricts the requests authorized users may make. Users without
+	// an entry are allowed to make any request.
+	Roles map[string]Roles
+
+	// Rules grant or deny access to paths beneath a prefix. When a rule
+	// applies to a request, it takes precedence over PublicRead. Requests
+	// allowed by a rule are still subject to the user's Roles.
+	Rules Rules
+
+	// Tokens are accepted as bearer tokens or API keys in place of basic
+	// authentication.
+	Tokens Tokens
+
+	// CertificateUsers authenticates requests made with a verified client
+	// certificate. When RequireCertificateForWrites is set, requests other
+	// than GET and HEAD must be authenticated by a client certificate.
+	CertificateUsers            CertificateUsers
+	RequireCertificateForWrites bool
+
+	// Signer verifies pre-authorized URLs. A request with a valid signature
+	// is allowed without any other authentication, and Rules, Roles and
+	// RequireCertificateForWrites do not apply to it.
+	Signer *URLSigner
+
+	// Metrics counts the requests that are refused when set.
+	Metrics *Metrics
+}
+
+// principal is the authenticated identity behind a request.
+type principal struct {
+	name        string
+	roles       Roles
+	token       *Token
+	certificate bool
+}
+
+// operation is a read, write or delete of a single path.
+type operation struct {
+	method string
+	upath  string
 }
 
 func (ah *AuthenticationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet, http.MethodHead:
-		if ah.PublicRead {
-			break
+	operations := requestOperations(r)
+
+	if ah.anonymousAllowed(operations) {
+		ah.Delegate.ServeHTTP(w, r)
+		return
+	}
+
+	if ah.Signer != nil && isSigned(r) {
+		if isWebDAVMethod(r.Method) || !ah.Signer.Verify(r, time.Now()) {
+			ah.Metrics.authFailed(AuthFailureInvalidSignature)
+			w.WriteHeader(http.StatusForbidden)
+			return
 		}
-		fallthrough
+		ah.Delegate.ServeHTTP(w, r)
+		return
+	}
 
-	default:
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+	user, status, reason := ah.authenticate(r)
+	if user == nil {
+		ah.Metrics.authFailed(reason)
+		w.WriteHeader(status)
+		return
+	}
+	for _, op := range operations {
+		if ah.RequireCertificateForWrites && !user.certificate && !isRead(op.method) {
+			ah.Metrics.authFailed(AuthFailureCertificate)
+			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-		if ah.Authorized == nil || ah.Authorized[username] != password {
+		if !ah.authorized(user, op.method, op.upath) {
+			ah.Metrics.authFailed(AuthFailureForbidden)
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
 	}
 
-	ah.Delegate.ServeHTTP(w, r)
+	ah.Delegate.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user.name)))
+}
+
+type userContextKey struct{}
+
+// requestUser returns the name of the user that authenticated the request.
+// It is empty for anonymous and signed requests.
+func requestUser(r *http.Request) string {
+	name, _ := r.Context().Value(userContextKey{}).(string)
+	return name
+}
+
+// requestOperations translates a request into the operations it performs.
+// WebDAV methods are checked as the GET, PUT and DELETE requests they are
+// equivalent to, including those on the destination of a COPY or MOVE.
+func requestOperations(r *http.Request) []operation {
+	upath := cleanPath(r.URL.Path)
+	if isUploadSessionRequest(r) {
+		return []operation{{http.MethodPut, upath}}
+	}
+
+	switch r.Method {
+	case MethodOptions, MethodPropfind:
+		return []operation{{http.MethodGet, upath}}
+	case MethodMkcol, MethodProppatch, MethodLock, MethodUnlock:
+		return []operation{{http.MethodPut, upath}}
+	case MethodCopy, MethodMove:
+		operations := []operation{{http.MethodGet, upath}}
+		if r.Method == MethodMove {
+			operations = append(operations, operation{http.MethodDelete, upath})
+		}
+		if destination, err := destinationPath(r); err == nil {
+			operations = append(operations, operation{http.MethodPut, destination})
+			if r.Header.Get("Overwrite") != "F" {
+				operations = append(operations, operation{http.MethodDelete, destination})
+			}
+		}
+		return operations
+	default:
+		return []operation{{r.Method, upath}}
+	}
+}
+
+func (ah *AuthenticationHandler) anonymousAllowed(operations []operation) bool {
+	for _, op := range operations {
+		if !ah.anonymousAllowedTo(op.method, op.upath) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ah *AuthenticationHandler) anonymousAllowedTo(method, upath string) bool {
+	if access, ok := ah.Rules.Evaluate("", method, upath); ok {
+		return access == AccessAllow
+	}
+
+	return ah.PublicRead && isRead(method)
+}
+
+func isRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// authenticate identifies the user making the request from a client
+// certificate, bearer token, API key, or basic authentication credentials.
+// When the request cannot be authenticated, the status to respond with and
+// the reason for the failure are returned instead.
+func (ah *AuthenticationHandler) authenticate(r *http.Request) (*principal, int, string) {
+	if cert, ok := verifiedCertificate(r); ok {
+		if user, found := ah.CertificateUsers.Lookup(cert); found {
+			return &principal{name: user.Name, roles: user.Roles, certificate: true}, 0, ""
+		}
+	}
+
+	if secret, ok := requestToken(r); ok {
+		token, found := ah.Tokens.Lookup(secret)
+		if !found {
+			return nil, http.StatusForbidden, AuthFailureInvalidToken
+		}
+		if token.Expired(time.Now()) {
+			return nil, http.StatusForbidden, AuthFailureExpiredToken
+		}
+		return &principal{name: token.Name, roles: token.Roles, token: token}, 0, ""
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, http.StatusUnauthorized, AuthFailureMissingCredentials
+	}
+	stored, found := ah.Authorized[username]
+	if !found || !VerifyPassword(stored, password) {
+		return nil, http.StatusForbidden, AuthFailureInvalidCredentials
+	}
+	return &principal{name: username, roles: ah.Roles[username]}, 0, ""
+}
+
+func (ah *AuthenticationHandler) authorized(user *principal, method, upath string) bool {
+	if access, ok := ah.Rules.Evaluate(user.name, method, upath); ok && access == AccessDeny {
+		return false
+	}
+	if user.token != nil && !user.token.Covers(upath) {
+		return false
+	}
+	if user.roles != nil && !user.roles.Has(RequiredRole(method)) {
+		return false
+	}
+	return true
+}
+
+// requestToken extracts an API token from either a bearer Authorization
+// header or an X-API-Key header.
+func requestToken(r *http.Request) (string, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+
+	authorization := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(authorization) > len(prefix) && strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return strings.TrimSpace(authorization[len(prefix):]), true
+	}
+	return "", false
 }
@@ -1,8 +1,12 @@
 package handlers_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/sykesm/dav-blobstore/handlers"
 
@@ -91,6 +95,86 @@ var _ = Describe("Authentication", func() {
 			})
 		})
 
+		Context("when the authorized password is hashed", func() {
+			BeforeEach(func() {
+				handler.Authorized["user"] = "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"
+			})
+
+			It("accepts the matching password", func() {
+				req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.SetBasicAuth("user", "password")
+				handler.ServeHTTP(response, req)
+				Expect(response.Code).To(Equal(http.StatusOK))
+			})
+
+			It("rejects the hash itself as a password", func() {
+				req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.SetBasicAuth("user", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/")
+				handler.ServeHTTP(response, req)
+				Expect(response.Code).To(Equal(http.StatusForbidden))
+			})
+		})
+
+		Context("when the user has been assigned roles", func() {
+			var statusFor func(method string) int
+
+			BeforeEach(func() {
+				handler.Roles = map[string]handlers.Roles{}
+
+				statusFor = func(method string) int {
+					req, err := http.NewRequest(method, "http://example.com/", nil)
+					Expect(err).NotTo(HaveOccurred())
+
+					response := httptest.NewRecorder()
+					req.SetBasicAuth("user", "password")
+					handler.ServeHTTP(response, req)
+					return response.Code
+				}
+			})
+
+			It("allows readers to GET and HEAD", func() {
+				handler.Roles["user"] = handlers.Roles{handlers.RoleRead}
+
+				Expect(statusFor("GET")).To(Equal(http.StatusOK))
+				Expect(statusFor("HEAD")).To(Equal(http.StatusOK))
+				Expect(statusFor("PUT")).To(Equal(http.StatusForbidden))
+				Expect(statusFor("DELETE")).To(Equal(http.StatusForbidden))
+			})
+
+			It("allows writers to PUT", func() {
+				handler.Roles["user"] = handlers.Roles{handlers.RoleWrite}
+
+				Expect(statusFor("PUT")).To(Equal(http.StatusOK))
+				Expect(statusFor("GET")).To(Equal(http.StatusForbidden))
+				Expect(statusFor("DELETE")).To(Equal(http.StatusForbidden))
+			})
+
+			It("allows deleters to DELETE", func() {
+				handler.Roles["user"] = handlers.Roles{handlers.RoleDelete}
+
+				Expect(statusFor("DELETE")).To(Equal(http.StatusOK))
+				Expect(statusFor("PUT")).To(Equal(http.StatusForbidden))
+			})
+
+			It("allows admins to make any request", func() {
+				handler.Roles["user"] = handlers.Roles{handlers.RoleAdmin}
+
+				for _, method := range []string{"GET", "HEAD", "PUT", "POST", "DELETE", "MKCOL", "UNNOWN"} {
+					Expect(statusFor(method)).To(Equal(http.StatusOK))
+				}
+			})
+
+			It("requires the admin role for unrecognized methods", func() {
+				handler.Roles["user"] = handlers.Roles{handlers.RoleRead, handlers.RoleWrite, handlers.RoleDelete}
+
+				Expect(statusFor("UNNOWN")).To(Equal(http.StatusForbidden))
+			})
+		})
+
 		Context("when the user and password are in the authorized list", func() {
 			It("accepts the request", func() {
 				for _, method := range []string{"GET", "HEAD", "PUT", "POST", "DELETE", "MKCOL", "UNNOWN"} {
@@ -104,4 +188,307 @@ var _ = Describe("Authentication", func() {
 			})
 		})
 	})
+
+	Describe("access rules", func() {
+		var statusFor func(method, url, username string) int
+
+		BeforeEach(func() {
+			handler.PublicRead = true
+			handler.Authorized = map[string]string{
+				"ci-release-a": "password",
+				"admin":        "password",
+			}
+			handler.Rules = handlers.Rules{
+				{Prefix: "/private", Users: []string{handlers.AnonymousUser}, Access: handlers.AccessDeny},
+				{Prefix: "/release-a/", Users: []string{"ci-release-a"}, Methods: []string{"PUT"}, Access: handlers.AccessAllow},
+				{Prefix: "/", Users: []string{"ci-release-a"}, Methods: []string{"PUT", "DELETE"}, Access: handlers.AccessDeny},
+				{Prefix: "/public-drop", Users: []string{handlers.AnonymousUser}, Methods: []string{"PUT"}, Access: handlers.AccessAllow},
+			}
+
+			statusFor = func(method, url, username string) int {
+				req, err := http.NewRequest(method, url, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				if username != "" {
+					req.SetBasicAuth(username, "password")
+				}
+
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, req)
+				return response.Code
+			}
+		})
+
+		It("denies anonymous reads under a private prefix", func() {
+			Expect(statusFor("GET", "http://example.com/private/blob", "")).To(Equal(http.StatusUnauthorized))
+			Expect(statusFor("HEAD", "http://example.com/private", "")).To(Equal(http.StatusUnauthorized))
+			Expect(statusFor("GET", "http://example.com/private/blob", "admin")).To(Equal(http.StatusOK))
+		})
+
+		It("matches prefixes against the cleaned path", func() {
+			Expect(statusFor("GET", "http://example.com/public/../private/blob", "")).To(Equal(http.StatusUnauthorized))
+			Expect(statusFor("GET", "http://example.com//private//blob", "")).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("matches whole path elements", func() {
+			Expect(statusFor("GET", "http://example.com/private-not/blob", "")).To(Equal(http.StatusOK))
+		})
+
+		It("applies the first matching rule", func() {
+			Expect(statusFor("PUT", "http://example.com/release-a/blob", "ci-release-a")).To(Equal(http.StatusOK))
+			Expect(statusFor("PUT", "http://example.com/release-b/blob", "ci-release-a")).To(Equal(http.StatusForbidden))
+			Expect(statusFor("DELETE", "http://example.com/release-a/blob", "ci-release-a")).To(Equal(http.StatusForbidden))
+			Expect(statusFor("PUT", "http://example.com/release-b/blob", "admin")).To(Equal(http.StatusOK))
+		})
+
+		It("allows anonymous requests permitted by a rule", func() {
+			Expect(statusFor("PUT", "http://example.com/public-drop/blob", "")).To(Equal(http.StatusOK))
+			Expect(statusFor("DELETE", "http://example.com/public-drop/blob", "")).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("still applies the roles of the user", func() {
+			handler.Roles = map[string]handlers.Roles{"ci-release-a": {handlers.RoleRead}}
+
+			Expect(statusFor("PUT", "http://example.com/release-a/blob", "ci-release-a")).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("WebDAV methods", func() {
+		var statusFor func(method, url, destination string) int
+
+		BeforeEach(func() {
+			handler.PublicRead = true
+			handler.Authorized = map[string]string{"user": "password"}
+			handler.Roles = map[string]handlers.Roles{"user": {handlers.RoleRead, handlers.RoleWrite}}
+			handler.Rules = handlers.Rules{
+				{Prefix: "/release-a", Users: []string{"user"}, Access: handlers.AccessDeny},
+			}
+
+			statusFor = func(method, url, destination string) int {
+				req, err := http.NewRequest(method, url, nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth("user", "password")
+				if destination != "" {
+					req.Header.Set("Destination", destination)
+					req.Header.Set("Overwrite", "F")
+				}
+
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, req)
+				return response.Code
+			}
+		})
+
+		It("treats PROPFIND and OPTIONS as reads", func() {
+			handler.Authorized = nil
+
+			for _, method := range []string{"PROPFIND", "OPTIONS"} {
+				req, err := http.NewRequest(method, "http://example.com/blob", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, req)
+				Expect(response.Code).To(Equal(http.StatusOK), method)
+			}
+		})
+
+		It("treats MKCOL as a write", func() {
+			Expect(statusFor("MKCOL", "http://example.com/dir", "")).To(Equal(http.StatusOK))
+			Expect(statusFor("MKCOL", "http://example.com/release-a/dir", "")).To(Equal(http.StatusForbidden))
+		})
+
+		It("authorizes COPY against both the source and the destination", func() {
+			Expect(statusFor("COPY", "http://example.com/blob", "/copy")).To(Equal(http.StatusOK))
+			Expect(statusFor("COPY", "http://example.com/release-a/blob", "/copy")).To(Equal(http.StatusForbidden))
+			Expect(statusFor("COPY", "http://example.com/blob", "http://example.com/release-a/copy")).To(Equal(http.StatusForbidden))
+		})
+
+		It("requires the delete role to MOVE", func() {
+			Expect(statusFor("MOVE", "http://example.com/blob", "/moved")).To(Equal(http.StatusForbidden))
+
+			handler.Roles["user"] = append(handler.Roles["user"], handlers.RoleDelete)
+			Expect(statusFor("MOVE", "http://example.com/blob", "/moved")).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("API tokens", func() {
+		var statusFor func(method, url string, authorize func(*http.Request)) int
+
+		BeforeEach(func() {
+			past := time.Now().Add(-time.Hour)
+			future := time.Now().Add(time.Hour)
+
+			var err error
+			handler.Tokens, err = handlers.NewTokens([]handlers.Token{{
+				Name:      "ci",
+				SHA256:    "a1d5601d3a081aea3a98b7dc5b6f20045eee286ab647e9660eed6958ef7ce8e5",
+				Roles:     handlers.Roles{handlers.RoleRead, handlers.RoleWrite},
+				ExpiresAt: &future,
+			}, {
+				Name:      "expired",
+				SHA256:    "b52b3ef2233858ce1156d85f235cf2c41eddfa8ca1eedc924398b9af1db303cb",
+				Roles:     handlers.Roles{handlers.RoleAdmin},
+				ExpiresAt: &past,
+			}, {
+				Name:     "scoped",
+				SHA256:   "16d56c41fff8b01dace6ca266b6c160503e9999260dc3a69dd6f06f37e307e5d",
+				Roles:    handlers.Roles{handlers.RoleAdmin},
+				Prefixes: []string{"/release-a"},
+			}})
+			Expect(err).NotTo(HaveOccurred())
+
+			statusFor = func(method, url string, authorize func(*http.Request)) int {
+				req, err := http.NewRequest(method, url, nil)
+				Expect(err).NotTo(HaveOccurred())
+				authorize(req)
+
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, req)
+				return response.Code
+			}
+		})
+
+		bearer := func(token string) func(*http.Request) {
+			return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+		}
+		apiKey := func(token string) func(*http.Request) {
+			return func(req *http.Request) { req.Header.Set("X-API-Key", token) }
+		}
+
+		It("accepts bearer tokens", func() {
+			Expect(statusFor("PUT", "http://example.com/blob", bearer("ci-secret-token"))).To(Equal(http.StatusOK))
+		})
+
+		It("accepts API keys", func() {
+			Expect(statusFor("PUT", "http://example.com/blob", apiKey("ci-secret-token"))).To(Equal(http.StatusOK))
+		})
+
+		It("rejects unknown tokens", func() {
+			Expect(statusFor("GET", "http://example.com/blob", bearer("unknown-token"))).To(Equal(http.StatusForbidden))
+		})
+
+		It("rejects expired tokens", func() {
+			Expect(statusFor("GET", "http://example.com/blob", bearer("expired-token"))).To(Equal(http.StatusForbidden))
+		})
+
+		It("limits tokens to their roles", func() {
+			Expect(statusFor("DELETE", "http://example.com/blob", bearer("ci-secret-token"))).To(Equal(http.StatusForbidden))
+		})
+
+		It("limits tokens to their prefixes", func() {
+			Expect(statusFor("DELETE", "http://example.com/release-a/blob", bearer("scoped-token"))).To(Equal(http.StatusOK))
+			Expect(statusFor("DELETE", "http://example.com/release-b/blob", bearer("scoped-token"))).To(Equal(http.StatusForbidden))
+		})
+
+		It("applies access rules using the token name", func() {
+			handler.Rules = handlers.Rules{{Prefix: "/private", Users: []string{"ci"}, Access: handlers.AccessDeny}}
+
+			Expect(statusFor("GET", "http://example.com/private/blob", bearer("ci-secret-token"))).To(Equal(http.StatusForbidden))
+		})
+
+		Describe("NewTokens", func() {
+			It("requires a valid digest", func() {
+				_, err := handlers.NewTokens([]handlers.Token{{Name: "bad", SHA256: "abc", Roles: handlers.Roles{handlers.RoleRead}}})
+				Expect(err).To(MatchError(`token "bad": sha256 must be a hex encoded SHA-256 digest`))
+			})
+
+			It("requires roles", func() {
+				_, err := handlers.NewTokens([]handlers.Token{{Name: "bad", SHA256: "a1d5601d3a081aea3a98b7dc5b6f20045eee286ab647e9660eed6958ef7ce8e5"}})
+				Expect(err).To(MatchError(`token "bad": at least one role is required`))
+			})
+		})
+	})
+
+	Describe("client certificates", func() {
+		var statusFor func(method string, cert *x509.Certificate) int
+
+		BeforeEach(func() {
+			handler.PublicRead = true
+			handler.CertificateUsers = handlers.CertificateUsers{
+				"CN=ci-runner,O=Example": {Name: "ci", Roles: handlers.Roles{handlers.RoleWrite}},
+				"release-manager":        {Name: "release-manager"},
+			}
+
+			statusFor = func(method string, cert *x509.Certificate) int {
+				req, err := http.NewRequest(method, "https://example.com/blob", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.TLS = &tls.ConnectionState{}
+				if cert != nil {
+					req.TLS.PeerCertificates = []*x509.Certificate{cert}
+					req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+				}
+
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, req)
+				return response.Code
+			}
+		})
+
+		certificate := func(subject pkix.Name) *x509.Certificate {
+			return &x509.Certificate{Subject: subject}
+		}
+
+		It("authenticates certificates by distinguished name", func() {
+			cert := certificate(pkix.Name{CommonName: "ci-runner", Organization: []string{"Example"}})
+
+			Expect(statusFor("PUT", cert)).To(Equal(http.StatusOK))
+			Expect(statusFor("DELETE", cert)).To(Equal(http.StatusForbidden))
+		})
+
+		It("authenticates certificates by common name", func() {
+			cert := certificate(pkix.Name{CommonName: "release-manager", Organization: []string{"Example"}})
+
+			Expect(statusFor("DELETE", cert)).To(Equal(http.StatusOK))
+		})
+
+		It("does not authenticate unmapped certificates", func() {
+			cert := certificate(pkix.Name{CommonName: "someone-else"})
+
+			Expect(statusFor("PUT", cert)).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("ignores certificates that were not verified", func() {
+			req, err := http.NewRequest("DELETE", "https://example.com/blob", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{certificate(pkix.Name{CommonName: "release-manager"})},
+			}
+
+			handler.ServeHTTP(response, req)
+			Expect(response.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		Context("when certificates are required for writes", func() {
+			BeforeEach(func() {
+				handler.RequireCertificateForWrites = true
+				handler.Authorized = map[string]string{"user": "password"}
+			})
+
+			It("rejects writes authenticated by other means", func() {
+				req, err := http.NewRequest("PUT", "https://example.com/blob", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth("user", "password")
+
+				handler.ServeHTTP(response, req)
+				Expect(response.Code).To(Equal(http.StatusForbidden))
+			})
+
+			It("allows writes authenticated by certificate", func() {
+				Expect(statusFor("PUT", certificate(pkix.Name{CommonName: "release-manager"}))).To(Equal(http.StatusOK))
+			})
+
+			It("allows anonymous reads", func() {
+				Expect(statusFor("GET", nil)).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Describe("Rule", func() {
+		It("requires allow rules to list their users", func() {
+			Expect((&handlers.Rule{Prefix: "/", Access: handlers.AccessDeny}).Validate()).To(Succeed())
+			Expect((&handlers.Rule{Prefix: "/", Users: []string{handlers.AuthenticatedUser}, Access: handlers.AccessAllow}).Validate()).To(Succeed())
+			Expect((&handlers.Rule{Prefix: "/", Access: handlers.AccessAllow}).Validate()).To(MatchError(ContainSubstring("must list its users")))
+		})
+	})
 })
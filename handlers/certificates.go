@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// CertificateUser identifies the user a verified client certificate
+// authenticates as.
+type CertificateUser struct {
+	Name  string `json:"name"`
+	Roles Roles  `json:"roles,omitempty"`
+}
+
+func (cu *CertificateUser) Validate() error {
+	if cu.Name == "" {
+		return fmt.Errorf("certificate user name is required")
+	}
+	for _, role := range cu.Roles {
+		if _, err := ParseRole(string(role)); err != nil {
+			return fmt.Errorf("certificate user %q: %s", cu.Name, err)
+		}
+	}
+	return nil
+}
+
+// CertificateUsers maps client certificate subjects to users. Subjects are
+// matched first by their full distinguished name, as formatted by
+// pkix.Name.String, and then by their common name.
+type CertificateUsers map[string]CertificateUser
+
+func (users CertificateUsers) Lookup(cert *x509.Certificate) (CertificateUser, bool) {
+	if user, ok := users[cert.Subject.String()]; ok {
+		return user, true
+	}
+	if cert.Subject.CommonName == "" {
+		return CertificateUser{}, false
+	}
+	user, ok := users[cert.Subject.CommonName]
+	return user, ok
+}
+
+// verifiedCertificate returns the client certificate presented with the
+// request when the TLS handshake verified it against the client CAs.
+func verifiedCertificate(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return r.TLS.VerifiedChains[0][0], true
+}
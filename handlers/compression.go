@@ -0,0 +1,573 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for blobs at rest. Their names are the HTTP content
+// codings of the compressed content.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// A compressed blob is followed by a trailer that records the algorithm and
+// the size of the decompressed content so the blob can be described without
+// decompressing it.
+const (
+	compressionMagic   = "dav-blobstore-compressed"
+	compressionTrailer = 4 + 8 + len(compressionMagic)
+)
+
+// COMPRESSION_SUFFIX names the sidecar that marks a blob as compressed by the
+// server and holds its algorithm. Clients cannot write sidecars, so a blob
+// they upload with a trailer of its own is never mistaken for a compressed
+// one.
+const COMPRESSION_SUFFIX = ".compression"
+
+// CompressionRule compresses the blobs under a path prefix with an algorithm.
+type CompressionRule struct {
+	Prefix    string `json:"prefix"`
+	Algorithm string `json:"algorithm"`
+}
+
+func (rule *CompressionRule) Validate() error {
+	if !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("compression prefix must be absolute: %q", rule.Prefix)
+	}
+	switch rule.Algorithm {
+	case CompressionNone, CompressionZstd, CompressionGzip:
+	case "":
+		return errors.New("compression algorithm is required")
+	default:
+		return fmt.Errorf("unknown compression algorithm: %q", rule.Algorithm)
+	}
+	return nil
+}
+
+// CompressionRules are evaluated in order and the first rule whose prefix
+// contains the path decides its algorithm.
+type CompressionRules []CompressionRule
+
+// Algorithm returns the compression algorithm for upath. Blobs that no rule
+// applies to, and sidecars, are stored uncompressed.
+func (rules CompressionRules) Algorithm(upath string) string {
+	if isHidden(path.Base(upath)) {
+		return CompressionNone
+	}
+	for i := range rules {
+		if hasPathPrefix(upath, rules[i].Prefix) {
+			return rules[i].Algorithm
+		}
+	}
+	return CompressionNone
+}
+
+// CompressedStorage compresses blobs in Backend according to Rules and
+// decompresses them when they are read. Blobs are recognized as compressed
+// by their COMPRESSION_SUFFIX sidecar, so changing the rules does not affect
+// the blobs that are already stored.
+type CompressedStorage struct {
+	Backend Storage
+	Rules   CompressionRules
+}
+
+// encodedOpener is implemented by storage that can serve the compressed
+// content of a blob as it is stored.
+type encodedOpener interface {
+	// OpenEncoded returns the stored content of the blob at upath and its
+	// content coding, which is empty when the blob is not compressed.
+	OpenEncoded(upath string) (File, string, error)
+}
+
+var errInvalidTrailer = errors.New("invalid compression trailer")
+
+// compressedAlgorithm returns the algorithm recorded in the sidecar of the
+// blob at upath, or an empty string when the blob is not compressed.
+func (cs *CompressedStorage) compressedAlgorithm(upath string) (string, error) {
+	algorithm, err := readBlob(cs.Backend, upath+COMPRESSION_SUFFIX)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(algorithm), err
+}
+
+// compressionInfo describes the blob at upath, whose content is in file, or
+// returns nil when it is not compressed.
+func (cs *CompressedStorage) compressionInfo(upath string, file File) (*compressedBlob, error) {
+	algorithm, err := cs.compressedAlgorithm(upath)
+	if err != nil || algorithm == "" {
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(compressionTrailer) {
+		return nil, errInvalidTrailer
+	}
+	if _, err := file.Seek(-int64(compressionTrailer), io.SeekEnd); err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, compressionTrailer)
+	if _, err := io.ReadFull(file, trailer); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	decompressedSize := int64(binary.BigEndian.Uint64(trailer[4:12]))
+	if string(trailer[12:]) != compressionMagic ||
+		strings.TrimRight(string(trailer[:4]), " ") != algorithm ||
+		decompressedSize < 0 {
+		return nil, errInvalidTrailer
+	}
+	return &compressedBlob{
+		algorithm:   algorithm,
+		size:        decompressedSize,
+		encodedSize: size - int64(compressionTrailer),
+	}, nil
+}
+
+type compressedBlob struct {
+	algorithm   string
+	size        int64
+	encodedSize int64
+}
+
+func (cs *CompressedStorage) Open(upath string) (File, error) {
+	file, err := cs.Backend.Open(upath)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := cs.compressionInfo(upath, file)
+	if err != nil || blob == nil {
+		return closeOnError(file, err)
+	}
+	return &decompressedFile{file: file, blob: blob}, nil
+}
+
+func (cs *CompressedStorage) OpenEncoded(upath string) (File, string, error) {
+	file, err := cs.Backend.Open(upath)
+	if err != nil {
+		return nil, "", err
+	}
+	blob, err := cs.compressionInfo(upath, file)
+	if err != nil || blob == nil {
+		file, err = closeOnError(file, err)
+		return file, "", err
+	}
+	return &truncatedFile{File: file, size: blob.encodedSize}, blob.algorithm, nil
+}
+
+func closeOnError(file File, err error) (File, error) {
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (cs *CompressedStorage) Stat(upath string) (os.FileInfo, error) {
+	info, err := cs.Backend.Stat(upath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return info, nil
+	}
+	if _, err := cs.Backend.Stat(upath + COMPRESSION_SUFFIX); os.IsNotExist(err) {
+		return info, nil
+	}
+	return cs.describe(upath, info)
+}
+
+// describe reports the size of the decompressed content of a compressed
+// blob.
+func (cs *CompressedStorage) describe(upath string, info os.FileInfo) (os.FileInfo, error) {
+	file, err := cs.Backend.Open(upath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	blob, err := cs.compressionInfo(upath, file)
+	if err != nil || blob == nil {
+		return info, err
+	}
+	return &fileInfo{name: info.Name(), size: blob.size, modTime: info.ModTime()}, nil
+}
+
+// List describes the compressed blobs in upath by the size of their
+// decompressed content and omits their sidecars.
+func (cs *CompressedStorage) List(upath string) ([]os.FileInfo, error) {
+	infos, err := cs.Backend.List(upath)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := map[string]bool{}
+	for _, info := range infos {
+		if name := info.Name(); strings.HasSuffix(name, COMPRESSION_SUFFIX) {
+			compressed[strings.TrimSuffix(name, COMPRESSION_SUFFIX)] = true
+		}
+	}
+
+	described := infos[:0]
+	for _, info := range infos {
+		switch {
+		case strings.HasSuffix(info.Name(), COMPRESSION_SUFFIX):
+			continue
+		case compressed[info.Name()] && !info.IsDir():
+			if compressedInfo, err := cs.describe(path.Join(upath, info.Name()), info); err == nil {
+				info = compressedInfo
+			}
+		}
+		described = append(described, info)
+	}
+	return described, nil
+}
+
+func (cs *CompressedStorage) Create(upath string) (Upload, error) {
+	upload, err := cs.Backend.Create(upath)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := cs.Rules.Algorithm(upath)
+	if algorithm == CompressionNone {
+		if isHidden(path.Base(upath)) {
+			return upload, nil
+		}
+		return &uncompressedUpload{Upload: upload, storage: cs, upath: upath}, nil
+	}
+
+	var encoder io.WriteCloser
+	switch algorithm {
+	case CompressionZstd:
+		encoder, err = zstd.NewWriter(upload)
+	case CompressionGzip:
+		encoder = gzip.NewWriter(upload)
+	}
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	return &compressedUpload{upload: upload, encoder: encoder, storage: cs, upath: upath, algorithm: algorithm}, nil
+}
+
+// Delete removes the blob at upath and the sidecar that marks it as
+// compressed.
+func (cs *CompressedStorage) Delete(upath string) error {
+	if err := cs.Backend.Delete(upath); err != nil {
+		return err
+	}
+	return cs.unmark(upath)
+}
+
+// mark records that the blob at upath is compressed with algorithm.
+func (cs *CompressedStorage) mark(upath, algorithm string) error {
+	upload, err := cs.Backend.Create(upath + COMPRESSION_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := upload.Write([]byte(algorithm)); err != nil {
+		return err
+	}
+	return upload.Commit(true)
+}
+
+func (cs *CompressedStorage) unmark(upath string) error {
+	err := cs.Backend.Delete(upath + COMPRESSION_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Mkdir creates an empty directory when the backend supports them.
+func (cs *CompressedStorage) Mkdir(upath string) error {
+	maker, ok := cs.Backend.(directoryMaker)
+	if !ok {
+		return &os.PathError{Op: "mkdir", Path: upath, Err: os.ErrPermission}
+	}
+	return maker.Mkdir(upath)
+}
+
+// uncompressedUpload stores a blob as it is. A blob it replaces may have
+// been compressed, so the sidecar that marks it is removed before the blob
+// is replaced and restored if the blob cannot be.
+type uncompressedUpload struct {
+	Upload
+	storage *CompressedStorage
+	upath   string
+}
+
+func (u *uncompressedUpload) Commit(replace bool) error {
+	if !replace {
+		if err := u.Upload.Commit(false); err != nil {
+			return err
+		}
+		return u.storage.unmark(u.upath)
+	}
+
+	algorithm, err := u.storage.compressedAlgorithm(u.upath)
+	if err != nil {
+		return err
+	}
+	if err := u.storage.unmark(u.upath); err != nil {
+		return err
+	}
+	if err := u.Upload.Commit(true); err != nil {
+		if algorithm != "" {
+			u.storage.mark(u.upath, algorithm)
+		}
+		return err
+	}
+	return nil
+}
+
+// compressedUpload compresses the content written to it and appends the
+// trailer when it is committed. The blob is marked as compressed before it
+// is stored.
+type compressedUpload struct {
+	upload    Upload
+	encoder   io.WriteCloser
+	storage   *CompressedStorage
+	upath     string
+	algorithm string
+	size      int64
+	closed    bool
+}
+
+func (u *compressedUpload) Write(p []byte) (int, error) {
+	n, err := u.encoder.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *compressedUpload) Commit(replace bool) error {
+	if !u.closed {
+		if err := u.encoder.Close(); err != nil {
+			return err
+		}
+		u.closed = true
+
+		trailer := make([]byte, compressionTrailer)
+		copy(trailer, fmt.Sprintf("%-4s", u.algorithm))
+		binary.BigEndian.PutUint64(trailer[4:12], uint64(u.size))
+		copy(trailer[12:], compressionMagic)
+		if _, err := u.upload.Write(trailer); err != nil {
+			return err
+		}
+	}
+	if !replace {
+		if _, err := u.storage.Backend.Stat(u.upath); err == nil {
+			return &os.PathError{Op: "create", Path: u.upath, Err: os.ErrExist}
+		}
+	}
+
+	// The blob is marked before it is stored so that its compressed content
+	// is never served as it is. The previous marker is restored if the blob
+	// cannot be stored.
+	previous, err := u.storage.compressedAlgorithm(u.upath)
+	if err != nil {
+		return err
+	}
+	if previous != u.algorithm {
+		if err := u.storage.mark(u.upath, u.algorithm); err != nil {
+			return err
+		}
+	}
+	if err := u.upload.Commit(replace); err != nil {
+		switch {
+		case previous == u.algorithm:
+		case previous == "":
+			u.storage.unmark(u.upath)
+		default:
+			u.storage.mark(u.upath, previous)
+		}
+		return err
+	}
+	return nil
+}
+
+func (u *compressedUpload) Close() error {
+	if !u.closed {
+		u.encoder.Close()
+		u.closed = true
+	}
+	return u.upload.Close()
+}
+
+// truncatedFile hides the content of a file beyond size.
+type truncatedFile struct {
+	File
+	size   int64
+	offset int64
+}
+
+func (f *truncatedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if remaining := f.size - f.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := f.File.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *truncatedFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		offset, whence = f.size+offset, io.SeekStart
+	}
+	offset, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.offset = offset
+	}
+	return offset, err
+}
+
+// decompressedFile reads the decompressed content of a compressed blob.
+// Seeking forward discards decompressed content and seeking backward
+// decompresses the blob again from its start.
+type decompressedFile struct {
+	file File
+	blob *compressedBlob
+
+	decoder io.Reader
+	offset  int64 // of the decoder in the decompressed content
+	target  int64 // the position of the next Read
+}
+
+func (f *decompressedFile) Read(p []byte) (int, error) {
+	if f.target >= f.blob.size {
+		return 0, io.EOF
+	}
+	if f.decoder == nil || f.target < f.offset {
+		if err := f.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if f.target > f.offset {
+		skipped, err := io.CopyN(ioutil.Discard, f.decoder, f.target-f.offset)
+		f.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.decoder.Read(p)
+	f.offset += int64(n)
+	f.target = f.offset
+	return n, err
+}
+
+func (f *decompressedFile) reset() error {
+	f.closeDecoder()
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	encoded := io.LimitReader(f.file, f.blob.encodedSize)
+
+	var err error
+	switch f.blob.algorithm {
+	case CompressionZstd:
+		f.decoder, err = zstd.NewReader(encoded, zstd.WithDecoderConcurrency(1))
+	case CompressionGzip:
+		f.decoder, err = gzip.NewReader(encoded)
+	}
+	f.offset = 0
+	return err
+}
+
+func (f *decompressedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.target
+	case io.SeekEnd:
+		offset += f.blob.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.target = offset
+	return offset, nil
+}
+
+func (f *decompressedFile) closeDecoder() {
+	if decoder, ok := f.decoder.(*zstd.Decoder); ok {
+		decoder.Close()
+	}
+	f.decoder = nil
+}
+
+func (f *decompressedFile) Close() error {
+	f.closeDecoder()
+	return f.file.Close()
+}
+
+// openBlob opens the blob at upath for a GET or HEAD request. A compressed
+// blob is served as it is stored when the client accepts its content coding
+// and does not request a range. Otherwise it is decompressed.
+func openBlob(w http.ResponseWriter, r *http.Request, storage Storage, upath string) (File, error) {
+	opener, ok := storage.(encodedOpener)
+	if !ok {
+		return storage.Open(upath)
+	}
+	blob, coding, err := opener.OpenEncoded(upath)
+	if err != nil || coding == "" {
+		return blob, err
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if r.Header.Get("Range") != "" || !acceptsEncoding(r, coding) {
+		blob.Close()
+		return storage.Open(upath)
+	}
+
+	w.Header().Set("Content-Encoding", coding)
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+coding+`"`)
+	}
+	return blob, nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// allows the content coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, element := range strings.Split(value, ",") {
+			params := strings.Split(element, ";")
+			if strings.TrimSpace(params[0]) != coding {
+				continue
+			}
+			for _, param := range params[1:] {
+				param = strings.Replace(param, " ", "", -1)
+				if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package handlers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// markerObserver records whether each blob was marked as compressed when it
+// was committed.
+type markerObserver struct {
+	handlers.Storage
+	marked map[string]bool
+}
+
+func (s *markerObserver) Create(upath string) (handlers.Upload, error) {
+	upload, err := s.Storage.Create(upath)
+	return &observedUpload{Upload: upload, storage: s, upath: upath}, err
+}
+
+type observedUpload struct {
+	handlers.Upload
+	storage *markerObserver
+	upath   string
+}
+
+func (u *observedUpload) Commit(replace bool) error {
+	_, err := u.storage.Stat(u.upath + handlers.COMPRESSION_SUFFIX)
+	u.storage.marked[u.upath] = err == nil
+	return u.Upload.Commit(replace)
+}
+
+var _ = Describe("CompressedStorage", func() {
+	var (
+		tempDir string
+		handler *handlers.FileServer
+		content string
+	)
+
+	serve := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		return serveRequest(handler, "", method, target, strings.NewReader(body), headers)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "compression")
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = &handlers.FileServer{
+			Root: tempDir,
+			Storage: &handlers.CompressedStorage{
+				Backend: &handlers.LocalStorage{Root: tempDir},
+				Rules: handlers.CompressionRules{
+					{Prefix: "/src/vendor/", Algorithm: handlers.CompressionNone},
+					{Prefix: "/src/", Algorithm: handlers.CompressionZstd},
+					{Prefix: "/logs/", Algorithm: handlers.CompressionGzip},
+				},
+			},
+		}
+		content = strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 100)
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("stores blobs compressed and serves them decompressed", func() {
+		response := serve(http.MethodPut, "/src/main.go", content, nil)
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		etag := response.Header().Get("ETag")
+
+		info, err := os.Stat(filepath.Join(tempDir, "src", "main.go"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically("<", len(content)/10))
+
+		response = serve(http.MethodGet, "/src/main.go", "", nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(Equal(content))
+		Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(response.Header().Get("ETag")).To(Equal(etag))
+		Expect(response.Header().Get("Vary")).To(Equal("Accept-Encoding"))
+	})
+
+	It("passes the compressed content through to clients that accept it", func() {
+		Expect(serve(http.MethodPut, "/src/main.go", content, nil).Code).To(Equal(http.StatusCreated))
+
+		response := serve(http.MethodGet, "/src/main.go", "", map[string]string{"Accept-Encoding": "gzip, zstd"})
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Content-Encoding")).To(Equal("zstd"))
+		Expect(response.Header().Get("ETag")).To(HaveSuffix(`-zstd"`))
+
+		decoder, err := zstd.NewReader(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		defer decoder.Close()
+		decoded, err := ioutil.ReadAll(decoder)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(decoded)).To(Equal(content))
+	})
+
+	It("applies ranges to the decompressed content", func() {
+		Expect(serve(http.MethodPut, "/logs/build.log", content, nil).Code).To(Equal(http.StatusCreated))
+
+		response := serve(http.MethodGet, "/logs/build.log", "", map[string]string{
+			"Accept-Encoding": "gzip",
+			"Range":           "bytes=49-53",
+		})
+		Expect(response.Code).To(Equal(http.StatusPartialContent))
+		Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(response.Body.String()).To(Equal("quick"))
+
+		response = serve(http.MethodGet, "/logs/build.log", "", map[string]string{"Range": "bytes=4-8,49-53"})
+		Expect(response.Code).To(Equal(http.StatusPartialContent))
+		Expect(response.Body.String()).To(ContainSubstring("quick"))
+	})
+
+	It("decompresses blobs for clients that refuse the coding", func() {
+		Expect(serve(http.MethodPut, "/logs/build.log", content, nil).Code).To(Equal(http.StatusCreated))
+
+		stored, err := ioutil.ReadFile(filepath.Join(tempDir, "logs", "build.log"))
+		Expect(err).NotTo(HaveOccurred())
+		reader, err := gzip.NewReader(bytes.NewReader(stored))
+		Expect(err).NotTo(HaveOccurred())
+		reader.Multistream(false)
+		decoded, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(decoded)).To(Equal(content))
+
+		response := serve(http.MethodGet, "/logs/build.log", "", map[string]string{"Accept-Encoding": "gzip;q=0, zstd"})
+		Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(response.Body.String()).To(Equal(content))
+	})
+
+	It("stores blobs that no rule compresses as they are", func() {
+		Expect(serve(http.MethodPut, "/src/vendor/lib.go", content, nil).Code).To(Equal(http.StatusCreated))
+		Expect(serve(http.MethodPut, "/other.txt", content, nil).Code).To(Equal(http.StatusCreated))
+
+		for _, name := range []string{"src/vendor/lib.go", "other.txt"} {
+			stored, err := ioutil.ReadFile(filepath.Join(tempDir, name))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(stored)).To(Equal(content))
+		}
+
+		response := serve(http.MethodGet, "/other.txt", "", map[string]string{"Accept-Encoding": "zstd"})
+		Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(response.Header().Get("Vary")).To(BeEmpty())
+	})
+
+	It("lists the size of the decompressed content", func() {
+		Expect(serve(http.MethodPut, "/src/main.go", content, nil).Code).To(Equal(http.StatusCreated))
+
+		response := serve(http.MethodGet, "/src/", "", map[string]string{"Accept": "application/json"})
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(ContainSubstring(`"size":4500`))
+		Expect(response.Body.String()).NotTo(ContainSubstring(".compression"))
+	})
+
+	Context("when a client uploads a blob that ends with a compression trailer", func() {
+		var forged string
+
+		BeforeEach(func() {
+			buf := &bytes.Buffer{}
+			writer := gzip.NewWriter(buf)
+			writer.Write([]byte("secret"))
+			writer.Close()
+			trailer := make([]byte, 12)
+			copy(trailer, "gzip")
+			binary.BigEndian.PutUint64(trailer[4:], 1<<63)
+			forged = buf.String() + string(trailer) + "dav-blobstore-compressed"
+		})
+
+		It("serves the blob as it was uploaded", func() {
+			Expect(serve(http.MethodPut, "/other.bin", forged, nil).Code).To(Equal(http.StatusCreated))
+
+			response := serve(http.MethodGet, "/other.bin", "", map[string]string{"Accept-Encoding": "gzip"})
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+			Expect(response.Body.String()).To(Equal(forged))
+		})
+
+		It("refuses to serve it when it is marked as compressed", func() {
+			Expect(serve(http.MethodPut, "/other.bin", forged, nil).Code).To(Equal(http.StatusCreated))
+			Expect(ioutil.WriteFile(filepath.Join(tempDir, "other.bin.compression"), []byte("gzip"), 0644)).To(Succeed())
+
+			Expect(serve(http.MethodGet, "/other.bin", "", nil).Code).To(Equal(http.StatusInternalServerError))
+		})
+
+		It("refuses to store the marker", func() {
+			Expect(serve(http.MethodPut, "/other.bin.compression", "gzip", nil).Code).To(Equal(http.StatusNotFound))
+			Expect(filepath.Join(tempDir, "other.bin.compression")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	It("marks blobs before storing them", func() {
+		observer := &markerObserver{Storage: &handlers.LocalStorage{Root: tempDir}, marked: map[string]bool{}}
+		handler.Storage.(*handlers.CompressedStorage).Backend = observer
+
+		Expect(serve(http.MethodPut, "/src/main.go", content, nil).Code).To(Equal(http.StatusCreated))
+		Expect(observer.marked).To(HaveKeyWithValue("/src/main.go", true))
+	})
+
+	It("leaves an existing blob unmarked when it is not replaced", func() {
+		Expect(os.MkdirAll(filepath.Join(tempDir, "src"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "src", "main.go"), []byte("legacy"), 0644)).To(Succeed())
+
+		Expect(serve(http.MethodPut, "/src/main.go", content, nil).Code).To(Equal(http.StatusConflict))
+		Expect(filepath.Join(tempDir, "src", "main.go"+handlers.COMPRESSION_SUFFIX)).NotTo(BeAnExistingFile())
+		Expect(serve(http.MethodGet, "/src/main.go", "", nil).Body.String()).To(Equal("legacy"))
+	})
+
+	It("stops treating a blob as compressed once it is replaced uncompressed", func() {
+		handler.Overwrite = handlers.OverwriteRules{{Prefix: "/", Policy: handlers.OverwriteReplace}}
+		Expect(serve(http.MethodPut, "/src/main.go", content, nil).Code).To(Equal(http.StatusCreated))
+		Expect(filepath.Join(tempDir, "src", "main.go.compression")).To(BeARegularFile())
+
+		handler.Storage.(*handlers.CompressedStorage).Rules = nil
+		Expect(serve(http.MethodPut, "/src/main.go", "plain", nil).Code).To(Equal(http.StatusNoContent))
+		Expect(filepath.Join(tempDir, "src", "main.go.compression")).NotTo(BeAnExistingFile())
+		Expect(serve(http.MethodGet, "/src/main.go", "", nil).Body.String()).To(Equal("plain"))
+
+		Expect(serve(http.MethodDelete, "/src/main.go", "", nil).Code).To(Equal(http.StatusNoContent))
+		Expect(filepath.Join(tempDir, "src")).To(BeADirectory())
+		Expect(ioutil.ReadDir(filepath.Join(tempDir, "src"))).To(BeEmpty())
+	})
+
+	Describe("CompressionRule", func() {
+		It("requires an absolute prefix and a known algorithm", func() {
+			Expect((&handlers.CompressionRule{Prefix: "/src/", Algorithm: "zstd"}).Validate()).To(Succeed())
+			Expect((&handlers.CompressionRule{Prefix: "src/", Algorithm: "zstd"}).Validate()).To(MatchError(ContainSubstring("absolute")))
+			Expect((&handlers.CompressionRule{Prefix: "/src/"}).Validate()).To(MatchError("compression algorithm is required"))
+			Expect((&handlers.CompressionRule{Prefix: "/src/", Algorithm: "brotli"}).Validate()).To(MatchError(ContainSubstring("unknown")))
+		})
+	})
+})
@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CONTENT_DIR holds the content of blobs stored by ContentAddressedStorage.
+// Its name starts with UPLOAD_PREFIX so it is never served or listed.
+const CONTENT_DIR = UPLOAD_PREFIX + "content"
+
+// POINTER_SUFFIX names the sidecar that marks a blob as a pointer written by
+// ContentAddressedStorage. It holds the hash of the content the pointer
+// refers to. Clients cannot store sidecars, so a blob stored before content
+// addressing was enabled is never taken for a pointer, whatever it contains.
+const POINTER_SUFFIX = ".pointer"
+
+const (
+	pointerPrefix  = "sha256:"
+	maxPointerSize = 256
+)
+
+// contentIndexLock serializes changes to the pointers and reference counts
+// of content addressed storage. It is shared by every storage so it also
+// holds across configuration reloads.
+var contentIndexLock sync.Mutex
+
+// ContentAddressedStorage stores the content of each blob once in Backend,
+// under its SHA-256, and a small pointer to the content at the path of the
+// blob. Each content records how many pointers refer to it and is deleted
+// with the last one. Blobs stored in Backend before content addressing was
+// enabled are served as they are. Sidecars such as metadata are small and
+// unlikely to be shared, so they are stored in Backend directly.
+type ContentAddressedStorage struct {
+	Backend Storage
+
+	// StagingDir is where uploads are hashed before their content is
+	// stored. It defaults to the system temporary directory.
+	StagingDir string
+}
+
+// contentPointer is stored at the path of a blob in place of its content.
+type contentPointer struct {
+	Content string `json:"content"`
+	Size    int64  `json:"size"`
+}
+
+func (p *contentPointer) hash() string {
+	return strings.TrimPrefix(p.Content, pointerPrefix)
+}
+
+func contentPath(hash string) string {
+	return path.Join("/", CONTENT_DIR, hash[:2], hash)
+}
+
+// readPointer returns the pointer stored at upath or nil when upath holds a
+// directory or a blob that was not stored as a pointer. A pointer is only
+// followed when its sidecar names the same content.
+func (cs *ContentAddressedStorage) readPointer(upath string) (*contentPointer, error) {
+	marked, err := readBlob(cs.Backend, upath+POINTER_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := hex.DecodeString(string(marked)); err != nil || len(decoded) != sha256.Size {
+		return nil, nil
+	}
+
+	blob, err := cs.Backend.Open(upath)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(blob, maxPointerSize))
+	if err != nil {
+		return nil, err
+	}
+
+	pointer := &contentPointer{}
+	if err := json.Unmarshal(data, pointer); err != nil || pointer.Content != pointerPrefix+string(marked) {
+		return nil, nil
+	}
+	return pointer, nil
+}
+
+// passthrough reports whether upath is a sidecar that is stored in Backend
+// as it is.
+func passthrough(upath string) bool {
+	return isHidden(path.Base(upath))
+}
+
+func (cs *ContentAddressedStorage) Open(upath string) (File, error) {
+	if passthrough(upath) {
+		return cs.Backend.Open(upath)
+	}
+	pointer, err := cs.readPointer(upath)
+	if err != nil {
+		return nil, err
+	}
+	if pointer == nil {
+		return cs.Backend.Open(upath)
+	}
+	return cs.Backend.Open(contentPath(pointer.hash()))
+}
+
+func (cs *ContentAddressedStorage) Stat(upath string) (os.FileInfo, error) {
+	info, err := cs.Backend.Stat(upath)
+	if err != nil || info.IsDir() || passthrough(upath) {
+		return info, err
+	}
+	return cs.describe(upath, info)
+}
+
+// describe reports the size of the content a pointer refers to in place of
+// the size of the pointer.
+func (cs *ContentAddressedStorage) describe(upath string, info os.FileInfo) (os.FileInfo, error) {
+	pointer, err := cs.readPointer(upath)
+	if err != nil || pointer == nil {
+		return info, err
+	}
+	return &fileInfo{name: info.Name(), size: pointer.Size, modTime: info.ModTime()}, nil
+}
+
+func (cs *ContentAddressedStorage) List(upath string) ([]os.FileInfo, error) {
+	infos, err := cs.Backend.List(upath)
+	if err != nil {
+		return nil, err
+	}
+
+	marked := map[string]bool{}
+	for _, info := range infos {
+		if name := info.Name(); strings.HasSuffix(name, POINTER_SUFFIX) {
+			marked[strings.TrimSuffix(name, POINTER_SUFFIX)] = true
+		}
+	}
+
+	described := infos[:0]
+	for _, info := range infos {
+		switch {
+		case strings.HasSuffix(info.Name(), POINTER_SUFFIX):
+			continue
+		case marked[info.Name()] && !info.IsDir():
+			if pointerInfo, err := cs.describe(path.Join(upath, info.Name()), info); err == nil {
+				info = pointerInfo
+			}
+		}
+		described = append(described, info)
+	}
+	return described, nil
+}
+
+func (cs *ContentAddressedStorage) Create(upath string) (Upload, error) {
+	if passthrough(upath) {
+		return cs.Backend.Create(upath)
+	}
+
+	dir := cs.StagingDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	temp, err := ioutil.TempFile(dir, UPLOAD_PREFIX+"content.")
+	if err != nil {
+		return nil, err
+	}
+	return &contentUpload{storage: cs, upath: upath, temp: temp, hash: sha256.New()}, nil
+}
+
+// Delete removes the pointer at upath and releases its content.
+func (cs *ContentAddressedStorage) Delete(upath string) error {
+	if passthrough(upath) {
+		return cs.Backend.Delete(upath)
+	}
+
+	contentIndexLock.Lock()
+	defer contentIndexLock.Unlock()
+
+	pointer, err := cs.readPointer(upath)
+	if err != nil {
+		return err
+	}
+	if err := cs.Backend.Delete(upath); err != nil {
+		return err
+	}
+	if err := cs.unmark(upath); err != nil {
+		log.Printf("failed to remove the pointer sidecar of %s: %s", upath, err)
+	}
+
+	if pointer != nil {
+		if err := cs.release(pointer.hash()); err != nil {
+			log.Printf("failed to release content %s: %s", pointer.hash(), err)
+		}
+	}
+	return nil
+}
+
+// Mkdir creates an empty directory when the backend supports them.
+func (cs *ContentAddressedStorage) Mkdir(upath string) error {
+	maker, ok := cs.Backend.(directoryMaker)
+	if !ok {
+		return &os.PathError{Op: "mkdir", Path: upath, Err: os.ErrPermission}
+	}
+	return maker.Mkdir(upath)
+}
+
+func (cs *ContentAddressedStorage) mark(upath, hash string) error {
+	upload, err := cs.Backend.Create(upath + POINTER_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := io.WriteString(upload, hash); err != nil {
+		return err
+	}
+	return upload.Commit(true)
+}
+
+func (cs *ContentAddressedStorage) unmark(upath string) error {
+	err := cs.Backend.Delete(upath + POINTER_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// storeContent copies staged content to its content path unless the same
+// content is already stored.
+func (cs *ContentAddressedStorage) storeContent(hash string, staged *os.File) error {
+	if _, err := cs.Backend.Stat(contentPath(hash)); err == nil {
+		return nil
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	upload, err := cs.Backend.Create(contentPath(hash))
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := io.Copy(upload, staged); err != nil {
+		return err
+	}
+	err = upload.Commit(false)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// references returns the number of pointers that refer to the content.
+func (cs *ContentAddressedStorage) references(hash string) (int, error) {
+	data, err := readBlob(cs.Backend, contentPath(hash)+".refs")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (cs *ContentAddressedStorage) setReferences(hash string, count int) error {
+	upload, err := cs.Backend.Create(contentPath(hash) + ".refs")
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := io.WriteString(upload, strconv.Itoa(count)); err != nil {
+		return err
+	}
+	return upload.Commit(true)
+}
+
+func (cs *ContentAddressedStorage) retain(hash string) error {
+	count, err := cs.references(hash)
+	if err != nil {
+		return err
+	}
+	return cs.setReferences(hash, count+1)
+}
+
+// release drops a reference to the content and deletes the content when it
+// was the last one.
+func (cs *ContentAddressedStorage) release(hash string) error {
+	count, err := cs.references(hash)
+	if err != nil {
+		return err
+	}
+	if count > 1 {
+		return cs.setReferences(hash, count-1)
+	}
+
+	if err := cs.Backend.Delete(contentPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = cs.Backend.Delete(contentPath(hash) + ".refs")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// contentUpload hashes a blob into a staging file. Committing it stores the
+// content unless it is already stored, writes the pointer, and then marks the
+// blob as a pointer. Until it is marked, a pointer that replaced another is
+// served as it is rather than followed to the wrong content.
+type contentUpload struct {
+	storage *ContentAddressedStorage
+	upath   string
+	temp    *os.File
+	hash    hash.Hash
+	size    int64
+}
+
+func (u *contentUpload) Write(p []byte) (int, error) {
+	n, err := u.temp.Write(p)
+	u.hash.Write(p[:n])
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *contentUpload) Commit(replace bool) error {
+	cs := u.storage
+	hash := hex.EncodeToString(u.hash.Sum(nil))
+	if err := cs.storeContent(hash, u.temp); err != nil {
+		return err
+	}
+
+	contentIndexLock.Lock()
+	defer contentIndexLock.Unlock()
+
+	// The content may have been released since it was found to be
+	// stored.
+	if err := cs.storeContent(hash, u.temp); err != nil {
+		return err
+	}
+
+	var previous *contentPointer
+	if replace {
+		previous, _ = cs.readPointer(u.upath)
+	}
+
+	if err := cs.retain(hash); err != nil {
+		return err
+	}
+	if err := u.writePointer(hash, replace); err != nil {
+		if rerr := cs.release(hash); rerr != nil {
+			log.Printf("failed to release content %s: %s", hash, rerr)
+		}
+		return err
+	}
+	if err := cs.mark(u.upath, hash); err != nil {
+		// The unmarked pointer would be served as it is, so it is removed
+		// along with the blob it replaced.
+		if derr := cs.Backend.Delete(u.upath); derr != nil {
+			log.Printf("failed to remove unmarked pointer %s: %s", u.upath, derr)
+		}
+		if rerr := cs.release(hash); rerr != nil {
+			log.Printf("failed to release content %s: %s", hash, rerr)
+		}
+		if previous != nil {
+			if rerr := cs.release(previous.hash()); rerr != nil {
+				log.Printf("failed to release content %s: %s", previous.hash(), rerr)
+			}
+		}
+		return err
+	}
+
+	if previous != nil {
+		if err := cs.release(previous.hash()); err != nil {
+			log.Printf("failed to release content %s: %s", previous.hash(), err)
+		}
+	}
+	return nil
+}
+
+func (u *contentUpload) writePointer(hash string, replace bool) error {
+	data, err := json.Marshal(&contentPointer{Content: pointerPrefix + hash, Size: u.size})
+	if err != nil {
+		return err
+	}
+
+	upload, err := u.storage.Backend.Create(u.upath)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := upload.Write(data); err != nil {
+		return err
+	}
+	return upload.Commit(replace)
+}
+
+func (u *contentUpload) Close() error {
+	u.temp.Close()
+	return os.Remove(u.temp.Name())
+}
@@ -0,0 +1,138 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("ContentAddressedStorage", func() {
+	const blobDigest = "c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"
+
+	var (
+		tempDir string
+		handler *handlers.FileServer
+	)
+
+	serve := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		return serveRequest(handler, "", method, target, strings.NewReader(body), headers)
+	}
+
+	contentFile := func(digest string) string {
+		return filepath.Join(tempDir, handlers.CONTENT_DIR, digest[:2], digest)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "cas")
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = &handlers.FileServer{
+			Root: tempDir,
+			Storage: &handlers.ContentAddressedStorage{
+				Backend:    &handlers.LocalStorage{Root: tempDir},
+				StagingDir: tempDir,
+			},
+		}
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("stores identical blobs once", func() {
+		Expect(serve(http.MethodPut, "/a/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+		Expect(serve(http.MethodPut, "/b/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+		Expect(contentFile(blobDigest)).To(BeARegularFile())
+		Expect(ioutil.ReadFile(contentFile(blobDigest) + ".refs")).To(BeEquivalentTo("2"))
+
+		pointer, err := ioutil.ReadFile(filepath.Join(tempDir, "a", "blob.tgz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(pointer)).To(ContainSubstring("sha256:" + blobDigest))
+		Expect(ioutil.ReadFile(filepath.Join(tempDir, "a", "blob.tgz"+handlers.POINTER_SUFFIX))).To(BeEquivalentTo(blobDigest))
+
+		response := serve(http.MethodGet, "/b/blob.tgz", "", map[string]string{"Range": "bytes=5-"})
+		Expect(response.Code).To(Equal(http.StatusPartialContent))
+		Expect(response.Body.String()).To(Equal("data"))
+		Expect(response.Header().Get("ETag")).To(Equal(`"` + blobDigest + `"`))
+	})
+
+	It("deletes content with the last path that refers to it", func() {
+		Expect(serve(http.MethodPut, "/a/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+		Expect(serve(http.MethodPut, "/b/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+		Expect(serve(http.MethodDelete, "/a/blob.tgz", "", nil).Code).To(Equal(http.StatusNoContent))
+		Expect(contentFile(blobDigest)).To(BeARegularFile())
+		Expect(serve(http.MethodGet, "/b/blob.tgz", "", nil).Body.String()).To(Equal("blob-data"))
+
+		Expect(serve(http.MethodDelete, "/b/blob.tgz", "", nil).Code).To(Equal(http.StatusNoContent))
+		Expect(contentFile(blobDigest)).NotTo(BeAnExistingFile())
+		Expect(contentFile(blobDigest) + ".refs").NotTo(BeAnExistingFile())
+	})
+
+	It("releases the previous content when a blob is replaced", func() {
+		handler.Overwrite = handlers.OverwriteRules{{Prefix: "/", Policy: handlers.OverwriteReplace}}
+		Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+		Expect(serve(http.MethodPut, "/blob.tgz", "new-data", nil).Code).To(Equal(http.StatusNoContent))
+
+		Expect(contentFile(blobDigest)).NotTo(BeAnExistingFile())
+		Expect(serve(http.MethodGet, "/blob.tgz", "", nil).Body.String()).To(Equal("new-data"))
+	})
+
+	It("reports the size of the content in listings", func() {
+		Expect(serve(http.MethodPut, "/dir/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+		response := serve(http.MethodGet, "/dir/", "", map[string]string{"Accept": "application/json"})
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(ContainSubstring(`"size":9`))
+
+		response = serve(http.MethodGet, "/", "", map[string]string{"Accept": "application/json"})
+		Expect(response.Body.String()).NotTo(ContainSubstring(handlers.CONTENT_DIR))
+	})
+
+	It("serves blobs stored before content addressing was enabled", func() {
+		err := ioutil.WriteFile(filepath.Join(tempDir, "legacy.tgz"), []byte("legacy-data"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(serve(http.MethodGet, "/legacy.tgz", "", nil).Body.String()).To(Equal("legacy-data"))
+		Expect(serve(http.MethodDelete, "/legacy.tgz", "", nil).Code).To(Equal(http.StatusNoContent))
+	})
+
+	It("serves a blob that looks like a pointer as it was stored", func() {
+		Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+		forged := `{"content":"sha256:` + blobDigest + `","size":9}`
+		err := ioutil.WriteFile(filepath.Join(tempDir, "forged.tgz"), []byte(forged), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(serve(http.MethodGet, "/forged.tgz", "", nil).Body.String()).To(Equal(forged))
+		Expect(serve(http.MethodDelete, "/forged.tgz", "", nil).Code).To(Equal(http.StatusNoContent))
+		Expect(ioutil.ReadFile(contentFile(blobDigest) + ".refs")).To(BeEquivalentTo("1"))
+		Expect(serve(http.MethodGet, "/blob.tgz", "", nil).Body.String()).To(Equal("blob-data"))
+	})
+
+	It("stores metadata sidecars directly", func() {
+		Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+		metadata, err := ioutil.ReadFile(filepath.Join(tempDir, "blob.tgz"+handlers.METADATA_SUFFIX))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metadata)).To(ContainSubstring(blobDigest))
+		Expect(filepath.Join(tempDir, "blob.tgz"+handlers.METADATA_SUFFIX+handlers.POINTER_SUFFIX)).NotTo(BeAnExistingFile())
+	})
+
+	It("does not serve the content directory", func() {
+		Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+		Expect(serve(http.MethodGet, "/"+handlers.CONTENT_DIR+"/c2/"+blobDigest, "", nil).Code).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+const (
+	MD5    = "MD5"
+	SHA1   = "SHA"
+	SHA256 = "SHA-256"
+)
+
+// Digests holds the checksums of a blob keyed by their RFC 3230 algorithm
+// names.
+type Digests map[string][]byte
+
+type digestMismatchError struct {
+	Algorithm string
+	Expected  []byte
+	Actual    []byte
+}
+
+func (e *digestMismatchError) Error() string {
+	return fmt.Sprintf("%s digest mismatch: expected %x, computed %x", e.Algorithm, e.Expected, e.Actual)
+}
+
+func isDigestMismatch(err error) bool {
+	_, ok := err.(*digestMismatchError)
+	return ok
+}
+
+// Verify ensures that every digest in expected matches the corresponding
+// computed digest.
+func (d Digests) Verify(expected Digests) error {
+	for algorithm, value := range expected {
+		if !bytes.Equal(d[algorithm], value) {
+			return &digestMismatchError{Algorithm: algorithm, Expected: value, Actual: d[algorithm]}
+		}
+	}
+	return nil
+}
+
+// SetHeaders writes the digests to the response as an RFC 3230 Digest header
+// and the hex encoded X-Checksum-* headers.
+func (d Digests) SetHeaders(h http.Header) {
+	var instances []string
+	for _, algorithm := range []string{MD5, SHA1, SHA256} {
+		value, ok := d[algorithm]
+		if !ok {
+			continue
+		}
+		instances = append(instances, algorithm+"="+base64.StdEncoding.EncodeToString(value))
+		h.Set(checksumHeaders[algorithm], hex.EncodeToString(value))
+	}
+	if len(instances) > 0 {
+		h.Set("Digest", strings.Join(instances, ","))
+	}
+}
+
+var checksumHeaders = map[string]string{
+	MD5:    "X-Checksum-Md5",
+	SHA1:   "X-Checksum-Sha1",
+	SHA256: "X-Checksum-Sha256",
+}
+
+// digester computes the MD5, SHA-1, and SHA-256 digests of everything
+// written to it.
+type digester map[string]hash.Hash
+
+func newDigester() digester {
+	return digester{
+		MD5:    md5.New(),
+		SHA1:   sha1.New(),
+		SHA256: sha256.New(),
+	}
+}
+
+func (d digester) Write(p []byte) (int, error) {
+	for _, h := range d {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (d digester) Digests() Digests {
+	digests := Digests{}
+	for algorithm, h := range d {
+		digests[algorithm] = h.Sum(nil)
+	}
+	return digests
+}
+
+// requestDigests collects the digests a client supplied with an upload from
+// the Content-MD5, Digest, and X-Checksum-* headers. Digest algorithms that
+// are not supported are ignored.
+func requestDigests(h http.Header) (Digests, error) {
+	expected := Digests{}
+	add := func(algorithm string, value []byte) error {
+		if existing, ok := expected[algorithm]; ok && !bytes.Equal(existing, value) {
+			return fmt.Errorf("conflicting %s digests supplied", algorithm)
+		}
+		expected[algorithm] = value
+		return nil
+	}
+
+	if contentMD5 := h.Get("Content-MD5"); contentMD5 != "" {
+		value, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-MD5 header: %s", err)
+		}
+		if err := add(MD5, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, header := range h[http.CanonicalHeaderKey("Digest")] {
+		for _, instance := range strings.Split(header, ",") {
+			parts := strings.SplitN(strings.TrimSpace(instance), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid Digest header: %q", header)
+			}
+			algorithm := strings.ToUpper(parts[0])
+			if _, ok := checksumHeaders[algorithm]; !ok {
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s digest: %s", algorithm, err)
+			}
+			if err := add(algorithm, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for algorithm, header := range checksumHeaders {
+		checksum := h.Get(header)
+		if checksum == "" {
+			continue
+		}
+		value, err := hex.DecodeString(checksum)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %s", header, err)
+		}
+		if err := add(algorithm, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return expected, nil
+}
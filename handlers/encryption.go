@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// An encrypted blob starts with a header that names the key its data key is
+// wrapped with, followed by the content sealed in chunks of
+// encryptionChunkSize bytes. Each chunk is sealed with its index and a flag
+// that marks the last chunk, so chunks cannot be reordered or dropped.
+const (
+	encryptionMagic     = "DAVBENC1"
+	encryptionHeader    = 80
+	encryptionChunkSize = 64 * 1024
+)
+
+var (
+	errUnknownKey       = errors.New("blob is encrypted with an unknown key")
+	errDecryptionFailed = errors.New("blob could not be decrypted")
+)
+
+// Keyring holds the AES-256 keys that blobs are encrypted with. The first
+// key encrypts new blobs; the others can only decrypt the blobs that were
+// encrypted with them.
+type Keyring struct {
+	keys []*encryptionKey
+}
+
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// NewKeyring returns a keyring of base64 encoded 32 byte keys.
+func NewKeyring(encodedKeys []string) (*Keyring, error) {
+	if len(encodedKeys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+
+	keyring := &Keyring{}
+	for i, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %d is not a base64 encoded 32 byte key", i+1)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		keyring.keys = append(keyring.keys, &encryptionKey{id: sum[:8], aead: aead})
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyring from a file of base64 encoded keys, one per
+// line. Blank lines and lines starting with # are ignored.
+func LoadKeyring(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewKeyring(keys)
+}
+
+func (k *Keyring) current() *encryptionKey {
+	return k.keys[0]
+}
+
+func (k *Keyring) key(id []byte) (*encryptionKey, error) {
+	for _, key := range k.keys {
+		if bytes.Equal(key.id, id) {
+			return key, nil
+		}
+	}
+	return nil, errUnknownKey
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce that the chunk at index is sealed with.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptedStorage encrypts blobs in Backend with a data key of their own,
+// which is stored with the blob wrapped by the current key of Keys. Blobs
+// stored before encryption was enabled are served as they are.
+type EncryptedStorage struct {
+	Backend Storage
+	Keys    *Keyring
+}
+
+// encryptedBlob is the header of an encrypted blob.
+type encryptedBlob struct {
+	keyID     []byte
+	chunkSize int64
+	aead      cipher.AEAD
+	size      int64
+}
+
+// readEncryptionHeader returns the header of the encrypted blob in file,
+// which is stored in size bytes, or nil when the blob is not encrypted.
+func (es *EncryptedStorage) readEncryptionHeader(file File, size int64) (*encryptedBlob, error) {
+	if size < encryptionHeader {
+		return nil, nil
+	}
+	header := make([]byte, encryptionHeader)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != encryptionMagic {
+		return nil, nil
+	}
+
+	blob := &encryptedBlob{
+		keyID:     header[8:16],
+		chunkSize: int64(binary.BigEndian.Uint32(header[16:20])),
+	}
+	key, err := es.Keys.key(blob.keyID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := key.aead.Open(nil, header[20:32], header[32:], header[:20])
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	if blob.aead, err = newAEAD(dataKey); err != nil {
+		return nil, err
+	}
+
+	sealed := size - encryptionHeader
+	overhead := int64(blob.aead.Overhead())
+	chunks := (sealed + blob.chunkSize + overhead - 1) / (blob.chunkSize + overhead)
+	blob.size = sealed - chunks*overhead
+	if blob.chunkSize == 0 || chunks == 0 || blob.size < 0 {
+		return nil, errDecryptionFailed
+	}
+	return blob, nil
+}
+
+// openEncrypted opens the blob at upath in the backend and reads its header.
+// The file is positioned at the start of the blob.
+func (es *EncryptedStorage) openEncrypted(upath string) (File, *encryptedBlob, error) {
+	file, err := es.Backend.Open(upath)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	var blob *encryptedBlob
+	if err == nil {
+		blob, err = es.readEncryptionHeader(file, size)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, blob, nil
+}
+
+func (es *EncryptedStorage) Open(upath string) (File, error) {
+	file, blob, err := es.openEncrypted(upath)
+	if err != nil || blob == nil {
+		return file, err
+	}
+	return &decryptedFile{file: file, blob: blob, chunk: -1}, nil
+}
+
+func (es *EncryptedStorage) Stat(upath string) (os.FileInfo, error) {
+	info, err := es.Backend.Stat(upath)
+	if err != nil {
+		return nil, err
+	}
+	return es.describe(upath, info)
+}
+
+// describe reports the size of the decrypted content of an encrypted blob.
+func (es *EncryptedStorage) describe(upath string, info os.FileInfo) (os.FileInfo, error) {
+	if info.IsDir() || info.Size() < encryptionHeader {
+		return info, nil
+	}
+	file, blob, err := es.openEncrypted(upath)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	if blob == nil {
+		return info, nil
+	}
+	return &fileInfo{name: info.Name(), size: blob.size, modTime: info.ModTime()}, nil
+}
+
+func (es *EncryptedStorage) List(upath string) ([]os.FileInfo, error) {
+	infos, err := es.Backend.List(upath)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if described, err := es.describe(path.Join(upath, info.Name()), info); err == nil {
+			infos[i] = described
+		}
+	}
+	return infos, nil
+}
+
+func (es *EncryptedStorage) Create(upath string) (Upload, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := es.Keys.current()
+	header := make([]byte, 32, encryptionHeader)
+	copy(header, encryptionMagic)
+	copy(header[8:16], key.id)
+	binary.BigEndian.PutUint32(header[16:20], encryptionChunkSize)
+	if _, err := rand.Read(header[20:32]); err != nil {
+		return nil, err
+	}
+	header = key.aead.Seal(header, header[20:32], dataKey, header[:20])
+
+	upload, err := es.Backend.Create(upath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := upload.Write(header); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	return &encryptedUpload{upload: upload, aead: aead, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (es *EncryptedStorage) Delete(upath string) error {
+	return es.Backend.Delete(upath)
+}
+
+// Mkdir creates an empty directory when the backend supports them.
+func (es *EncryptedStorage) Mkdir(upath string) error {
+	maker, ok := es.Backend.(directoryMaker)
+	if !ok {
+		return &os.PathError{Op: "mkdir", Path: upath, Err: os.ErrPermission}
+	}
+	return maker.Mkdir(upath)
+}
+
+// Reencrypt encrypts the blobs beneath upath that are not encrypted with the
+// current key, or not encrypted at all, with the current key. Upload
+// sessions and temporary upload files are skipped. Rewritten is called with
+// the path of each blob that is encrypted again.
+func (es *EncryptedStorage) Reencrypt(upath string, rewritten func(string)) error {
+	info, err := es.Backend.Stat(upath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return es.reencryptBlob(upath, rewritten)
+	}
+
+	infos, err := es.Backend.List(upath)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if upath == "/" && name == UPLOAD_SESSIONS_DIR || !info.IsDir() && strings.HasPrefix(name, UPLOAD_PREFIX) {
+			continue
+		}
+		if err := es.Reencrypt(path.Join(upath, name), rewritten); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *EncryptedStorage) reencryptBlob(upath string, rewritten func(string)) error {
+	blob, err := es.Open(upath)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if decrypted, ok := blob.(*decryptedFile); ok && bytes.Equal(decrypted.blob.keyID, es.Keys.current().id) {
+		return nil
+	}
+
+	upload, err := es.Create(upath)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := io.Copy(upload, blob); err != nil {
+		return err
+	}
+	if err := upload.Commit(true); err != nil {
+		return err
+	}
+	rewritten(upath)
+	return nil
+}
+
+// encryptedUpload seals the content written to it in chunks. A full chunk
+// is only sealed once more content arrives so that the last chunk can be
+// marked when the upload is committed.
+type encryptedUpload struct {
+	upload Upload
+	aead   cipher.AEAD
+	buf    []byte
+	chunk  int64
+	sealed bool
+}
+
+func (u *encryptedUpload) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(u.buf) == cap(u.buf) {
+			if err := u.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(u.buf[len(u.buf):cap(u.buf)], p)
+		u.buf = u.buf[:len(u.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (u *encryptedUpload) seal(last bool) error {
+	sealed := u.aead.Seal(nil, chunkNonce(u.chunk, last), u.buf, nil)
+	if _, err := u.upload.Write(sealed); err != nil {
+		return err
+	}
+	u.buf = u.buf[:0]
+	u.chunk++
+	return nil
+}
+
+func (u *encryptedUpload) Commit(replace bool) error {
+	if !u.sealed {
+		if err := u.seal(true); err != nil {
+			return err
+		}
+		u.sealed = true
+	}
+	return u.upload.Commit(replace)
+}
+
+func (u *encryptedUpload) Close() error {
+	return u.upload.Close()
+}
+
+// decryptedFile reads the decrypted content of an encrypted blob one chunk
+// at a time, so seeking only decrypts the chunks that are read.
+type decryptedFile struct {
+	file File
+	blob *encryptedBlob
+
+	offset    int64
+	chunk     int64
+	plaintext []byte
+}
+
+func (f *decryptedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.blob.size {
+		return 0, io.EOF
+	}
+
+	chunk := f.offset / f.blob.chunkSize
+	if chunk != f.chunk {
+		if err := f.decrypt(chunk); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.plaintext[f.offset-chunk*f.blob.chunkSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *decryptedFile) decrypt(chunk int64) error {
+	sealedSize := f.blob.chunkSize + int64(f.blob.aead.Overhead())
+	if _, err := f.file.Seek(encryptionHeader+chunk*sealedSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	last := chunk == (f.blob.size-1)/f.blob.chunkSize || f.blob.size == 0
+	sealed := make([]byte, sealedSize)
+	n, err := io.ReadFull(f.file, sealed)
+	if err != nil && !(last && err == io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	f.plaintext, err = f.blob.aead.Open(f.plaintext[:0], chunkNonce(chunk, last), sealed[:n], nil)
+	if err != nil {
+		f.chunk = -1
+		return errDecryptionFailed
+	}
+	f.chunk = chunk
+	return nil
+}
+
+func (f *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.blob.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+
+	// Decrypting the chunk at the offset now reports a damaged blob before
+	// a response starts.
+	if chunk := offset / f.blob.chunkSize; offset < f.blob.size && chunk != f.chunk {
+		if err := f.decrypt(chunk); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func (f *decryptedFile) Close() error {
+	return f.file.Close()
+}
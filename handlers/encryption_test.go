@@ -0,0 +1,174 @@
+package handlers_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("EncryptedStorage", func() {
+	const (
+		oldKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+		newKey = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	)
+
+	var (
+		tempDir string
+		storage *handlers.EncryptedStorage
+		handler *handlers.FileServer
+		content string
+	)
+
+	keyring := func(keys ...string) *handlers.Keyring {
+		keyring, err := handlers.NewKeyring(keys)
+		Expect(err).NotTo(HaveOccurred())
+		return keyring
+	}
+
+	serve := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		return serveRequest(handler, "", method, target, strings.NewReader(body), headers)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "encryption")
+		Expect(err).NotTo(HaveOccurred())
+
+		storage = &handlers.EncryptedStorage{
+			Backend: &handlers.LocalStorage{Root: tempDir},
+			Keys:    keyring(oldKey),
+		}
+		handler = &handlers.FileServer{Root: tempDir, Storage: storage}
+
+		// Spans several chunks with a partial last chunk.
+		content = strings.Repeat("licensed-binary-", 10000)
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("stores blobs encrypted and serves them decrypted", func() {
+		response := serve(http.MethodPut, "/dir/blob.tgz", content, nil)
+		Expect(response.Code).To(Equal(http.StatusCreated))
+
+		stored, err := ioutil.ReadFile(filepath.Join(tempDir, "dir", "blob.tgz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(stored)).NotTo(ContainSubstring("licensed-binary"))
+
+		response = serve(http.MethodGet, "/dir/blob.tgz", "", nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Content-Length")).To(Equal("160000"))
+		Expect(response.Body.String()).To(Equal(content))
+	})
+
+	It("decrypts only the requested range", func() {
+		Expect(serve(http.MethodPut, "/blob.tgz", content, nil).Code).To(Equal(http.StatusCreated))
+
+		response := serve(http.MethodGet, "/blob.tgz", "", map[string]string{"Range": "bytes=65530-65545"})
+		Expect(response.Code).To(Equal(http.StatusPartialContent))
+		Expect(response.Body.String()).To(Equal(content[65530:65546]))
+
+		response = serve(http.MethodGet, "/blob.tgz", "", map[string]string{"Range": "bytes=-20"})
+		Expect(response.Code).To(Equal(http.StatusPartialContent))
+		Expect(response.Body.String()).To(Equal(content[len(content)-20:]))
+	})
+
+	It("serves empty blobs", func() {
+		Expect(serve(http.MethodPut, "/empty", "", nil).Code).To(Equal(http.StatusCreated))
+
+		response := serve(http.MethodGet, "/empty", "", nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.Len()).To(BeZero())
+	})
+
+	It("serves blobs stored before encryption was enabled", func() {
+		err := ioutil.WriteFile(filepath.Join(tempDir, "plain.txt"), []byte("plain-data"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(serve(http.MethodGet, "/plain.txt", "", nil).Body.String()).To(Equal("plain-data"))
+	})
+
+	It("refuses to serve blobs that were tampered with", func() {
+		Expect(serve(http.MethodPut, "/blob.tgz", content, nil).Code).To(Equal(http.StatusCreated))
+
+		blobPath := filepath.Join(tempDir, "blob.tgz")
+		stored, err := ioutil.ReadFile(blobPath)
+		Expect(err).NotTo(HaveOccurred())
+		stored[100] ^= 1
+		Expect(ioutil.WriteFile(blobPath, stored, 0644)).To(Succeed())
+
+		response := serve(http.MethodGet, "/blob.tgz", "", map[string]string{"Range": "bytes=0-9"})
+		Expect(response.Code).To(Equal(http.StatusInternalServerError))
+	})
+
+	Context("when the key is rotated", func() {
+		BeforeEach(func() {
+			Expect(serve(http.MethodPut, "/a/blob.tgz", content, nil).Code).To(Equal(http.StatusCreated))
+			Expect(serve(http.MethodPut, "/b/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+			storage.Keys = keyring(newKey, oldKey)
+		})
+
+		It("decrypts blobs with the old key", func() {
+			Expect(serve(http.MethodGet, "/a/blob.tgz", "", nil).Body.String()).To(Equal(content))
+		})
+
+		It("re-encrypts blobs with the new key", func() {
+			Expect(serve(http.MethodPut, "/c/blob.tgz", "new-data", nil).Code).To(Equal(http.StatusCreated))
+
+			var rewritten []string
+			err := storage.Reencrypt("/", func(upath string) { rewritten = append(rewritten, upath) })
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(ConsistOf(
+				"/a/blob.tgz", "/a/blob.tgz.metadata",
+				"/b/blob.tgz", "/b/blob.tgz.metadata",
+			))
+
+			storage.Keys = keyring(newKey)
+			Expect(serve(http.MethodGet, "/a/blob.tgz", "", nil).Body.String()).To(Equal(content))
+			Expect(serve(http.MethodGet, "/b/blob.tgz", "", nil).Body.String()).To(Equal("blob-data"))
+		})
+
+		It("fails to serve blobs once the old key is removed", func() {
+			storage.Keys = keyring(newKey)
+			Expect(serve(http.MethodGet, "/a/blob.tgz", "", nil).Code).To(Equal(http.StatusInternalServerError))
+		})
+	})
+
+	Describe("LoadKeyring", func() {
+		It("reads one key per line", func() {
+			keyFile := filepath.Join(tempDir, "keys")
+			keys := "# rotated 2026-10-01\n" + newKey + "\n\n" + oldKey + "\n"
+			Expect(ioutil.WriteFile(keyFile, []byte(keys), 0600)).To(Succeed())
+
+			storage.Keys, _ = handlers.LoadKeyring(keyFile)
+			Expect(storage.Keys).NotTo(BeNil())
+			Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			storage.Keys = keyring(newKey)
+			Expect(serve(http.MethodGet, "/blob.tgz", "", nil).Body.String()).To(Equal("blob-data"))
+		})
+
+		It("rejects keys that are not 32 bytes", func() {
+			keyFile := filepath.Join(tempDir, "keys")
+			Expect(ioutil.WriteFile(keyFile, bytes.Repeat([]byte("a"), 44), 0600)).To(Succeed())
+
+			_, err := handlers.LoadKeyring(keyFile)
+			Expect(err).To(MatchError(ContainSubstring("not a base64 encoded 32 byte key")))
+
+			_, err = handlers.NewKeyring(nil)
+			Expect(err).To(MatchError("no encryption keys"))
+		})
+	})
+})
@@ -1,85 +1,287 @@
 package handlers
 
 import (
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 )
 
 const REDIRECT_SUFFIX = ".redirect"
 
 type FileServer struct {
+	// Root is the directory blobs are stored in when Storage is not set.
+	// Resumable upload sessions are always staged beneath it.
 	Root string
+
+	// Storage holds the blobs. It defaults to LocalStorage on Root.
+	Storage Storage
+
+	// WebDAV enables the RFC 4918 class 1 methods (OPTIONS, PROPFIND,
+	// PROPPATCH, MKCOL, COPY and MOVE) and recursive collection deletes.
+	WebDAV bool
+
+	// Overwrite decides whether a PUT may replace an existing blob when the
+	// request has no preconditions. By default blobs are never replaced.
+	Overwrite OverwriteRules
+
+	// DisableListings refuses GET and HEAD requests for directories instead
+	// of listing their contents.
+	DisableListings bool
+
+	// Locks enables LOCK and UNLOCK in WebDAV mode. Requests that modify a
+	// locked path must submit the lock token in an If header.
+	Locks *LockManager
+
+	// Quotas limit the bytes and blobs that may be stored beneath a prefix
+	// or owned by a user. Uploads that would exceed a quota are refused
+	// with 507 Insufficient Storage.
+	Quotas QuotaRules
+
+	// MaxUploadSize limits the size of uploaded blobs unless an entry of
+	// UploadLimits applies. Larger uploads are refused with 413 Payload
+	// Too Large. Zero is unlimited.
+	MaxUploadSize int64
+	UploadLimits  UploadLimitRules
+
+	// MinFreeSpace is the number of bytes that must remain free on the
+	// file system of Root. Uploads that would leave less are refused with
+	// 507 Insufficient Storage.
+	MinFreeSpace int64
+
+	// Metrics counts uploads and redirects when set.
+	Metrics *Metrics
+
+	// UsageTracker counts the blobs stored for Quotas, usage reports and
+	// Metrics. It may be shared by the file servers of successive
+	// configurations of the same storage so that it is not rescanned.
+	UsageTracker *UsageTracker
+
+	usage UsageTracker
 }
 
 func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	upath := r.URL.Path
-	if !strings.HasPrefix(upath, "/") {
-		upath = "/" + upath
-		r.URL.Path = upath
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		r.URL.Path = "/" + r.URL.Path
 	}
 
-	upath = path.Clean(upath)
+	upath := cleanPath(r.URL.Path)
 	if strings.Contains(upath, "..") || strings.Contains(upath, "\x00") {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if isReservedPath(upath) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	location := filepath.Join(fs.Root, upath)
-	log.Printf("method: %s, location: %s", r.Method, location)
+	storage := fs.storage()
+	log.Printf("method: %s, path: %s", r.Method, upath)
+
+	if fs.Locks != nil && !fs.checkLocks(w, r, upath) {
+		return
+	}
+
+	if isUploadSessionRequest(r) {
+		fs.serveUploadSession(w, r, upath)
+		return
+	}
 
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
-		redirect, err := ioutil.ReadFile(location + REDIRECT_SUFFIX)
+		if _, ok := r.URL.Query()[USAGE_PARAM]; ok {
+			fs.serveUsage(w, r, upath)
+			return
+		}
+
+		redirect, err := readBlob(storage, upath+REDIRECT_SUFFIX)
 		if err == nil {
+			fs.Metrics.redirected()
 			http.Redirect(w, r, string(redirect), http.StatusTemporaryRedirect)
 			return
 		}
-		httpFS := http.FileServer(http.Dir(fs.Root))
-		httpFS.ServeHTTP(w, r)
+
+		info, err := storage.Stat(upath)
+		if err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+		if info.IsDir() {
+			fs.serveListing(w, r, upath)
+			return
+		}
+		if metadata, err := readMetadata(storage, upath, info); err == nil {
+			w.Header().Set("ETag", metadata.ETag())
+			metadata.Digests().SetHeaders(w.Header())
+		}
+
+		blob, err := openBlob(w, r, storage, upath)
+		if err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+		defer blob.Close()
+		http.ServeContent(w, r, info.Name(), info.ModTime(), blob)
 
 	case http.MethodPut:
-		err := os.MkdirAll(filepath.Dir(location), 0755)
+		expected, err := requestDigests(r.Header)
 		if err != nil {
+			log.Printf("rejecting upload: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var precondition func(*Metadata) error
+		replaced := false
+		if hasPreconditions(r.Header) {
+			// Fail before receiving the body when possible. The
+			// preconditions are checked again before the blob is replaced.
+			if err := checkPreconditions(r.Header, storage, upath); err != nil {
+				sendErrorResponse(w, r, err)
+				return
+			}
+			precondition = func(*Metadata) error {
+				if err := checkPreconditions(r.Header, storage, upath); err != nil {
+					return err
+				}
+				_, err := storage.Stat(upath)
+				replaced = err == nil
+				return nil
+			}
+		} else if !isCreateOnly(r.Header) {
+			precondition = overwritePrecondition(fs.Overwrite.Policy(upath), storage, upath, &replaced)
+		}
+
+		if err := fs.checkUpload(upath, r.ContentLength); err != nil {
 			sendErrorResponse(w, r, err)
 			return
 		}
+		fs.limitUploadBody(w, r, upath)
+		done := fs.Metrics.uploadStarted()
+		defer done()
 
-		output, err := os.OpenFile(location, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		body, release, err := fs.checkQuota(r, upath, r.ContentLength)
+		defer release()
 		if err != nil {
 			sendErrorResponse(w, r, err)
 			return
 		}
-		defer output.Close()
 
-		_, err = io.Copy(output, r.Body)
+		metadata, err := receiveUpload(storage, upath, requestUser(r), body, expected, precondition)
+		fs.usageTracker().refresh(storage, upath)
+		if os.IsExist(err) && isCreateOnly(r.Header) {
+			err = errPreconditionFailed
+		}
 		if err != nil {
 			sendErrorResponse(w, r, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("ETag", metadata.ETag())
+		metadata.Digests().SetHeaders(w.Header())
+		if replaced {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
 
 	case http.MethodDelete:
-		err := os.Remove(location)
+		if hasPreconditions(r.Header) || isCreateOnly(r.Header) {
+			unlock := lockLocation(upath)
+			defer unlock()
+
+			if err := checkPreconditions(r.Header, storage, upath); err != nil {
+				sendErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		if fs.WebDAV {
+			if upath == "/" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			err := removeResource(storage, upath)
+			fs.usageTracker().refresh(storage, upath)
+			if err != nil {
+				sendErrorResponse(w, r, err)
+				return
+			}
+			if fs.Locks != nil {
+				fs.Locks.Remove(upath, true)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		err := storage.Delete(upath)
 		if err != nil {
 			sendErrorResponse(w, r, err)
 			return
 		}
+		if err := removeMetadata(storage, upath); err != nil {
+			log.Printf("failed to remove metadata for %s: %s", upath, err)
+		}
+		fs.usageTracker().refresh(storage, upath)
+		if fs.Locks != nil {
+			fs.Locks.Remove(upath, false)
+		}
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
+		if fs.WebDAV && isWebDAVMethod(r.Method) {
+			fs.serveWebDAV(w, r, upath)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
+func (fs *FileServer) storage() Storage {
+	if fs.Storage != nil {
+		return fs.Storage
+	}
+	return &LocalStorage{Root: fs.Root}
+}
+
+func (fs *FileServer) usageTracker() *UsageTracker {
+	if fs.UsageTracker != nil {
+		return fs.UsageTracker
+	}
+	return &fs.usage
+}
+
+// cleanPath returns the canonical, rooted form of a request path.
+func cleanPath(upath string) string {
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	return path.Clean(upath)
+}
+
 func sendErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	switch {
+	case err == errPreconditionFailed:
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case err == errOffsetMismatch:
+		w.WriteHeader(http.StatusConflict)
+	case err == errUploadTooLarge || err == errBlobTooLarge || isBodyTooLarge(err):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case err == errLowDiskSpace:
+		log.Printf("rejecting upload: %s", err)
+		w.WriteHeader(http.StatusInsufficientStorage)
+	case err == errQuotaExceeded:
+		w.WriteHeader(http.StatusInsufficientStorage)
+	case err == errUnknownKey || err == errDecryptionFailed || err == errInvalidTrailer:
+		log.Printf("failed to read blob: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	case isBackendError(err):
+		log.Printf("storage request failed: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+	case isDigestMismatch(err):
+		log.Printf("rejecting upload: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
 	case os.IsExist(err):
 		if r.Method == http.MethodDelete {
 			w.WriteHeader(http.StatusBadRequest)
@@ -1,6 +1,8 @@
 package handlers_test
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -8,8 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 
 	"github.com/sykesm/dav-blobstore/handlers"
@@ -76,6 +80,55 @@ var _ = Describe("FileServer", func() {
 				Expect(response.HeaderMap).To(HaveKeyWithValue("Location", []string{"http://example.com/redirected/resource.txt"}))
 			})
 		})
+		Context("when metadata has been recorded for the blob", func() {
+			BeforeEach(func() {
+				metadata := `{"size":9,"md5":"72b0350d00ffbfb8bb71df19e1f59209","sha1":"3bcccc96a500595533611b2ae2d9171f9ee3cb5c","sha256":"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"}`
+				err := ioutil.WriteFile(file+".metadata", []byte(metadata), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns a strong ETag and the blob digests", func() {
+				req, err := http.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				handler.ServeHTTP(response, req)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.HeaderMap).To(HaveKeyWithValue("Etag", []string{`"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`}))
+				Expect(response.HeaderMap).To(HaveKeyWithValue("Digest", []string{
+					"MD5=crA1DQD/v7i7cd8Z4fWSCQ==,SHA=O8zMlqUAWVUzYRsq4tkXH57jy1w=,SHA-256=wnUq2W7mUuTTf9OFLeYyxQ8ZNJDRMvJ6F5TJhuHxEu8=",
+				}))
+				Expect(response.Body.Bytes()).To(BeEquivalentTo("blob-data"))
+			})
+
+			It("honors If-None-Match", func() {
+				req, err := http.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.Header.Set("If-None-Match", `"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`)
+				handler.ServeHTTP(response, req)
+
+				Expect(response.Code).To(Equal(http.StatusNotModified))
+			})
+
+			Context("when the metadata does not describe the blob", func() {
+				BeforeEach(func() {
+					err := ioutil.WriteFile(file, []byte("different-blob-data"), 0644)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("ignores the metadata", func() {
+					req, err := http.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+					Expect(err).NotTo(HaveOccurred())
+
+					handler.ServeHTTP(response, req)
+
+					Expect(response.Code).To(Equal(http.StatusOK))
+					Expect(response.HeaderMap).NotTo(HaveKey("Etag"))
+					Expect(response.HeaderMap).NotTo(HaveKey("Digest"))
+				})
+			})
+		})
 	})
 
 	Describe("HEAD", func() {
@@ -135,6 +188,106 @@ var _ = Describe("FileServer", func() {
 			Expect(contents).To(BeEquivalentTo("blob-data"))
 		})
 
+		It("returns the digests of the uploaded content", func() {
+			req, err := http.NewRequest(http.MethodPut, "http://example.com/file.txt", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			req.Body = ioutil.NopCloser(strings.NewReader("blob-data"))
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(response.HeaderMap).To(HaveKeyWithValue("Digest", []string{
+				"MD5=crA1DQD/v7i7cd8Z4fWSCQ==,SHA=O8zMlqUAWVUzYRsq4tkXH57jy1w=,SHA-256=wnUq2W7mUuTTf9OFLeYyxQ8ZNJDRMvJ6F5TJhuHxEu8=",
+			}))
+			Expect(response.HeaderMap).To(HaveKeyWithValue("X-Checksum-Md5", []string{"72b0350d00ffbfb8bb71df19e1f59209"}))
+			Expect(response.HeaderMap).To(HaveKeyWithValue("X-Checksum-Sha1", []string{"3bcccc96a500595533611b2ae2d9171f9ee3cb5c"}))
+			Expect(response.HeaderMap).To(HaveKeyWithValue("X-Checksum-Sha256", []string{"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"}))
+		})
+
+		Describe("content verification", func() {
+			var req *http.Request
+
+			BeforeEach(func() {
+				var err error
+				req, err = http.NewRequest(http.MethodPut, "http://example.com/file.txt", nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.Body = ioutil.NopCloser(strings.NewReader("blob-data"))
+			})
+
+			DescribeTable("accepts matching digests",
+				func(header, value string) {
+					req.Header.Set(header, value)
+					handler.ServeHTTP(response, req)
+
+					Expect(response.Code).To(Equal(http.StatusCreated))
+					Expect(filepath.Join(tempDir, "file.txt")).To(BeARegularFile())
+				},
+				Entry("Content-MD5", "Content-MD5", "crA1DQD/v7i7cd8Z4fWSCQ=="),
+				Entry("Digest SHA", "Digest", "SHA=O8zMlqUAWVUzYRsq4tkXH57jy1w="),
+				Entry("Digest SHA-256", "Digest", "sha-256=wnUq2W7mUuTTf9OFLeYyxQ8ZNJDRMvJ6F5TJhuHxEu8="),
+				Entry("Digest with unsupported algorithms", "Digest", "UNIXsum=30637, MD5=crA1DQD/v7i7cd8Z4fWSCQ=="),
+				Entry("X-Checksum-Sha1", "X-Checksum-Sha1", "3bcccc96a500595533611b2ae2d9171f9ee3cb5c"),
+				Entry("X-Checksum-Sha256", "X-Checksum-Sha256", "c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"),
+			)
+
+			DescribeTable("rejects mismatched digests and discards the content",
+				func(header, value string) {
+					req.Header.Set(header, value)
+					handler.ServeHTTP(response, req)
+
+					Expect(response.Code).To(Equal(http.StatusBadRequest))
+
+					entries, err := ioutil.ReadDir(tempDir)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(entries).To(BeEmpty())
+				},
+				Entry("Content-MD5", "Content-MD5", "1B2M2Y8AsgTpgAmY7PhCfg=="),
+				Entry("Digest SHA", "Digest", "SHA=2jmj7l5rSw0yVb/vlWAYkK/YBwk="),
+				Entry("Digest SHA-256", "Digest", "MD5=crA1DQD/v7i7cd8Z4fWSCQ==,SHA-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="),
+				Entry("X-Checksum-Sha256", "X-Checksum-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"),
+			)
+
+			DescribeTable("rejects malformed digests",
+				func(header, value string) {
+					req.Header.Set(header, value)
+					handler.ServeHTTP(response, req)
+
+					Expect(response.Code).To(Equal(http.StatusBadRequest))
+				},
+				Entry("Content-MD5", "Content-MD5", "not base64!"),
+				Entry("Digest", "Digest", "SHA-256"),
+				Entry("X-Checksum-Sha256", "X-Checksum-Sha256", "not hex"),
+			)
+
+			It("rejects conflicting digests", func() {
+				req.Header.Set("Content-MD5", "crA1DQD/v7i7cd8Z4fWSCQ==")
+				req.Header.Set("X-Checksum-Md5", "d41d8cd98f00b204e9800998ecf8427e")
+				handler.ServeHTTP(response, req)
+
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		It("records the blob metadata", func() {
+			req, err := http.NewRequest(http.MethodPut, "http://example.com/file.txt", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			req.Body = ioutil.NopCloser(strings.NewReader("blob-data"))
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(response.HeaderMap).To(HaveKeyWithValue("Etag", []string{`"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`}))
+
+			contents, err := ioutil.ReadFile(filepath.Join(tempDir, "file.txt.metadata"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{
+				"size": 9,
+				"md5": "72b0350d00ffbfb8bb71df19e1f59209",
+				"sha1": "3bcccc96a500595533611b2ae2d9171f9ee3cb5c",
+				"sha256": "c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"
+			}`))
+		})
+
 		Context("when the target path contains directories", func() {
 			It("generates intermediate directories", func() {
 				req, err := http.NewRequest(http.MethodPut, "http://example.com/subdir1/subdir2/file.txt", nil)
@@ -173,6 +326,47 @@ var _ = Describe("FileServer", func() {
 			})
 		})
 
+		Context("when the request body fails part way through", func() {
+			var body io.Reader
+
+			BeforeEach(func() {
+				body = io.MultiReader(strings.NewReader("blob-"), &failingReader{})
+			})
+
+			It("does not leave a partial file behind", func() {
+				req, err := http.NewRequest(http.MethodPut, "http://example.com/file.txt", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.Body = ioutil.NopCloser(body)
+				handler.ServeHTTP(response, req)
+
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+				Expect(filepath.Join(tempDir, "file.txt")).NotTo(BeAnExistingFile())
+
+				entries, err := ioutil.ReadDir(tempDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(BeEmpty())
+			})
+
+			It("allows the upload to be retried", func() {
+				req, err := http.NewRequest(http.MethodPut, "http://example.com/file.txt", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.Body = ioutil.NopCloser(body)
+				handler.ServeHTTP(response, req)
+				Expect(response.Code).To(Equal(http.StatusBadRequest))
+
+				response = httptest.NewRecorder()
+				req.Body = ioutil.NopCloser(strings.NewReader("blob-data"))
+				handler.ServeHTTP(response, req)
+				Expect(response.Code).To(Equal(http.StatusCreated))
+
+				contents, err := ioutil.ReadFile(filepath.Join(tempDir, "file.txt"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(BeEquivalentTo("blob-data"))
+			})
+		})
+
 		Context("when the target directory cannot be written to", func() {
 			BeforeEach(func() {
 				os.Mkdir(filepath.Join(tempDir, "subdir"), 0550)
@@ -190,6 +384,154 @@ var _ = Describe("FileServer", func() {
 		})
 	})
 
+	Describe("conditional requests", func() {
+		const etag = `"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`
+
+		var file string
+
+		statusFor := func(method, header, value, body string) int {
+			req, err := http.NewRequest(method, "http://example.com/file.txt", strings.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set(header, value)
+
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+			return response.Code
+		}
+
+		BeforeEach(func() {
+			file = filepath.Join(tempDir, "file.txt")
+			err := ioutil.WriteFile(file, []byte("blob-data"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("replaces a blob when If-Match matches its ETag", func() {
+			Expect(statusFor(http.MethodPut, "If-Match", etag, "new-data")).To(Equal(http.StatusNoContent))
+			Expect(ioutil.ReadFile(file)).To(BeEquivalentTo("new-data"))
+
+			metadata, err := ioutil.ReadFile(file + ".metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata).NotTo(ContainSubstring("c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"))
+		})
+
+		It("does not record metadata while checking a precondition", func() {
+			Expect(statusFor(http.MethodPut, "If-Match", `"other"`, "new-data")).To(Equal(http.StatusPreconditionFailed))
+			Expect(file + ".metadata").NotTo(BeAnExistingFile())
+		})
+
+		It("replaces a blob when If-Match is *", func() {
+			Expect(statusFor(http.MethodPut, "If-Match", "*", "new-data")).To(Equal(http.StatusNoContent))
+			Expect(ioutil.ReadFile(file)).To(BeEquivalentTo("new-data"))
+		})
+
+		It("fails with 412 when If-Match does not match", func() {
+			Expect(statusFor(http.MethodPut, "If-Match", `"other", W/`+etag, "new-data")).To(Equal(http.StatusPreconditionFailed))
+			Expect(ioutil.ReadFile(file)).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("fails with 412 when If-Match is used for a blob that does not exist", func() {
+			Expect(os.Remove(file)).To(Succeed())
+			Expect(statusFor(http.MethodPut, "If-Match", "*", "new-data")).To(Equal(http.StatusPreconditionFailed))
+			Expect(file).NotTo(BeAnExistingFile())
+		})
+
+		It("only creates blobs when If-None-Match is *", func() {
+			Expect(statusFor(http.MethodPut, "If-None-Match", "*", "new-data")).To(Equal(http.StatusPreconditionFailed))
+			Expect(ioutil.ReadFile(file)).To(BeEquivalentTo("blob-data"))
+
+			Expect(os.Remove(file)).To(Succeed())
+			Expect(statusFor(http.MethodPut, "If-None-Match", "*", "new-data")).To(Equal(http.StatusCreated))
+		})
+
+		It("fails with 412 when If-None-Match matches", func() {
+			Expect(statusFor(http.MethodPut, "If-None-Match", "W/"+etag, "new-data")).To(Equal(http.StatusPreconditionFailed))
+			Expect(statusFor(http.MethodPut, "If-None-Match", `"other"`, "new-data")).To(Equal(http.StatusNoContent))
+		})
+
+		It("honors If-Unmodified-Since", func() {
+			modified := time.Now().Add(-time.Hour)
+			Expect(os.Chtimes(file, modified, modified)).To(Succeed())
+
+			Expect(statusFor(http.MethodPut, "If-Unmodified-Since", modified.Add(-time.Minute).UTC().Format(http.TimeFormat), "new-data")).To(Equal(http.StatusPreconditionFailed))
+			Expect(statusFor(http.MethodPut, "If-Unmodified-Since", modified.UTC().Format(http.TimeFormat), "new-data")).To(Equal(http.StatusNoContent))
+		})
+
+		It("deletes a blob when If-Match matches its ETag", func() {
+			Expect(statusFor(http.MethodDelete, "If-Match", `"other"`, "")).To(Equal(http.StatusPreconditionFailed))
+			Expect(file).To(BeARegularFile())
+
+			Expect(statusFor(http.MethodDelete, "If-Match", etag, "")).To(Equal(http.StatusNoContent))
+			Expect(file).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("overwrite policies", func() {
+		var file string
+
+		put := func(target, body string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest(http.MethodPut, "http://example.com"+target, strings.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+			return response
+		}
+
+		BeforeEach(func() {
+			handler.Overwrite = handlers.OverwriteRules{
+				{Prefix: "/replace", Policy: handlers.OverwriteReplace},
+				{Prefix: "/idempotent", Policy: handlers.OverwriteIdempotent},
+			}
+
+			for _, dir := range []string{"replace", "idempotent", "other"} {
+				Expect(os.Mkdir(filepath.Join(tempDir, dir), 0755)).To(Succeed())
+				file = filepath.Join(tempDir, dir, "file.txt")
+				Expect(ioutil.WriteFile(file, []byte("blob-data"), 0644)).To(Succeed())
+			}
+		})
+
+		It("rejects overwrites outside the configured prefixes", func() {
+			Expect(put("/other/file.txt", "new-data").Code).To(Equal(http.StatusConflict))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "other", "file.txt"))).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("replaces blobs under a replace prefix", func() {
+			response := put("/replace/file.txt", "new-data")
+
+			Expect(response.Code).To(Equal(http.StatusNoContent))
+			Expect(response.HeaderMap).To(HaveKeyWithValue("X-Checksum-Sha256", []string{"68d46d3125a13d7df402ac42c1b5b8752fcbaa20c1f8276ed129c94cd469a01b"}))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "replace", "file.txt"))).To(BeEquivalentTo("new-data"))
+			Expect(put("/replace/new.txt", "new-data").Code).To(Equal(http.StatusCreated))
+		})
+
+		It("accepts identical content under an idempotent prefix", func() {
+			response := put("/idempotent/file.txt", "blob-data")
+
+			Expect(response.Code).To(Equal(http.StatusNoContent))
+			Expect(response.Header().Get("ETag")).To(Equal(`"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`))
+			Expect(put("/idempotent/new.txt", "new-data").Code).To(Equal(http.StatusCreated))
+		})
+
+		It("rejects different content under an idempotent prefix", func() {
+			Expect(put("/idempotent/file.txt", "new-data").Code).To(Equal(http.StatusConflict))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "idempotent", "file.txt"))).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("lets If-None-Match: * keep create-only semantics", func() {
+			req, err := http.NewRequest(http.MethodPut, "http://example.com/replace/file.txt", strings.NewReader("new-data"))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("If-None-Match", "*")
+
+			handler.ServeHTTP(response, req)
+			Expect(response.Code).To(Equal(http.StatusPreconditionFailed))
+		})
+
+		It("requires valid rules", func() {
+			Expect((&handlers.OverwriteRule{Prefix: "/", Policy: "sometimes"}).Validate()).To(HaveOccurred())
+			Expect((&handlers.OverwriteRule{Prefix: "relative", Policy: handlers.OverwriteReplace}).Validate()).To(HaveOccurred())
+		})
+	})
+
 	Describe("DELETE", func() {
 		var dir, file string
 
@@ -213,6 +555,19 @@ var _ = Describe("FileServer", func() {
 			Expect(file).NotTo(BeAnExistingFile())
 		})
 
+		It("deletes the blob metadata", func() {
+			err := ioutil.WriteFile(file+".metadata", []byte("{}"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			req, err := http.NewRequest(http.MethodDelete, "http://example.com/subdir/file.txt", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusNoContent))
+			Expect(file + ".metadata").NotTo(BeAnExistingFile())
+		})
+
 		It("does not delete the directory", func() {
 			req, err := http.NewRequest(http.MethodDelete, "http://example.com/subdir/file.txt", nil)
 			Expect(err).NotTo(HaveOccurred())
@@ -287,6 +642,59 @@ var _ = Describe("FileServer", func() {
 		})
 	})
 
+	Describe("RemoveStaleUploads", func() {
+		BeforeEach(func() {
+			err := os.MkdirAll(filepath.Join(tempDir, "subdir"), 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, name := range []string{"file.txt", "subdir/.upload-file.txt.1234", ".upload-other.txt.5678"} {
+				err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte("blob-data"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("removes abandoned temporary upload files", func() {
+			err := handler.RemoveStaleUploads()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(tempDir, "subdir", ".upload-file.txt.1234")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(tempDir, ".upload-other.txt.5678")).NotTo(BeAnExistingFile())
+		})
+
+		It("leaves other files alone", func() {
+			err := handler.RemoveStaleUploads()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(tempDir, "file.txt")).To(BeARegularFile())
+			Expect(filepath.Join(tempDir, "subdir")).To(BeADirectory())
+		})
+	})
+
+	Context("when the path names a sidecar", func() {
+		BeforeEach(func() {
+			err := ioutil.WriteFile(filepath.Join(tempDir, "file.txt.metadata"), []byte(`{"sha256":"forged"}`), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("is not served, replaced or deleted", func() {
+			for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+				for _, target := range []string{"/file.txt.metadata", "/file.txt.redirect"} {
+					req, err := http.NewRequest(method, "http://example.com"+target, strings.NewReader("forged"))
+					Expect(err).NotTo(HaveOccurred())
+
+					response = httptest.NewRecorder()
+					handler.ServeHTTP(response, req)
+					Expect(response.Code).To(Equal(http.StatusNotFound), method+" "+target)
+				}
+			}
+
+			contents, err := ioutil.ReadFile(filepath.Join(tempDir, "file.txt.metadata"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(`{"sha256":"forged"}`))
+			Expect(filepath.Join(tempDir, "file.txt.redirect")).NotTo(BeAnExistingFile())
+		})
+	})
+
 	Context("when the cleaned path contains ..", func() {
 		It("rejects the request", func() {
 			req, err := http.NewRequest("anything", "http://example.com/%2e%2efoo", nil)
@@ -309,3 +717,9 @@ var _ = Describe("FileServer", func() {
 		})
 	})
 })
+
+type failingReader struct{}
+
+func (*failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package handlers
+
+import "errors"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space is not available on this platform")
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package handlers
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system that holds dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
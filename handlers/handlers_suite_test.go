@@ -1,6 +1,10 @@
 package handlers_test
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -11,3 +15,21 @@ func TestHandlers(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Handlers Suite")
 }
+
+// serveRequest sends a request with body and headers for target to handler.
+// The request is made as user, with the password "password", unless user is
+// empty.
+func serveRequest(handler http.Handler, user, method, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://example.com"+target, body)
+	Expect(err).NotTo(HaveOccurred())
+	if user != "" {
+		req.SetBasicAuth(user, "password")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	return response
+}
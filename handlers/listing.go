@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listing page sizes. Clients may ask for up to MaxListingLimit entries per
+// page with the limit query parameter.
+const (
+	DefaultListingLimit = 1000
+	MaxListingLimit     = 10000
+)
+
+// Query parameters used to page through a listing. DIGESTS_PARAM asks for
+// the digest of each blob, which costs a read of its metadata.
+const (
+	LIMIT_PARAM   = "limit"
+	AFTER_PARAM   = "after"
+	DIGESTS_PARAM = "digests"
+)
+
+// ListingEntry describes one member of a directory. Redirects are listed
+// under the name of the blob they redirect.
+type ListingEntry struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Digest     string    `json:"digest,omitempty"`
+	IsDir      bool      `json:"is_dir"`
+	IsRedirect bool      `json:"is_redirect"`
+}
+
+// Listing is one page of the members of a directory, sorted by name. Next
+// is the URL of the following page, if any.
+type Listing struct {
+	Path    string         `json:"path"`
+	Entries []ListingEntry `json:"entries"`
+	Next    string         `json:"next,omitempty"`
+}
+
+func (fs *FileServer) serveListing(w http.ResponseWriter, r *http.Request, upath string) {
+	if fs.DisableListings {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// The target is built from the cleaned path so that a request for
+		// //host/dir cannot redirect to another host.
+		target := hrefFor(upath, true)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := DefaultListingLimit
+	if value := query.Get(LIMIT_PARAM); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if parsed < MaxListingLimit {
+			limit = parsed
+		} else {
+			limit = MaxListingLimit
+		}
+	}
+
+	storage := fs.storage()
+	entries, err := listDirectory(storage, upath)
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	after := query.Get(AFTER_PARAM)
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Name > after })
+	entries = entries[start:]
+
+	listing := &Listing{Path: upath, Entries: entries}
+	if listing.Path != "/" {
+		listing.Path += "/"
+	}
+	if len(entries) > limit {
+		listing.Entries = entries[:limit]
+		next := url.Values{}
+		next.Set(AFTER_PARAM, listing.Entries[limit-1].Name)
+		next.Set(LIMIT_PARAM, strconv.Itoa(limit))
+		if _, ok := query[DIGESTS_PARAM]; ok {
+			next.Set(DIGESTS_PARAM, "")
+		}
+		listing.Next = hrefFor(listing.Path, true) + "?" + next.Encode()
+		w.Header().Set("Link", "<"+listing.Next+`>; rel="next"`)
+	}
+
+	if _, ok := query[DIGESTS_PARAM]; ok {
+		for i := range listing.Entries {
+			entry := &listing.Entries[i]
+			if entry.IsDir || entry.IsRedirect {
+				continue
+			}
+			info := &fileInfo{name: entry.Name, size: entry.Size, modTime: entry.ModTime}
+			if metadata, err := readMetadata(storage, path.Join(upath, entry.Name), info); err == nil {
+				entry.Digest = metadata.SHA256
+			}
+		}
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if prefersJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listing)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := listingTemplate.Execute(w, listing); err != nil {
+		log.Printf("failed to render listing of %s: %s", upath, err)
+	}
+}
+
+// listDirectory returns the members of a directory sorted by name. Upload
+// temporaries and metadata sidecars are not listed.
+func listDirectory(storage Storage, upath string) ([]ListingEntry, error) {
+	infos, err := storage.List(upath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*ListingEntry{}
+	for _, info := range infos {
+		name := info.Name()
+		if isHidden(name) && !strings.HasSuffix(name, REDIRECT_SUFFIX) {
+			continue
+		}
+
+		if strings.HasSuffix(name, REDIRECT_SUFFIX) && !info.IsDir() {
+			// A redirect takes precedence over a blob with the same name.
+			name = strings.TrimSuffix(name, REDIRECT_SUFFIX)
+			entries[name] = &ListingEntry{Name: name, ModTime: info.ModTime().UTC(), IsRedirect: true}
+			continue
+		}
+		if existing, ok := entries[name]; ok && existing.IsRedirect {
+			continue
+		}
+		entries[name] = &ListingEntry{
+			Name:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			IsDir:   info.IsDir(),
+		}
+		if info.IsDir() {
+			entries[name].Size = 0
+		}
+	}
+
+	listing := make([]ListingEntry, 0, len(entries))
+	for _, entry := range entries {
+		listing = append(listing, *entry)
+	}
+	sort.Slice(listing, func(i, j int) bool { return listing[i].Name < listing[j].Name })
+	return listing, nil
+}
+
+// prefersJSON reports whether the Accept header ranks application/json
+// above text/html.
+func prefersJSON(accept string) bool {
+	jsonQuality, htmlQuality := -1.0, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			if quality > jsonQuality {
+				jsonQuality = quality
+			}
+		case "text/html":
+			if quality > htmlQuality {
+				htmlQuality = quality
+			}
+		}
+	}
+	return jsonQuality > htmlQuality
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"href": func(entry ListingEntry) string {
+		return "./" + hrefFor(entry.Name, entry.IsDir)
+	},
+	"mtime": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: -apple-system, "Helvetica Neue", Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; font-weight: normal; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 1em 0.3em 0; border-bottom: 1px solid #eee; }
+th { color: #666; font-weight: normal; }
+td.size { text-align: right; white-space: nowrap; }
+td.digest { font-family: monospace; font-size: 0.85em; color: #666; }
+a { color: #0366d6; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.redirect { color: #999; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th><th>SHA-256</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr>
+<td><a href="{{href .}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{if .IsRedirect}} <span class="redirect">(redirect)</span>{{end}}</td>
+<td class="size">{{if not (or .IsDir .IsRedirect)}}{{.Size}}{{end}}</td>
+<td>{{mtime .ModTime}}</td>
+<td class="digest">{{.Digest}}</td>
+</tr>
+{{end}}</table>
+{{if .Next}}<p><a href="{{.Next}}">Next page</a></p>{{end}}
+</body>
+</html>
+`))
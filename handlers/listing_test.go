@@ -0,0 +1,169 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("Directory listings", func() {
+	var (
+		handler *handlers.FileServer
+		tempDir string
+	)
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+		Expect(err).NotTo(HaveOccurred())
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	getListing := func(target string) (*httptest.ResponseRecorder, handlers.Listing) {
+		response := get(target, "application/json")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		listing := handlers.Listing{}
+		Expect(json.Unmarshal(response.Body.Bytes(), &listing)).To(Succeed())
+		return response, listing
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "listing")
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = &handlers.FileServer{Root: tempDir}
+		log.SetOutput(GinkgoWriter)
+
+		req, err := http.NewRequest(http.MethodPut, "http://example.com/dir/blob.tgz", strings.NewReader("blob-data"))
+		Expect(err).NotTo(HaveOccurred())
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(os.Mkdir(filepath.Join(tempDir, "dir", "nested"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "dir", "moved.tgz.redirect"), []byte("http://example.com/elsewhere"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "dir", ".upload-partial"), []byte("partial"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("lists the directory as JSON", func() {
+		_, listing := getListing("/dir/")
+
+		Expect(listing.Path).To(Equal("/dir/"))
+		Expect(listing.Next).To(BeEmpty())
+		Expect(listing.Entries).To(HaveLen(3))
+
+		blob := listing.Entries[0]
+		Expect(blob.Name).To(Equal("blob.tgz"))
+		Expect(blob.Size).To(BeEquivalentTo(9))
+		Expect(blob.Digest).To(BeEmpty())
+		Expect(blob.ModTime.IsZero()).To(BeFalse())
+		Expect(blob.IsDir).To(BeFalse())
+		Expect(blob.IsRedirect).To(BeFalse())
+
+		Expect(listing.Entries[1].Name).To(Equal("moved.tgz"))
+		Expect(listing.Entries[1].IsRedirect).To(BeTrue())
+
+		Expect(listing.Entries[2].Name).To(Equal("nested"))
+		Expect(listing.Entries[2].IsDir).To(BeTrue())
+	})
+
+	It("reports the digests of blobs when asked to", func() {
+		_, listing := getListing("/dir/?digests")
+
+		Expect(listing.Entries[0].Digest).To(Equal("c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"))
+		Expect(listing.Entries[1].Digest).To(BeEmpty())
+
+		_, listing = getListing("/dir/?digests&limit=1")
+		Expect(listing.Next).To(ContainSubstring("digests="))
+	})
+
+	It("lists the directory as HTML by default", func() {
+		response := get("/dir/", "text/html,application/xhtml+xml,*/*;q=0.8")
+
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+		body := response.Body.String()
+		Expect(body).To(ContainSubstring(`<a href="./blob.tgz">blob.tgz</a>`))
+		Expect(body).To(ContainSubstring(`<a href="./nested/">nested/</a>`))
+		Expect(body).To(ContainSubstring("(redirect)"))
+		Expect(body).NotTo(ContainSubstring(".metadata"))
+		Expect(body).NotTo(ContainSubstring(".upload-"))
+	})
+
+	It("redirects to the directory path with a trailing slash", func() {
+		response := get("/dir?limit=2", "")
+
+		Expect(response.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(response.Header().Get("Location")).To(Equal("/dir/?limit=2"))
+	})
+
+	It("redirects to the cleaned directory path", func() {
+		Expect(os.Mkdir(filepath.Join(tempDir, "evil.com"), 0755)).To(Succeed())
+
+		response := get("//evil.com", "")
+
+		Expect(response.Code).To(Equal(http.StatusMovedPermanently))
+		Expect(response.Header().Get("Location")).To(Equal("/evil.com/"))
+	})
+
+	It("pages through large directories", func() {
+		for i := 0; i < 5; i++ {
+			Expect(ioutil.WriteFile(filepath.Join(tempDir, fmt.Sprintf("blob-%d", i)), nil, 0644)).To(Succeed())
+		}
+
+		var names []string
+		next := "/?limit=2"
+		for next != "" {
+			response, listing := getListing(next)
+			Expect(len(listing.Entries)).To(BeNumerically("<=", 2))
+			for _, entry := range listing.Entries {
+				names = append(names, entry.Name)
+			}
+			if listing.Next != "" {
+				Expect(response.Header().Get("Link")).To(Equal("<" + listing.Next + `>; rel="next"`))
+			}
+			next = listing.Next
+		}
+
+		Expect(names).To(Equal([]string{"blob-0", "blob-1", "blob-2", "blob-3", "blob-4", "dir"}))
+	})
+
+	It("rejects an invalid limit", func() {
+		Expect(get("/dir/?limit=zero", "").Code).To(Equal(http.StatusBadRequest))
+	})
+
+	Context("when listings are disabled", func() {
+		BeforeEach(func() {
+			handler.DisableListings = true
+		})
+
+		It("refuses to list directories", func() {
+			Expect(get("/dir/", "application/json").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("still serves blobs", func() {
+			Expect(get("/dir/blob.tgz", "").Code).To(Equal(http.StatusOK))
+		})
+	})
+})
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lock timeouts. Clients may ask for any timeout up to MaxLockTimeout.
+const (
+	DefaultLockTimeout = 10 * time.Minute
+	MaxLockTimeout     = 24 * time.Hour
+)
+
+var (
+	errLockConflict = errors.New("path is already locked")
+	errNoSuchLock   = errors.New("no matching lock")
+)
+
+// Lock is a WebDAV write lock on a path and, when Infinite is set, on
+// everything beneath it.
+type Lock struct {
+	Token    string
+	Path     string
+	Shared   bool
+	Infinite bool
+	Owner    string
+	Timeout  time.Duration
+	Expires  time.Time
+}
+
+// Covers reports whether the lock applies to upath.
+func (l *Lock) Covers(upath string) bool {
+	if l.Infinite {
+		return hasPathPrefix(upath, l.Path)
+	}
+	return upath == l.Path
+}
+
+func (l *Lock) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// LockManager holds the WebDAV locks of a FileServer in memory. A single
+// manager is shared by every handler so locks survive configuration reloads.
+type LockManager struct {
+	mu    sync.Mutex
+	locks map[string]*Lock
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{locks: map[string]*Lock{}}
+}
+
+// Create grants a new lock unless it conflicts with an existing lock. An
+// exclusive lock conflicts with any lock on an overlapping path, and a shared
+// lock conflicts with overlapping exclusive locks.
+func (lm *LockManager) Create(lock Lock, now time.Time) (*Lock, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.expire(now)
+
+	for _, existing := range lm.locks {
+		if lock.Shared && existing.Shared {
+			continue
+		}
+		if existing.Covers(lock.Path) || (lock.Infinite && hasPathPrefix(existing.Path, lock.Path)) {
+			conflict := *existing
+			return &conflict, errLockConflict
+		}
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
+	}
+	lock.Token = token
+	lock.Timeout = lockTimeout(lock.Timeout)
+	lock.Expires = now.Add(lock.Timeout)
+
+	lm.locks[token] = &lock
+	granted := lock
+	return &granted, nil
+}
+
+// Refresh extends a lock that applies to upath by timeout.
+func (lm *LockManager) Refresh(token, upath string, timeout time.Duration, now time.Time) (*Lock, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.expire(now)
+
+	lock, ok := lm.locks[token]
+	if !ok || !lock.Covers(upath) {
+		return nil, errNoSuchLock
+	}
+	lock.Timeout = lockTimeout(timeout)
+	lock.Expires = now.Add(lock.Timeout)
+
+	refreshed := *lock
+	return &refreshed, nil
+}
+
+// Unlock removes a lock that applies to upath.
+func (lm *LockManager) Unlock(token, upath string, now time.Time) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.expire(now)
+
+	lock, ok := lm.locks[token]
+	if !ok || !lock.Covers(upath) {
+		return errNoSuchLock
+	}
+	delete(lm.locks, token)
+	return nil
+}
+
+// Holds reports whether token identifies a current lock that applies to
+// upath.
+func (lm *LockManager) Holds(token, upath string, now time.Time) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.expire(now)
+
+	lock, ok := lm.locks[token]
+	return ok && lock.Covers(upath)
+}
+
+// Conflict returns a lock on upath whose token was not submitted. When
+// recursive is set, locks on paths beneath upath are also considered. The
+// shared locks on a path only need one of their tokens, so a path held by
+// several shared locks is not in conflict once any of them is submitted.
+func (lm *LockManager) Conflict(upath string, recursive bool, submitted []string, now time.Time) (*Lock, bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.expire(now)
+
+	// Each locked path beneath upath is checked with every lock that
+	// covers it.
+	paths := map[string]bool{upath: true}
+	if recursive {
+		for _, lock := range lm.locks {
+			if hasPathPrefix(lock.Path, upath) {
+				paths[lock.Path] = true
+			}
+		}
+	}
+
+	for checked := range paths {
+		var covering []*Lock
+		for _, lock := range lm.locks {
+			if lock.Covers(checked) {
+				covering = append(covering, lock)
+			}
+		}
+		if conflict := lockConflict(covering, submitted); conflict != nil {
+			found := *conflict
+			return &found, true
+		}
+	}
+	return nil, false
+}
+
+// lockConflict returns an exclusive lock whose token was not submitted or,
+// when none of the tokens of the shared locks were, one of those.
+func lockConflict(locks []*Lock, submitted []string) *Lock {
+	var shared *Lock
+	sharedSubmitted := false
+	for _, lock := range locks {
+		held := containsString(submitted, lock.Token)
+		switch {
+		case !lock.Shared && !held:
+			return lock
+		case lock.Shared && held:
+			sharedSubmitted = true
+		case lock.Shared:
+			shared = lock
+		}
+	}
+	if shared != nil && !sharedSubmitted {
+		return shared
+	}
+	return nil
+}
+
+// Discover returns the current locks that apply to upath.
+func (lm *LockManager) Discover(upath string, now time.Time) []Lock {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.expire(now)
+
+	var locks []Lock
+	for _, lock := range lm.locks {
+		if lock.Covers(upath) {
+			locks = append(locks, *lock)
+		}
+	}
+	return locks
+}
+
+// Remove discards the locks on upath and, when recursive is set, on paths
+// beneath it. It is used once the locked resources have been deleted.
+func (lm *LockManager) Remove(upath string, recursive bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for token, lock := range lm.locks {
+		if lock.Path == upath || (recursive && hasPathPrefix(lock.Path, upath)) {
+			delete(lm.locks, token)
+		}
+	}
+}
+
+func (lm *LockManager) expire(now time.Time) {
+	for token, lock := range lm.locks {
+		if lock.expired(now) {
+			delete(lm.locks, token)
+		}
+	}
+}
+
+func lockTimeout(timeout time.Duration) time.Duration {
+	switch {
+	case timeout <= 0:
+		return DefaultLockTimeout
+	case timeout > MaxLockTimeout:
+		return MaxLockTimeout
+	default:
+		return timeout
+	}
+}
+
+// newLockToken returns a random opaquelocktoken URI.
+func newLockToken() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ifCondition is a single state token or entity tag condition of an If
+// header.
+type ifCondition struct {
+	not   bool
+	token string
+	etag  string
+}
+
+// ifList is a list of conditions that must all be true. A tagged list
+// applies to resource rather than to the request path.
+type ifList struct {
+	resource   string
+	conditions []ifCondition
+}
+
+// parseIfHeader parses the If header described in section 10.4 of RFC 4918.
+func parseIfHeader(header string) ([]ifList, error) {
+	var lists []ifList
+	resource := ""
+	s := strings.TrimSpace(header)
+
+	for s != "" {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, errors.New("unterminated resource tag")
+			}
+			resource = s[1:end]
+			s = s[end+1:]
+
+		case '(':
+			end := strings.IndexByte(s, ')')
+			if end < 0 {
+				return nil, errors.New("unterminated list")
+			}
+			conditions, err := parseIfConditions(s[1:end])
+			if err != nil {
+				return nil, err
+			}
+			lists = append(lists, ifList{resource: resource, conditions: conditions})
+			s = s[end+1:]
+
+		default:
+			return nil, fmt.Errorf("unexpected %q", s[0])
+		}
+		s = strings.TrimSpace(s)
+	}
+
+	if len(lists) == 0 {
+		return nil, errors.New("empty If header")
+	}
+	return lists, nil
+}
+
+func parseIfConditions(s string) ([]ifCondition, error) {
+	var conditions []ifCondition
+	condition := ifCondition{}
+	s = strings.TrimSpace(s)
+
+	for s != "" {
+		switch {
+		case strings.HasPrefix(s, "Not"):
+			condition.not = true
+			s = s[len("Not"):]
+
+		case s[0] == '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, errors.New("unterminated state token")
+			}
+			condition.token = s[1:end]
+			conditions = append(conditions, condition)
+			condition = ifCondition{}
+			s = s[end+1:]
+
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, errors.New("unterminated entity tag")
+			}
+			condition.etag = s[1:end]
+			conditions = append(conditions, condition)
+			condition = ifCondition{}
+			s = s[end+1:]
+
+		default:
+			return nil, fmt.Errorf("unexpected %q", s[0])
+		}
+		s = strings.TrimSpace(s)
+	}
+
+	if len(conditions) == 0 || condition.not {
+		return nil, errors.New("empty condition list")
+	}
+	return conditions, nil
+}
+
+// submittedTokens returns the lock tokens named by the If header.
+func submittedTokens(lists []ifList) []string {
+	var tokens []string
+	for _, list := range lists {
+		for _, condition := range list.conditions {
+			if condition.token != "" && !condition.not {
+				tokens = append(tokens, condition.token)
+			}
+		}
+	}
+	return tokens
+}
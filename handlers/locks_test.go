@@ -0,0 +1,127 @@
+package handlers_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("LockManager", func() {
+	var (
+		locks *handlers.LockManager
+		now   time.Time
+	)
+
+	BeforeEach(func() {
+		locks = handlers.NewLockManager()
+		now = time.Now()
+	})
+
+	It("grants locks with unique tokens", func() {
+		first, err := locks.Create(handlers.Lock{Path: "/a"}, now)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := locks.Create(handlers.Lock{Path: "/b"}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first.Token).To(HavePrefix("opaquelocktoken:"))
+		Expect(first.Token).NotTo(Equal(second.Token))
+		Expect(first.Timeout).To(Equal(handlers.DefaultLockTimeout))
+	})
+
+	It("limits the lock timeout", func() {
+		lock, err := locks.Create(handlers.Lock{Path: "/a", Timeout: 365 * 24 * time.Hour}, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lock.Timeout).To(Equal(handlers.MaxLockTimeout))
+	})
+
+	It("refuses locks that overlap an exclusive lock", func() {
+		_, err := locks.Create(handlers.Lock{Path: "/dir", Infinite: true}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = locks.Create(handlers.Lock{Path: "/dir/file"}, now)
+		Expect(err).To(HaveOccurred())
+		_, err = locks.Create(handlers.Lock{Path: "/", Infinite: true, Shared: true}, now)
+		Expect(err).To(HaveOccurred())
+		_, err = locks.Create(handlers.Lock{Path: "/other"}, now)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("allows shared locks on the same path", func() {
+		_, err := locks.Create(handlers.Lock{Path: "/file", Shared: true}, now)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = locks.Create(handlers.Lock{Path: "/file", Shared: true}, now)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = locks.Create(handlers.Lock{Path: "/file"}, now)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports locks whose tokens were not submitted", func() {
+		lock, err := locks.Create(handlers.Lock{Path: "/dir/file"}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, locked := locks.Conflict("/dir/file", false, nil, now)
+		Expect(locked).To(BeTrue())
+		_, locked = locks.Conflict("/dir/file", false, []string{lock.Token}, now)
+		Expect(locked).To(BeFalse())
+
+		_, locked = locks.Conflict("/dir", false, nil, now)
+		Expect(locked).To(BeFalse())
+		conflict, locked := locks.Conflict("/dir", true, nil, now)
+		Expect(locked).To(BeTrue())
+		Expect(conflict.Path).To(Equal("/dir/file"))
+	})
+
+	It("only needs one token of the shared locks on a path", func() {
+		first, err := locks.Create(handlers.Lock{Path: "/dir", Shared: true, Infinite: true}, now)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := locks.Create(handlers.Lock{Path: "/dir/file", Shared: true}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, locked := locks.Conflict("/dir/file", false, nil, now)
+		Expect(locked).To(BeTrue())
+		_, locked = locks.Conflict("/dir/file", false, []string{first.Token}, now)
+		Expect(locked).To(BeFalse())
+		_, locked = locks.Conflict("/dir/file", false, []string{second.Token}, now)
+		Expect(locked).To(BeFalse())
+
+		_, locked = locks.Conflict("/dir", true, []string{first.Token}, now)
+		Expect(locked).To(BeFalse())
+		conflict, locked := locks.Conflict("/dir", true, []string{second.Token}, now)
+		Expect(locked).To(BeTrue())
+		Expect(conflict.Path).To(Equal("/dir"))
+	})
+
+	It("expires locks after their timeout", func() {
+		lock, err := locks.Create(handlers.Lock{Path: "/file", Timeout: time.Minute}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(locks.Holds(lock.Token, "/file", now.Add(59*time.Second))).To(BeTrue())
+		Expect(locks.Holds(lock.Token, "/file", now.Add(time.Minute))).To(BeFalse())
+		_, err = locks.Create(handlers.Lock{Path: "/file"}, now.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("extends locks that are refreshed", func() {
+		lock, err := locks.Create(handlers.Lock{Path: "/file", Timeout: time.Minute}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = locks.Refresh(lock.Token, "/file", time.Hour, now.Add(30*time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(locks.Holds(lock.Token, "/file", now.Add(time.Minute))).To(BeTrue())
+
+		_, err = locks.Refresh(lock.Token, "/other", time.Hour, now)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("removes unlocked locks", func() {
+		lock, err := locks.Create(handlers.Lock{Path: "/dir", Infinite: true}, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(locks.Unlock("opaquelocktoken:unknown", "/dir", now)).To(HaveOccurred())
+		Expect(locks.Unlock(lock.Token, "/dir/file", now)).To(Succeed())
+		Expect(locks.Holds(lock.Token, "/dir", now)).To(BeFalse())
+	})
+})
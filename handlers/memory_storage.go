@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errIsDirectory  = errors.New("is a directory")
+	errNotDirectory = errors.New("not a directory")
+	errNotEmpty     = errors.New("directory not empty")
+)
+
+// MemoryStorage keeps blobs in memory. It is meant for tests and for
+// servers whose content does not need to survive a restart.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	blobs map[string]*memoryBlob
+	dirs  map[string]time.Time
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		blobs: map[string]*memoryBlob{},
+		dirs:  map[string]time.Time{"/": time.Now()},
+	}
+}
+
+func (ms *MemoryStorage) Open(upath string) (File, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if blob, ok := ms.blobs[upath]; ok {
+		return &memoryFile{bytes.NewReader(blob.data)}, nil
+	}
+	if _, ok := ms.dirs[upath]; ok {
+		return nil, &os.PathError{Op: "open", Path: upath, Err: errIsDirectory}
+	}
+	return nil, &os.PathError{Op: "open", Path: upath, Err: os.ErrNotExist}
+}
+
+func (ms *MemoryStorage) Stat(upath string) (os.FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if info, ok := ms.stat(upath); ok {
+		return info, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: upath, Err: os.ErrNotExist}
+}
+
+func (ms *MemoryStorage) stat(upath string) (os.FileInfo, bool) {
+	if blob, ok := ms.blobs[upath]; ok {
+		return &fileInfo{name: path.Base(upath), size: int64(len(blob.data)), modTime: blob.modTime}, true
+	}
+	if modTime, ok := ms.dirs[upath]; ok {
+		return &fileInfo{name: path.Base(upath), modTime: modTime, dir: true}, true
+	}
+	return nil, false
+}
+
+func (ms *MemoryStorage) Create(upath string) (Upload, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for dir := path.Dir(upath); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := ms.blobs[dir]; ok {
+			return nil, &os.PathError{Op: "create", Path: upath, Err: errNotDirectory}
+		}
+	}
+	return &memoryUpload{storage: ms, upath: upath}, nil
+}
+
+func (ms *MemoryStorage) Delete(upath string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.blobs[upath]; ok {
+		delete(ms.blobs, upath)
+		return nil
+	}
+	if _, ok := ms.dirs[upath]; !ok {
+		return &os.PathError{Op: "remove", Path: upath, Err: os.ErrNotExist}
+	}
+	if upath == "/" || len(ms.list(upath)) > 0 {
+		return &os.PathError{Op: "remove", Path: upath, Err: errNotEmpty}
+	}
+	delete(ms.dirs, upath)
+	return nil
+}
+
+func (ms *MemoryStorage) List(upath string) ([]os.FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.dirs[upath]; !ok {
+		return nil, &os.PathError{Op: "open", Path: upath, Err: os.ErrNotExist}
+	}
+	return ms.list(upath), nil
+}
+
+func (ms *MemoryStorage) list(dir string) []os.FileInfo {
+	var infos []os.FileInfo
+	add := func(upath string) {
+		if upath != dir && path.Dir(upath) == dir {
+			info, _ := ms.stat(upath)
+			infos = append(infos, info)
+		}
+	}
+	for upath := range ms.blobs {
+		add(upath)
+	}
+	for upath := range ms.dirs {
+		add(upath)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos
+}
+
+func (ms *MemoryStorage) Mkdir(upath string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.stat(upath); ok {
+		return &os.PathError{Op: "mkdir", Path: upath, Err: os.ErrExist}
+	}
+	if _, ok := ms.dirs[path.Dir(upath)]; !ok {
+		return &os.PathError{Op: "mkdir", Path: upath, Err: os.ErrNotExist}
+	}
+	ms.dirs[upath] = time.Now()
+	return nil
+}
+
+func (ms *MemoryStorage) commit(upath string, data []byte, replace bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.dirs[upath]; ok {
+		return &os.PathError{Op: "create", Path: upath, Err: os.ErrExist}
+	}
+	if _, ok := ms.blobs[upath]; ok && !replace {
+		return &os.PathError{Op: "create", Path: upath, Err: os.ErrExist}
+	}
+
+	now := time.Now()
+	for dir := path.Dir(upath); !strings.HasSuffix(dir, "/"); dir = path.Dir(dir) {
+		if _, ok := ms.blobs[dir]; ok {
+			return &os.PathError{Op: "create", Path: upath, Err: errNotDirectory}
+		}
+		if _, ok := ms.dirs[dir]; !ok {
+			ms.dirs[dir] = now
+		}
+	}
+	ms.blobs[upath] = &memoryBlob{data: data, modTime: now}
+	return nil
+}
+
+type memoryUpload struct {
+	storage *MemoryStorage
+	upath   string
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (u *memoryUpload) Write(p []byte) (int, error) {
+	if u.done {
+		return 0, os.ErrClosed
+	}
+	return u.buf.Write(p)
+}
+
+func (u *memoryUpload) Commit(replace bool) error {
+	if u.done {
+		return os.ErrClosed
+	}
+	if err := u.storage.commit(u.upath, u.buf.Bytes(), replace); err != nil {
+		return err
+	}
+	u.done = true
+	return nil
+}
+
+func (u *memoryUpload) Close() error {
+	u.done = true
+	return nil
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+const METADATA_SUFFIX = ".metadata"
+
+// Metadata is recorded in a sidecar file next to each blob when it is
+// uploaded so that responses can carry validators without rehashing the
+// blob.
+type Metadata struct {
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+
+	// Owner is the user that uploaded the blob.
+	Owner string `json:"owner,omitempty"`
+}
+
+func newMetadata(size int64, digests Digests) *Metadata {
+	return &Metadata{
+		Size:   size,
+		MD5:    hex.EncodeToString(digests[MD5]),
+		SHA1:   hex.EncodeToString(digests[SHA1]),
+		SHA256: hex.EncodeToString(digests[SHA256]),
+	}
+}
+
+// ETag returns a strong entity tag derived from the SHA-256 of the blob.
+func (m *Metadata) ETag() string {
+	return `"` + m.SHA256 + `"`
+}
+
+func (m *Metadata) Digests() Digests {
+	digests := Digests{}
+	for algorithm, value := range map[string]string{MD5: m.MD5, SHA1: m.SHA1, SHA256: m.SHA256} {
+		if decoded, err := hex.DecodeString(value); err == nil && len(decoded) > 0 {
+			digests[algorithm] = decoded
+		}
+	}
+	return digests
+}
+
+// readMetadata loads the sidecar metadata for the blob at upath. Metadata
+// that does not describe the blob currently stored is treated as missing.
+func readMetadata(storage Storage, upath string, info os.FileInfo) (*Metadata, error) {
+	data, err := readBlob(storage, upath+METADATA_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &Metadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Size != info.Size() || metadata.SHA256 == "" {
+		return nil, os.ErrNotExist
+	}
+
+	return metadata, nil
+}
+
+// blobMetadata returns the metadata of the blob at upath. Blobs stored
+// without metadata are hashed. Their metadata is not recorded because the
+// blob may be replaced while it is hashed.
+func blobMetadata(storage Storage, upath string, info os.FileInfo) (*Metadata, error) {
+	if metadata, err := readMetadata(storage, upath, info); err == nil {
+		return metadata, nil
+	}
+
+	blob, err := storage.Open(upath)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	digester := newDigester()
+	size, err := io.Copy(digester, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMetadata(size, digester.Digests()), nil
+}
+
+// writeMetadata atomically replaces the sidecar metadata for the blob at
+// upath.
+func writeMetadata(storage Storage, upath string, metadata *Metadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	upload, err := storage.Create(upath + METADATA_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := upload.Write(data); err != nil {
+		return err
+	}
+	return upload.Commit(true)
+}
+
+func removeMetadata(storage Storage, upath string) error {
+	err := storage.Delete(upath + METADATA_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
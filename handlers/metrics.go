@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons that requests fail authentication or authorization.
+const (
+	AuthFailureMissingCredentials = "missing_credentials"
+	AuthFailureInvalidCredentials = "invalid_credentials"
+	AuthFailureInvalidToken       = "invalid_token"
+	AuthFailureExpiredToken       = "expired_token"
+	AuthFailureInvalidSignature   = "invalid_signature"
+	AuthFailureCertificate        = "certificate_required"
+	AuthFailureForbidden          = "forbidden"
+)
+
+// instrumentedMethods are reported by name. Other methods are reported as
+// OTHER so that clients cannot create unbounded label values.
+var instrumentedMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPut: true,
+	http.MethodPost: true, http.MethodPatch: true, http.MethodDelete: true,
+	MethodOptions: true, MethodPropfind: true, MethodProppatch: true,
+	MethodMkcol: true, MethodCopy: true, MethodMove: true,
+	MethodLock: true, MethodUnlock: true,
+}
+
+// Metrics collects Prometheus metrics about the requests served and the
+// blobs stored. A nil *Metrics collects nothing.
+type Metrics struct {
+	requests        *prometheus.CounterVec
+	duration        *prometheus.HistogramVec
+	bytesUploaded   prometheus.Counter
+	bytesDownloaded prometheus.Counter
+	authFailures    *prometheus.CounterVec
+	uploadsInFlight prometheus.Gauge
+	redirects       prometheus.Counter
+
+	storageBytes *prometheus.Desc
+	storageBlobs *prometheus.Desc
+	storageFree  *prometheus.Desc
+	fileServer   atomic.Value
+}
+
+// NewMetrics creates the metrics and registers them with registerer.
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dav_blobstore_requests_total",
+			Help: "Requests served by method and status code.",
+		}, []string{"method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dav_blobstore_request_duration_seconds",
+			Help:    "Time taken to serve requests by method and status code.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{"method", "status"}),
+		bytesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dav_blobstore_uploaded_bytes_total",
+			Help: "Bytes received in request bodies.",
+		}),
+		bytesDownloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dav_blobstore_downloaded_bytes_total",
+			Help: "Bytes sent in response bodies.",
+		}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dav_blobstore_auth_failures_total",
+			Help: "Requests refused by authentication or authorization by reason.",
+		}, []string{"reason"}),
+		uploadsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dav_blobstore_uploads_in_flight",
+			Help: "Uploads currently being received.",
+		}),
+		redirects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dav_blobstore_redirects_total",
+			Help: "Requests answered with the target of a redirect file.",
+		}),
+		storageBytes: prometheus.NewDesc("dav_blobstore_storage_used_bytes", "Bytes of blobs stored.", nil, nil),
+		storageBlobs: prometheus.NewDesc("dav_blobstore_storage_blobs", "Number of blobs stored.", nil, nil),
+		storageFree:  prometheus.NewDesc("dav_blobstore_storage_free_bytes", "Bytes available on the file system of the blobs path.", nil, nil),
+	}
+	registerer.MustRegister(m.requests, m.duration, m.bytesUploaded, m.bytesDownloaded,
+		m.authFailures, m.uploadsInFlight, m.redirects, m)
+
+	for _, reason := range []string{
+		AuthFailureMissingCredentials, AuthFailureInvalidCredentials, AuthFailureInvalidToken,
+		AuthFailureExpiredToken, AuthFailureInvalidSignature, AuthFailureCertificate, AuthFailureForbidden,
+	} {
+		m.authFailures.WithLabelValues(reason)
+	}
+	return m
+}
+
+// SetFileServer sets the file server whose storage usage is reported. It is
+// called again when the configuration is reloaded.
+func (m *Metrics) SetFileServer(fs *FileServer) {
+	if m != nil {
+		m.fileServer.Store(fs)
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.storageBytes
+	ch <- m.storageBlobs
+	ch <- m.storageFree
+}
+
+// Collect reports the storage usage of the file server. Collecting never
+// scans the storage; the usage is reported once it has been counted by
+// FileServer.Usage, a quota check, or a usage report, and is then kept up to
+// date as blobs are uploaded and deleted.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	fs, _ := m.fileServer.Load().(*FileServer)
+	if fs == nil {
+		return
+	}
+
+	if usage, ok := fs.usageTracker().total(); ok {
+		ch <- prometheus.MustNewConstMetric(m.storageBytes, prometheus.GaugeValue, float64(usage.Bytes))
+		ch <- prometheus.MustNewConstMetric(m.storageBlobs, prometheus.GaugeValue, float64(usage.Objects))
+	}
+	if fs.Root != "" {
+		if free, err := freeSpace(fs.Root); err == nil {
+			ch <- prometheus.MustNewConstMetric(m.storageFree, prometheus.GaugeValue, float64(free))
+		}
+	}
+}
+
+// Instrument counts the requests served by handler, how long they took,
+// and the bytes they received and sent.
+func (m *Metrics) Instrument(handler http.Handler) http.Handler {
+	if m == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		handler.ServeHTTP(recorder, r)
+
+		method := r.Method
+		if !instrumentedMethods[method] {
+			method = "OTHER"
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{"method": method, "status": strconv.Itoa(status)}
+		m.requests.With(labels).Inc()
+		m.duration.With(labels).Observe(time.Since(start).Seconds())
+		m.bytesUploaded.Add(float64(body.count))
+		m.bytesDownloaded.Add(float64(recorder.written))
+	})
+}
+
+func (m *Metrics) authFailed(reason string) {
+	if m != nil {
+		m.authFailures.WithLabelValues(reason).Inc()
+	}
+}
+
+// uploadStarted counts an upload as in flight until the returned function
+// is called.
+func (m *Metrics) uploadStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.uploadsInFlight.Inc()
+	return m.uploadsInFlight.Dec
+}
+
+func (m *Metrics) redirected() {
+	if m != nil {
+		m.redirects.Inc()
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// statusRecorder records the status and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom lets responses copied from files use the underlying writer's
+// ReadFrom, and so sendfile, when it has one.
+func (w *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if readerFrom, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.written += n
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
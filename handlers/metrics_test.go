@@ -0,0 +1,211 @@
+package handlers_test
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		tempDir    string
+		registry   *prometheus.Registry
+		metrics    *handlers.Metrics
+		fileServer *handlers.FileServer
+		handler    http.Handler
+	)
+
+	serve := func(method, target string, body io.Reader, user string) *httptest.ResponseRecorder {
+		return serveRequest(handler, user, method, target, body, nil)
+	}
+
+	// metricValue returns the value of the metric with name and labels, or
+	// -1 when it has not been collected.
+	metricValue := func(name string, labels map[string]string) float64 {
+		families, err := registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, metric := range family.GetMetric() {
+				for _, pair := range metric.GetLabel() {
+					if labels[pair.GetName()] != pair.GetValue() {
+						continue metrics
+					}
+				}
+				switch {
+				case metric.Counter != nil:
+					return metric.GetCounter().GetValue()
+				case metric.Gauge != nil:
+					return metric.GetGauge().GetValue()
+				case metric.Histogram != nil:
+					return float64(metric.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+		return -1
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "metrics")
+		Expect(err).NotTo(HaveOccurred())
+
+		registry = prometheus.NewRegistry()
+		metrics = handlers.NewMetrics(registry)
+		fileServer = &handlers.FileServer{Root: tempDir, Metrics: metrics}
+		handler = metrics.Instrument(&handlers.AuthenticationHandler{
+			PublicRead: true,
+			Authorized: map[string]string{"user": "password", "reader": "password"},
+			Roles:      map[string]handlers.Roles{"reader": {handlers.RoleRead}},
+			Delegate:   fileServer,
+			Metrics:    metrics,
+		})
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("counts requests and their duration by method and status", func() {
+		Expect(serve(http.MethodPut, "/blob.tgz", strings.NewReader("blob-data"), "user").Code).To(Equal(http.StatusCreated))
+		Expect(serve(http.MethodGet, "/blob.tgz", nil, "").Code).To(Equal(http.StatusOK))
+		Expect(serve(http.MethodGet, "/missing", nil, "").Code).To(Equal(http.StatusNotFound))
+		serve("BREW", "/blob.tgz", nil, "user")
+
+		Expect(metricValue("dav_blobstore_requests_total", map[string]string{"method": "PUT", "status": "201"})).To(Equal(1.0))
+		Expect(metricValue("dav_blobstore_requests_total", map[string]string{"method": "GET", "status": "200"})).To(Equal(1.0))
+		Expect(metricValue("dav_blobstore_requests_total", map[string]string{"method": "GET", "status": "404"})).To(Equal(1.0))
+		Expect(metricValue("dav_blobstore_requests_total", map[string]string{"method": "OTHER", "status": "400"})).To(Equal(1.0))
+		Expect(metricValue("dav_blobstore_request_duration_seconds", map[string]string{"method": "PUT", "status": "201"})).To(Equal(1.0))
+	})
+
+	It("counts the bytes uploaded and downloaded", func() {
+		serve(http.MethodPut, "/blob.tgz", strings.NewReader("blob-data"), "user")
+		serve(http.MethodGet, "/blob.tgz", nil, "")
+		serve(http.MethodHead, "/blob.tgz", nil, "")
+
+		Expect(metricValue("dav_blobstore_uploaded_bytes_total", nil)).To(Equal(9.0))
+		Expect(metricValue("dav_blobstore_downloaded_bytes_total", nil)).To(Equal(9.0))
+	})
+
+	It("counts authentication failures by reason", func() {
+		serve(http.MethodPut, "/blob.tgz", strings.NewReader("blob-data"), "")
+		serve(http.MethodPut, "/blob.tgz", strings.NewReader("blob-data"), "unknown")
+		serve(http.MethodPut, "/blob.tgz", strings.NewReader("blob-data"), "reader")
+
+		Expect(metricValue("dav_blobstore_auth_failures_total", map[string]string{"reason": "missing_credentials"})).To(Equal(1.0))
+		Expect(metricValue("dav_blobstore_auth_failures_total", map[string]string{"reason": "invalid_credentials"})).To(Equal(1.0))
+		Expect(metricValue("dav_blobstore_auth_failures_total", map[string]string{"reason": "forbidden"})).To(Equal(1.0))
+	})
+
+	It("counts uploads in flight", func() {
+		reader, writer := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			Expect(serve(http.MethodPut, "/blob.tgz", reader, "user").Code).To(Equal(http.StatusCreated))
+		}()
+
+		Eventually(func() float64 { return metricValue("dav_blobstore_uploads_in_flight", nil) }).Should(Equal(1.0))
+		writer.Write([]byte("blob-data"))
+		writer.Close()
+		Eventually(done).Should(BeClosed())
+		Expect(metricValue("dav_blobstore_uploads_in_flight", nil)).To(Equal(0.0))
+	})
+
+	It("counts redirects", func() {
+		err := ioutil.WriteFile(filepath.Join(tempDir, "blob.tgz.redirect"), []byte("https://example.org/blob.tgz"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(serve(http.MethodGet, "/blob.tgz", nil, "").Code).To(Equal(http.StatusTemporaryRedirect))
+		Expect(metricValue("dav_blobstore_redirects_total", nil)).To(Equal(1.0))
+	})
+
+	It("reports the storage usage of the file server", func() {
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(-1.0))
+
+		metrics.SetFileServer(fileServer)
+		_, err := fileServer.Usage()
+		Expect(err).NotTo(HaveOccurred())
+		serve(http.MethodPut, "/a/blob.tgz", strings.NewReader("blob-data"), "user")
+		serve(http.MethodPut, "/b/blob.tgz", strings.NewReader("more-blob-data"), "user")
+
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(23.0))
+		Expect(metricValue("dav_blobstore_storage_blobs", nil)).To(Equal(2.0))
+		Expect(metricValue("dav_blobstore_storage_free_bytes", nil)).To(BeNumerically(">", 0))
+
+		serve(http.MethodDelete, "/a/blob.tgz", nil, "user")
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(14.0))
+	})
+
+	It("does not scan the storage to collect its usage", func() {
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "blob.tgz"), []byte("blob-data"), 0644)).To(Succeed())
+		metrics.SetFileServer(fileServer)
+
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(-1.0))
+		Expect(metricValue("dav_blobstore_storage_free_bytes", nil)).To(BeNumerically(">", 0))
+
+		_, err := fileServer.Usage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(9.0))
+	})
+
+	It("collects while the storage is being scanned", func() {
+		storage := &blockingStorage{
+			Storage: &handlers.LocalStorage{Root: tempDir},
+			listing: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		fileServer.Storage = storage
+		metrics.SetFileServer(fileServer)
+
+		scanned := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(scanned)
+			_, err := fileServer.Usage()
+			Expect(err).NotTo(HaveOccurred())
+		}()
+		Eventually(storage.listing).Should(BeClosed())
+
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(-1.0))
+		Expect(serve(http.MethodPut, "/blob.tgz", strings.NewReader("blob-data"), "user").Code).To(Equal(http.StatusCreated))
+
+		close(storage.release)
+		Eventually(scanned).Should(BeClosed())
+		Expect(metricValue("dav_blobstore_storage_used_bytes", nil)).To(Equal(9.0))
+	})
+
+	It("passes flushes and file copies through to the response writer", func() {
+		var flushed, readFrom, unwrapped bool
+		handler = metrics.Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, flushed = w.(http.Flusher)
+			_, readFrom = w.(io.ReaderFrom)
+			_, unwrapped = w.(interface{ Unwrap() http.ResponseWriter })
+			io.Copy(w, strings.NewReader("blob-data"))
+		}))
+
+		Expect(serve(http.MethodGet, "/blob.tgz", nil, "").Body.String()).To(Equal("blob-data"))
+		Expect(flushed).To(BeTrue())
+		Expect(readFrom).To(BeTrue())
+		Expect(unwrapped).To(BeTrue())
+		Expect(metricValue("dav_blobstore_downloaded_bytes_total", nil)).To(Equal(9.0))
+		Expect(metricValue("dav_blobstore_requests_total", map[string]string{"method": "GET", "status": "200"})).To(Equal(1.0))
+	})
+})
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// OverwritePolicy decides what happens to a PUT for a blob that already
+// exists.
+type OverwritePolicy string
+
+const (
+	// OverwriteReject refuses the upload with 409 Conflict.
+	OverwriteReject OverwritePolicy = "reject"
+	// OverwriteReplace replaces the existing blob.
+	OverwriteReplace OverwritePolicy = "replace"
+	// OverwriteIdempotent accepts the upload without changing the existing
+	// blob when the content is identical and refuses it otherwise.
+	OverwriteIdempotent OverwritePolicy = "idempotent"
+)
+
+// errBlobUnchanged is returned by an upload precondition to keep the
+// existing blob in place of the received content.
+var errBlobUnchanged = errors.New("blob is unchanged")
+
+// OverwriteRule applies an overwrite policy to the blobs under a path prefix.
+type OverwriteRule struct {
+	Prefix string          `json:"prefix"`
+	Policy OverwritePolicy `json:"policy"`
+}
+
+func (rule *OverwriteRule) Validate() error {
+	if !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("overwrite prefix must be absolute: %q", rule.Prefix)
+	}
+	switch rule.Policy {
+	case OverwriteReject, OverwriteReplace, OverwriteIdempotent:
+	case "":
+		return errors.New("overwrite policy is required")
+	default:
+		return fmt.Errorf("unknown overwrite policy: %q", rule.Policy)
+	}
+	return nil
+}
+
+// OverwriteRules are evaluated in order and the first rule whose prefix
+// contains the path decides its policy.
+type OverwriteRules []OverwriteRule
+
+// Policy returns the overwrite policy for upath. Blobs that no rule applies
+// to are never overwritten.
+func (rules OverwriteRules) Policy(upath string) OverwritePolicy {
+	for i := range rules {
+		if hasPathPrefix(upath, rules[i].Prefix) {
+			return rules[i].Policy
+		}
+	}
+	return OverwriteReject
+}
+
+// overwritePrecondition returns the upload precondition that implements
+// policy for the blob at upath, or nil when existing blobs must not be
+// overwritten. Replaced is set when the upload replaces, or is identical
+// to, an existing blob.
+func overwritePrecondition(policy OverwritePolicy, storage Storage, upath string, replaced *bool) func(*Metadata) error {
+	switch policy {
+	case OverwriteReplace:
+		return func(*Metadata) error {
+			_, err := storage.Stat(upath)
+			*replaced = err == nil
+			return nil
+		}
+
+	case OverwriteIdempotent:
+		return func(incoming *Metadata) error {
+			info, err := storage.Stat(upath)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return &os.PathError{Op: "create", Path: upath, Err: os.ErrExist}
+			}
+
+			current, err := blobMetadata(storage, upath, info)
+			if err != nil {
+				return err
+			}
+			if current.SHA256 != incoming.SHA256 {
+				return &os.PathError{Op: "create", Path: upath, Err: os.ErrExist}
+			}
+			*replaced = true
+			return errBlobUnchanged
+		}
+
+	default:
+		return nil
+	}
+}
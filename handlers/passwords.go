@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// VerifyPassword reports whether password matches the stored credential.
+// Stored credentials may be bcrypt ($2a$, $2b$, $2y$), argon2id ($argon2id$),
+// SHA-crypt ($5$, $6$), Apache MD5 ($apr1$), or Apache SHA-1 ({SHA}) hashes.
+// Anything else is treated as a legacy plaintext password and compared in
+// constant time.
+func VerifyPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+	case strings.HasPrefix(stored, "$5$"):
+		return constantTimeEqual(stored, shaCrypt(sha256.New, sha256Permutation, "$5$", stored, password))
+	case strings.HasPrefix(stored, "$6$"):
+		return constantTimeEqual(stored, shaCrypt(sha512.New, sha512Permutation, "$6$", stored, password))
+	case strings.HasPrefix(stored, "$apr1$"):
+		return constantTimeEqual(stored, apr1Crypt(stored, password))
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual(stored, "{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return constantTimeEqual(stored, password)
+	}
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// LoadHtpasswd reads the users and password hashes from an Apache htpasswd
+// file.
+func LoadHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseHtpasswd(file)
+}
+
+func ParseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed htpasswd entry on line %d", lineNumber)
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// verifyArgon2id checks a password against a PHC formatted argon2id hash:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func verifyArgon2id(stored, password string) bool {
+	fields := strings.Split(stored, "$")
+	if len(fields) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	// argon2.IDKey panics without at least one pass and one thread.
+	if time < 1 || threads < 1 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(expected, actual) == 1
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptEncode encodes the digest with the crypt(3) base64 alphabet. Each
+// group of three digest indices is emitted as a little endian 24 bit value;
+// a trailing group may be shorter.
+func cryptEncode(digest []byte, permutation [][]int) string {
+	var encoded []byte
+	for _, group := range permutation {
+		var value uint
+		for _, index := range group {
+			value = value<<8 | uint(digest[index])
+		}
+		for n := len(group) + 1; n > 0; n-- {
+			encoded = append(encoded, cryptAlphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+	return string(encoded)
+}
+
+var sha256Permutation = [][]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	{31, 30},
+}
+
+var sha512Permutation = [][]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41}, {63},
+}
+
+// shaCrypt computes the SHA-crypt hash of password using the salt and
+// rounds from stored, as specified by Ulrich Drepper's "Unix crypt using
+// SHA-256 and SHA-512". It returns an empty string, which never matches,
+// when stored is malformed.
+func shaCrypt(newHash func() hash.Hash, permutation [][]int, magic, stored, password string) string {
+	settings := strings.Split(strings.TrimPrefix(stored, magic), "$")
+
+	rounds, customRounds := 5000, false
+	if strings.HasPrefix(settings[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(settings[0], "rounds="))
+		if err != nil {
+			return ""
+		}
+		rounds, customRounds = n, true
+		if rounds < 1000 {
+			rounds = 1000
+		}
+		if rounds > 999999999 {
+			rounds = 999999999
+		}
+		settings = settings[1:]
+	}
+	if len(settings) != 2 {
+		return ""
+	}
+
+	salt := []byte(settings[0])
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	key := []byte(password)
+
+	b := newHash()
+	b.Write(key)
+	b.Write(salt)
+	b.Write(key)
+	digestB := b.Sum(nil)
+
+	a := newHash()
+	a.Write(key)
+	a.Write(salt)
+	a.Write(repeatBytes(digestB, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(key)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := newHash()
+	for i := 0; i < len(key); i++ {
+		dp.Write(key)
+	}
+	p := repeatBytes(dp.Sum(nil), len(key))
+
+	ds := newHash()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeatBytes(ds.Sum(nil), len(salt))
+
+	digest := digestA
+	for i := 0; i < rounds; i++ {
+		c := newHash()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(p)
+		}
+		digest = c.Sum(nil)
+	}
+
+	result := magic
+	if customRounds {
+		result += fmt.Sprintf("rounds=%d$", rounds)
+	}
+	return result + string(salt) + "$" + cryptEncode(digest, permutation)
+}
+
+var apr1Permutation = [][]int{
+	{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}, {11},
+}
+
+// apr1Crypt computes the Apache variant of the MD5-crypt hash of password
+// using the salt from stored.
+func apr1Crypt(stored, password string) string {
+	const magic = "$apr1$"
+
+	salt := []byte(strings.SplitN(strings.TrimPrefix(stored, magic), "$", 2)[0])
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	key := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(key)
+	alternate.Write(salt)
+	alternate.Write(key)
+	digestAlternate := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(key)
+	ctx.Write([]byte(magic))
+	ctx.Write(salt)
+	ctx.Write(repeatBytes(digestAlternate, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(key[:1])
+		}
+	}
+	digest := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(key)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(salt)
+		}
+		if i%7 != 0 {
+			c.Write(key)
+		}
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(key)
+		}
+		digest = c.Sum(nil)
+	}
+
+	return magic + string(salt) + "$" + cryptEncode(digest, apr1Permutation)
+}
+
+func repeatBytes(b []byte, length int) []byte {
+	repeated := make([]byte, 0, length)
+	for len(repeated) < length {
+		n := length - len(repeated)
+		if n > len(b) {
+			n = len(b)
+		}
+		repeated = append(repeated, b[:n]...)
+	}
+	return repeated
+}
@@ -0,0 +1,92 @@
+package handlers_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("Passwords", func() {
+	Describe("VerifyPassword", func() {
+		DescribeTable("hashed passwords",
+			func(stored, password string) {
+				Expect(handlers.VerifyPassword(stored, password)).To(BeTrue())
+				Expect(handlers.VerifyPassword(stored, password+"x")).To(BeFalse())
+				Expect(handlers.VerifyPassword(stored, "")).To(BeFalse())
+			},
+			Entry("SHA-256 crypt", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"),
+			Entry("SHA-256 crypt with rounds", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"),
+			Entry("SHA-512 crypt", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"),
+			Entry("Apache MD5", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", "password"),
+			Entry("Apache SHA-1", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"),
+			Entry("plaintext", "password", "password"),
+		)
+
+		It("verifies bcrypt hashes", func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(handlers.VerifyPassword(string(hash), "password")).To(BeTrue())
+			Expect(handlers.VerifyPassword(string(hash), "bad-password")).To(BeFalse())
+
+			htpasswdHash := "$2y$" + strings.TrimPrefix(string(hash), "$2a$")
+			Expect(handlers.VerifyPassword(htpasswdHash, "password")).To(BeTrue())
+		})
+
+		It("verifies argon2id hashes", func() {
+			salt := []byte("somesaltvalue")
+			key := argon2.IDKey([]byte("password"), salt, 1, 64*1024, 2, 32)
+			hash := fmt.Sprintf("$argon2id$v=%d$m=65536,t=1,p=2$%s$%s",
+				argon2.Version,
+				base64.RawStdEncoding.EncodeToString(salt),
+				base64.RawStdEncoding.EncodeToString(key),
+			)
+
+			Expect(handlers.VerifyPassword(hash, "password")).To(BeTrue())
+			Expect(handlers.VerifyPassword(hash, "bad-password")).To(BeFalse())
+		})
+
+		It("rejects malformed argon2id hashes", func() {
+			Expect(handlers.VerifyPassword("$argon2id$v=19$m=65536,t=1,p=2$c2FsdA", "password")).To(BeFalse())
+			Expect(handlers.VerifyPassword("$argon2id$v=16$m=65536,t=1,p=2$c2FsdA$aGFzaA", "password")).To(BeFalse())
+			Expect(handlers.VerifyPassword("$argon2id$v=19$m=65536,t=1,p=0$c2FsdA$aGFzaA", "password")).To(BeFalse())
+			Expect(handlers.VerifyPassword("$argon2id$v=19$m=65536,t=0,p=1$c2FsdA$aGFzaA", "password")).To(BeFalse())
+		})
+
+		It("rejects malformed SHA-crypt hashes", func() {
+			Expect(handlers.VerifyPassword("$5$rounds=5000", "password")).To(BeFalse())
+			Expect(handlers.VerifyPassword("$5$rounds=5000$", "password")).To(BeFalse())
+			Expect(handlers.VerifyPassword("$6$", "password")).To(BeFalse())
+			Expect(handlers.VerifyPassword("$6$salt", "password")).To(BeFalse())
+		})
+	})
+
+	Describe("ParseHtpasswd", func() {
+		It("returns the users and hashes", func() {
+			users, err := handlers.ParseHtpasswd(strings.NewReader(`
+# comment
+alice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(Equal(map[string]string{
+				"alice": "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/",
+				"bob":   "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+			}))
+		})
+
+		It("fails on malformed entries", func() {
+			_, err := handlers.ParseHtpasswd(strings.NewReader("alice:hash\nbob\n"))
+			Expect(err).To(MatchError("malformed htpasswd entry on line 2"))
+		})
+	})
+})
@@ -0,0 +1,527 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// USAGE_PARAM is the query parameter that requests a usage report instead
+// of the blob or listing at a path.
+const USAGE_PARAM = "usage"
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaRule limits the bytes and number of blobs stored beneath a path
+// prefix or owned by a user. The owner of a blob is the user that last
+// uploaded it. A limit of zero is unlimited.
+type QuotaRule struct {
+	Prefix     string `json:"prefix,omitempty"`
+	User       string `json:"user,omitempty"`
+	MaxBytes   int64  `json:"max_bytes,omitempty"`
+	MaxObjects int64  `json:"max_objects,omitempty"`
+}
+
+func (rule *QuotaRule) Validate() error {
+	if (rule.Prefix == "") == (rule.User == "") {
+		return errors.New("quota must have either a prefix or a user")
+	}
+	if rule.Prefix != "" && !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("quota prefix must be absolute: %q", rule.Prefix)
+	}
+	if rule.MaxBytes < 0 || rule.MaxObjects < 0 {
+		return errors.New("quota limits cannot be negative")
+	}
+	if rule.MaxBytes == 0 && rule.MaxObjects == 0 {
+		return errors.New("quota must limit bytes or objects")
+	}
+	return nil
+}
+
+// QuotaRules are all enforced; an upload must satisfy every rule that
+// applies to it.
+type QuotaRules []QuotaRule
+
+// Applicable returns the rules that apply to an upload of upath by user.
+func (rules QuotaRules) Applicable(upath, user string) QuotaRules {
+	var applicable QuotaRules
+	for _, rule := range rules {
+		if rule.appliesTo(upath, user) {
+			applicable = append(applicable, rule)
+		}
+	}
+	return applicable
+}
+
+func (rule QuotaRule) appliesTo(upath, user string) bool {
+	return rule.User != "" && rule.User == user || rule.Prefix != "" && hasPathPrefix(upath, rule.Prefix)
+}
+
+// Usage is the number of bytes and blobs stored.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+type blobUsage struct {
+	size  int64
+	owner string
+}
+
+// UsageTracker counts the bytes and blobs stored beneath each directory and
+// owned by each user. It scans the storage when it is first needed and is
+// then kept up to date as blobs are uploaded and deleted. The storage is
+// never read while the counts are locked, so a scan or a slow backend does
+// not hold up other requests. The zero value is ready to use.
+type UsageTracker struct {
+	mu      sync.Mutex
+	scanned bool
+	usageCounts
+	reservations map[*reservation]bool
+
+	// scanning allows one scan at a time. The paths changed while it runs
+	// are refreshed once its counts are in place.
+	scanning sync.Mutex
+	changed  map[string]bool
+
+	// Refreshes read the storage concurrently, so the result of one that
+	// started before another refresh of the same path was applied is
+	// dropped.
+	started  uint64
+	applied  map[string]uint64
+	inflight int
+}
+
+// usageCounts are the blobs counted and their totals.
+type usageCounts struct {
+	blobs map[string]blobUsage
+	dirs  map[string]*Usage
+	users map[string]*Usage
+}
+
+func newUsageCounts() usageCounts {
+	return usageCounts{blobs: map[string]blobUsage{}, dirs: map[string]*Usage{}, users: map[string]*Usage{}}
+}
+
+// reservation holds room for an upload in progress so that concurrent
+// uploads cannot together exceed a quota.
+type reservation struct {
+	tracker *UsageTracker
+	upath   string
+	rules   QuotaRules
+	blob    blobUsage
+}
+
+// lockScanned scans the storage unless it has been scanned and returns with
+// the counts locked.
+func (t *UsageTracker) lockScanned(storage Storage) error {
+	for {
+		t.mu.Lock()
+		if t.scanned {
+			return nil
+		}
+		t.mu.Unlock()
+
+		if err := t.scan(storage); err != nil {
+			return err
+		}
+	}
+}
+
+// scan counts the blobs stored without holding the counts locked and then
+// puts the counts in place.
+func (t *UsageTracker) scan(storage Storage) error {
+	t.scanning.Lock()
+	defer t.scanning.Unlock()
+
+	t.mu.Lock()
+	if t.scanned {
+		t.mu.Unlock()
+		return nil
+	}
+	t.changed = map[string]bool{}
+	t.mu.Unlock()
+
+	counts := newUsageCounts()
+	err := counts.scanDir(storage, "/")
+
+	t.mu.Lock()
+	changed := t.changed
+	t.changed = nil
+	if err == nil {
+		t.usageCounts = counts
+		t.scanned = true
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for upath := range changed {
+		t.refresh(storage, upath)
+	}
+	return nil
+}
+
+func (c *usageCounts) scanDir(storage Storage, dir string) error {
+	infos, err := storage.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		upath := path.Join(dir, info.Name())
+		switch {
+		case isHidden(info.Name()):
+		case info.IsDir():
+			if err := c.scanDir(storage, upath); err != nil {
+				return err
+			}
+		default:
+			c.add(upath, blobUsage{size: info.Size(), owner: blobOwner(storage, upath, info)})
+		}
+	}
+	return nil
+}
+
+func blobOwner(storage Storage, upath string, info os.FileInfo) string {
+	if metadata, err := readMetadata(storage, upath, info); err == nil {
+		return metadata.Owner
+	}
+	return ""
+}
+
+func (c *usageCounts) add(upath string, blob blobUsage) {
+	c.remove(upath)
+	c.blobs[upath] = blob
+	c.count(upath, blob, 1)
+}
+
+func (c *usageCounts) remove(upath string) {
+	if blob, ok := c.blobs[upath]; ok {
+		delete(c.blobs, upath)
+		c.count(upath, blob, -1)
+	}
+}
+
+func (c *usageCounts) count(upath string, blob blobUsage, sign int64) {
+	usages := []*Usage{usageOf(c.users, blob.owner)}
+	for dir := path.Dir(upath); ; dir = path.Dir(dir) {
+		usages = append(usages, usageOf(c.dirs, dir))
+		if dir == "/" {
+			break
+		}
+	}
+	for _, usage := range usages {
+		usage.Bytes += sign * blob.size
+		usage.Objects += sign
+	}
+}
+
+func usageOf(usages map[string]*Usage, key string) *Usage {
+	usage, ok := usages[key]
+	if !ok {
+		usage = &Usage{}
+		usages[key] = usage
+	}
+	return usage
+}
+
+// refresh records the blob or directory now stored at upath, if any, once
+// the storage has been scanned. Directories are scanned again. The storage
+// is read before the counts are locked.
+func (t *UsageTracker) refresh(storage Storage, upath string) {
+	t.mu.Lock()
+	if !t.scanned {
+		if t.changed != nil {
+			t.changed[upath] = true
+		}
+		t.mu.Unlock()
+		return
+	}
+	t.started++
+	started := t.started
+	t.inflight++
+	t.mu.Unlock()
+
+	var blob *blobUsage
+	var rescanned *usageCounts
+	var scanErr error
+	info, err := storage.Stat(upath)
+	switch {
+	case err == nil && !info.IsDir():
+		blob = &blobUsage{size: info.Size(), owner: blobOwner(storage, upath, info)}
+	case err == nil:
+		counts := newUsageCounts()
+		scanErr = counts.scanDir(storage, upath)
+		rescanned = &counts
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight--
+	defer func() {
+		if t.inflight == 0 {
+			t.applied = nil
+		}
+	}()
+
+	if !t.scanned || t.applied[upath] > started {
+		return
+	}
+	if t.applied == nil {
+		t.applied = map[string]uint64{}
+	}
+	t.applied[upath] = started
+
+	if blob != nil {
+		t.add(upath, *blob)
+		return
+	}
+
+	t.remove(upath)
+	if usage := t.dirs[upath]; usage != nil && usage.Objects > 0 {
+		for blob := range t.blobs {
+			if hasPathPrefix(blob, upath) {
+				t.remove(blob)
+			}
+		}
+	}
+	switch {
+	case scanErr != nil:
+		// Count everything again when it is next needed rather than
+		// report a partial count.
+		t.scanned = false
+	case rescanned != nil:
+		for upath, blob := range rescanned.blobs {
+			t.add(upath, blob)
+		}
+	}
+}
+
+// total returns the bytes and blobs stored without scanning the storage. It
+// reports false until the storage has been scanned.
+func (t *UsageTracker) total() (Usage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.scanned {
+		return Usage{}, false
+	}
+	if usage := t.dirs["/"]; usage != nil {
+		return *usage, true
+	}
+	return Usage{}, true
+}
+
+// storedUsage returns the usage of the blobs stored that counts towards a
+// rule.
+func (t *UsageTracker) storedUsage(rule QuotaRule) Usage {
+	var usage *Usage
+	if rule.User != "" {
+		usage = t.users[rule.User]
+	} else {
+		usage = t.dirs[path.Clean(rule.Prefix)]
+	}
+	if usage == nil {
+		return Usage{}
+	}
+	return *usage
+}
+
+// ruleUsage returns the usage that counts towards a rule, including the
+// uploads in progress other than except.
+func (t *UsageTracker) ruleUsage(rule QuotaRule, except *reservation) Usage {
+	usage := t.storedUsage(rule)
+	for pending := range t.reservations {
+		if pending != except && rule.appliesTo(pending.upath, pending.blob.owner) {
+			usage.Bytes += pending.blob.size
+			usage.Objects++
+		}
+	}
+	return usage
+}
+
+// reserve holds room for an upload of size bytes, or of an unknown size
+// when size is negative, to upath by user. The room held for uploads of an
+// unknown size grows as they are received.
+func (t *UsageTracker) reserve(storage Storage, rules QuotaRules, upath, user string, size int64) (*reservation, error) {
+	if err := t.lockScanned(storage); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	if size < 0 {
+		size = 0
+	}
+	r := &reservation{tracker: t, upath: upath, rules: rules, blob: blobUsage{owner: user}}
+	if err := t.check(r, size); err != nil {
+		return nil, err
+	}
+	r.blob.size = size
+	if t.reservations == nil {
+		t.reservations = map[*reservation]bool{}
+	}
+	t.reservations[r] = true
+	return r, nil
+}
+
+// check fails with errQuotaExceeded unless every rule of the reservation
+// leaves room for it to hold size bytes.
+func (t *UsageTracker) check(r *reservation, size int64) error {
+	existing, replaces := t.blobs[r.upath]
+	for _, rule := range r.rules {
+		usage := t.ruleUsage(rule, r)
+		// The blob being replaced no longer counts once the upload has
+		// replaced it.
+		if replaces && (rule.User == "" || rule.User == existing.owner) {
+			usage.Bytes -= existing.size
+			usage.Objects--
+		}
+
+		if rule.MaxObjects > 0 && usage.Objects+1 > rule.MaxObjects {
+			return errQuotaExceeded
+		}
+		if rule.MaxBytes > 0 && usage.Bytes+size > rule.MaxBytes {
+			return errQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// grow holds size bytes for the upload when the quotas leave room for them.
+func (r *reservation) grow(size int64) error {
+	t := r.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.check(r, size); err != nil {
+		return err
+	}
+	r.blob.size = size
+	return nil
+}
+
+// release gives up the room held for the upload once it has been stored,
+// and so counted, or has failed.
+func (r *reservation) release() {
+	t := r.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.reservations, r)
+}
+
+// quotaReader fails with errQuotaExceeded once it has read more than the
+// reservation can hold.
+type quotaReader struct {
+	io.Reader
+	reservation *reservation
+	read        int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.reservation.blob.size {
+		if err := r.reservation.grow(r.read); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// checkQuota reserves room for an upload of size bytes to upath by the user
+// that made the request. The body is limited to the bytes the quotas allow.
+// The returned function releases the room once the upload has been counted
+// or has failed.
+func (fs *FileServer) checkQuota(r *http.Request, upath string, size int64) (io.Reader, func(), error) {
+	reserved, release, err := fs.reserveQuota(upath, requestUser(r), size)
+	if err != nil || reserved == nil {
+		return r.Body, release, err
+	}
+	return &quotaReader{Reader: r.Body, reservation: reserved}, release, nil
+}
+
+// reserveQuota reserves room for an upload of size bytes to upath by user.
+// The reservation is nil when no quota applies.
+func (fs *FileServer) reserveQuota(upath, user string, size int64) (*reservation, func(), error) {
+	rules := fs.Quotas.Applicable(upath, user)
+	if len(rules) == 0 {
+		return nil, func() {}, nil
+	}
+
+	reserved, err := fs.usageTracker().reserve(fs.storage(), rules, upath, user, size)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return reserved, reserved.release, nil
+}
+
+// Usage returns the bytes and blobs stored, scanning the storage the first
+// time it is needed. Metrics only report the usage once it has been counted,
+// so servers that export them call Usage when they start.
+func (fs *FileServer) Usage() (Usage, error) {
+	tracker := fs.usageTracker()
+	if err := tracker.lockScanned(fs.storage()); err != nil {
+		return Usage{}, err
+	}
+	defer tracker.mu.Unlock()
+
+	if usage := tracker.dirs["/"]; usage != nil {
+		return *usage, nil
+	}
+	return Usage{}, nil
+}
+
+type quotaReport struct {
+	QuotaRule
+	Usage
+}
+
+type usageReport struct {
+	Path string `json:"path"`
+	Usage
+	Quotas []quotaReport `json:"quotas"`
+}
+
+// serveUsage reports the bytes and blobs stored beneath upath and the usage
+// of the quotas that apply to uploads of upath by the user that made the
+// request.
+func (fs *FileServer) serveUsage(w http.ResponseWriter, r *http.Request, upath string) {
+	storage := fs.storage()
+	info, err := storage.Stat(upath)
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	tracker := fs.usageTracker()
+	err = tracker.lockScanned(storage)
+	report := usageReport{Path: upath, Quotas: []quotaReport{}}
+	if err == nil {
+		if info.IsDir() {
+			if usage := tracker.dirs[upath]; usage != nil {
+				report.Usage = *usage
+			}
+		} else if blob, ok := tracker.blobs[upath]; ok {
+			report.Usage = Usage{Bytes: blob.size, Objects: 1}
+		}
+		for _, rule := range fs.Quotas.Applicable(upath, requestUser(r)) {
+			report.Quotas = append(report.Quotas, quotaReport{QuotaRule: rule, Usage: tracker.storedUsage(rule)})
+		}
+		tracker.mu.Unlock()
+	}
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
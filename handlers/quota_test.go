@@ -0,0 +1,286 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing/iotest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// blockingStorage holds up the first listing of the root until released.
+type blockingStorage struct {
+	handlers.Storage
+	once    sync.Once
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) List(upath string) ([]os.FileInfo, error) {
+	if upath == "/" {
+		s.once.Do(func() {
+			close(s.listing)
+			<-s.release
+		})
+	}
+	return s.Storage.List(upath)
+}
+
+var _ = Describe("Quotas", func() {
+	var (
+		tempDir    string
+		fileServer *handlers.FileServer
+		handler    http.Handler
+	)
+
+	serve := func(user, method, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		return serveRequest(handler, user, method, target, body, headers)
+	}
+
+	put := func(user, target, content string) int {
+		return serve(user, http.MethodPut, target, strings.NewReader(content), nil).Code
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "quota")
+		Expect(err).NotTo(HaveOccurred())
+
+		fileServer = &handlers.FileServer{Root: tempDir}
+		handler = &handlers.AuthenticationHandler{
+			PublicRead: true,
+			Authorized: map[string]string{"ci": "password", "dev": "password"},
+			Delegate:   fileServer,
+		}
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Context("when a prefix is limited in bytes", func() {
+		BeforeEach(func() {
+			fileServer.Quotas = handlers.QuotaRules{{Prefix: "/builds/", MaxBytes: 16}}
+		})
+
+		It("refuses uploads whose Content-Length exceeds the quota", func() {
+			Expect(put("ci", "/builds/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/builds/b.tgz", "0123456789")).To(Equal(http.StatusInsufficientStorage))
+			Expect(put("ci", "/builds/c.tgz", "012345")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/other/b.tgz", "0123456789")).To(Equal(http.StatusCreated))
+
+			Expect(filepath.Join(tempDir, "builds", "b.tgz")).NotTo(BeAnExistingFile())
+		})
+
+		It("stops uploads of unknown length once they exceed the quota", func() {
+			body := io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("0123456789"))
+			response := serve("ci", http.MethodPut, "/builds/a.tgz", body, nil)
+			Expect(response.Code).To(Equal(http.StatusInsufficientStorage))
+			Expect(filepath.Join(tempDir, "builds", "a.tgz")).NotTo(BeAnExistingFile())
+		})
+
+		It("counts the blobs that were stored before the server started", func() {
+			Expect(os.MkdirAll(filepath.Join(tempDir, "builds"), 0755)).To(Succeed())
+			err := ioutil.WriteFile(filepath.Join(tempDir, "builds", "old.tgz"), []byte("0123456789"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(put("ci", "/builds/a.tgz", "0123456789")).To(Equal(http.StatusInsufficientStorage))
+		})
+
+		It("releases the bytes of deleted blobs", func() {
+			Expect(put("ci", "/builds/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(serve("ci", http.MethodDelete, "/builds/a.tgz", nil, nil).Code).To(Equal(http.StatusNoContent))
+			Expect(put("ci", "/builds/b.tgz", "0123456789")).To(Equal(http.StatusCreated))
+		})
+
+		It("holds room for uploads in progress", func() {
+			reader, writer := io.Pipe()
+			req, err := http.NewRequest(http.MethodPut, "http://example.com/builds/a.tgz", reader)
+			Expect(err).NotTo(HaveOccurred())
+			req.ContentLength = 10
+			req.SetBasicAuth("ci", "password")
+
+			response := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handler.ServeHTTP(response, req)
+			}()
+			_, err = writer.Write([]byte("01234"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(put("ci", "/builds/b.tgz", "0123456")).To(Equal(http.StatusInsufficientStorage))
+
+			_, err = writer.Write([]byte("56789"))
+			Expect(err).NotTo(HaveOccurred())
+			writer.Close()
+			Eventually(done).Should(BeClosed())
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/builds/b.tgz", "012345")).To(Equal(http.StatusCreated))
+		})
+
+		It("releases the room held for failed uploads", func() {
+			body := io.MultiReader(strings.NewReader("01234"), iotest.ErrReader(errors.New("connection reset")))
+			req, err := http.NewRequest(http.MethodPut, "http://example.com/builds/a.tgz", body)
+			Expect(err).NotTo(HaveOccurred())
+			req.ContentLength = 10
+			req.SetBasicAuth("ci", "password")
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+			Expect(response.Code).NotTo(Equal(http.StatusCreated))
+
+			Expect(put("ci", "/builds/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/builds/b.tgz", "012345")).To(Equal(http.StatusCreated))
+		})
+
+		It("refuses resumable uploads that would exceed the quota", func() {
+			response := serve("ci", http.MethodPost, "/builds/a.tgz", nil, map[string]string{"Upload-Length": "17"})
+			Expect(response.Code).To(Equal(http.StatusInsufficientStorage))
+		})
+	})
+
+	Context("when a prefix is limited in objects", func() {
+		BeforeEach(func() {
+			fileServer.Quotas = handlers.QuotaRules{{Prefix: "/builds/", MaxObjects: 2}}
+			fileServer.Overwrite = handlers.OverwriteRules{{Prefix: "/", Policy: handlers.OverwriteReplace}}
+		})
+
+		It("refuses new blobs beyond the limit but allows replacements", func() {
+			Expect(put("ci", "/builds/a.tgz", "a")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/builds/nested/b.tgz", "b")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/builds/c.tgz", "c")).To(Equal(http.StatusInsufficientStorage))
+			Expect(put("ci", "/builds/a.tgz", "new-a")).To(Equal(http.StatusNoContent))
+		})
+	})
+
+	Context("when a user is limited", func() {
+		BeforeEach(func() {
+			fileServer.Quotas = handlers.QuotaRules{{User: "ci", MaxBytes: 16}}
+		})
+
+		It("only counts the blobs the user uploaded", func() {
+			Expect(put("dev", "/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/b.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/c.tgz", "0123456789")).To(Equal(http.StatusInsufficientStorage))
+			Expect(put("dev", "/c.tgz", "0123456789")).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Describe("the usage report", func() {
+		BeforeEach(func() {
+			fileServer.Quotas = handlers.QuotaRules{
+				{Prefix: "/builds/", MaxBytes: 100},
+				{User: "ci", MaxObjects: 10},
+				{User: "dev", MaxObjects: 10},
+			}
+			handler.(*handlers.AuthenticationHandler).PublicRead = false
+		})
+
+		It("reports the usage beneath a path and of the quotas that apply", func() {
+			Expect(put("ci", "/builds/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(put("ci", "/builds/nested/b.tgz", "01234")).To(Equal(http.StatusCreated))
+			Expect(put("dev", "/c.tgz", "0123")).To(Equal(http.StatusCreated))
+
+			response := serve("ci", http.MethodGet, "/builds/?usage", nil, nil)
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var report map[string]interface{}
+			Expect(json.Unmarshal(response.Body.Bytes(), &report)).To(Succeed())
+			Expect(report).To(Equal(map[string]interface{}{
+				"path":    "/builds",
+				"bytes":   15.0,
+				"objects": 2.0,
+				"quotas": []interface{}{
+					map[string]interface{}{"prefix": "/builds/", "max_bytes": 100.0, "bytes": 15.0, "objects": 2.0},
+					map[string]interface{}{"user": "ci", "max_objects": 10.0, "bytes": 15.0, "objects": 2.0},
+				},
+			}))
+
+			response = serve("dev", http.MethodGet, "/?usage", nil, nil)
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(MatchJSON(`{
+				"path": "/", "bytes": 19, "objects": 3,
+				"quotas": [{"user": "dev", "max_objects": 10, "bytes": 4, "objects": 1}]
+			}`))
+		})
+
+		It("keeps counting blobs copied, moved, and deleted with WebDAV", func() {
+			fileServer.WebDAV = true
+			usage := func(target string) string {
+				response := serve("ci", http.MethodGet, target+"?usage", nil, nil)
+				Expect(response.Code).To(Equal(http.StatusOK))
+				return response.Body.String()
+			}
+			Expect(put("ci", "/builds/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+			Expect(usage("/")).To(ContainSubstring(`"bytes":10,"objects":1`))
+
+			copied := serve("ci", handlers.MethodCopy, "/builds/a.tgz", nil, map[string]string{"Destination": "/builds/b.tgz"})
+			Expect(copied.Code).To(Equal(http.StatusCreated))
+			Expect(usage("/builds/")).To(ContainSubstring(`"bytes":20,"objects":2`))
+
+			Expect(serve("ci", handlers.MethodMkcol, "/other", nil, nil).Code).To(Equal(http.StatusCreated))
+			moved := serve("ci", handlers.MethodMove, "/builds/b.tgz", nil, map[string]string{"Destination": "/other/b.tgz"})
+			Expect(moved.Code).To(Equal(http.StatusCreated))
+			Expect(usage("/builds/")).To(ContainSubstring(`"bytes":10,"objects":1`))
+			Expect(usage("/other/")).To(ContainSubstring(`"bytes":10,"objects":1`))
+
+			Expect(serve("ci", http.MethodDelete, "/builds", nil, nil).Code).To(Equal(http.StatusNoContent))
+			Expect(usage("/")).To(ContainSubstring(`"bytes":10,"objects":1`))
+		})
+
+		It("reports missing paths", func() {
+			Expect(serve("ci", http.MethodGet, "/missing/?usage", nil, nil).Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	It("serves uploads while the storage is scanned", func() {
+		storage := &blockingStorage{
+			Storage: &handlers.LocalStorage{Root: tempDir},
+			listing: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		fileServer.Storage = storage
+
+		done := make(chan handlers.Usage)
+		go func() {
+			defer GinkgoRecover()
+			usage, err := fileServer.Usage()
+			Expect(err).NotTo(HaveOccurred())
+			done <- usage
+		}()
+		Eventually(storage.listing).Should(BeClosed())
+
+		Expect(put("ci", "/a.tgz", "0123456789")).To(Equal(http.StatusCreated))
+		Expect(serve("ci", http.MethodDelete, "/a.tgz", nil, nil).Code).To(Equal(http.StatusNoContent))
+		Expect(put("ci", "/b.tgz", "01234")).To(Equal(http.StatusCreated))
+
+		close(storage.release)
+		Eventually(done).Should(Receive(Equal(handlers.Usage{Bytes: 5, Objects: 1})))
+	})
+
+	Describe("QuotaRule", func() {
+		It("requires a prefix or a user and a limit", func() {
+			Expect((&handlers.QuotaRule{Prefix: "/builds/", MaxBytes: 1}).Validate()).To(Succeed())
+			Expect((&handlers.QuotaRule{User: "ci", MaxObjects: 1}).Validate()).To(Succeed())
+			Expect((&handlers.QuotaRule{MaxBytes: 1}).Validate()).To(MatchError("quota must have either a prefix or a user"))
+			Expect((&handlers.QuotaRule{Prefix: "/", User: "ci", MaxBytes: 1}).Validate()).To(HaveOccurred())
+			Expect((&handlers.QuotaRule{Prefix: "builds/", MaxBytes: 1}).Validate()).To(MatchError(ContainSubstring("absolute")))
+			Expect((&handlers.QuotaRule{Prefix: "/builds/"}).Validate()).To(MatchError("quota must limit bytes or objects"))
+			Expect((&handlers.QuotaRule{User: "ci", MaxBytes: -1}).Validate()).To(MatchError("quota limits cannot be negative"))
+		})
+	})
+})
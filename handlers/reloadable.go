@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ReloadableHandler delegates to a handler that can be replaced while
+// requests are being served. Requests in flight continue with the handler
+// they started with.
+type ReloadableHandler struct {
+	current atomic.Value
+}
+
+type handlerHolder struct {
+	http.Handler
+}
+
+func NewReloadableHandler(handler http.Handler) *ReloadableHandler {
+	rh := &ReloadableHandler{}
+	rh.Swap(handler)
+	return rh
+}
+
+func (rh *ReloadableHandler) Swap(handler http.Handler) {
+	rh.current.Store(handlerHolder{handler})
+}
+
+func (rh *ReloadableHandler) Handler() http.Handler {
+	return rh.current.Load().(handlerHolder).Handler
+}
+
+func (rh *ReloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.Handler().ServeHTTP(w, r)
+}
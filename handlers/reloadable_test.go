@@ -0,0 +1,36 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("ReloadableHandler", func() {
+	statusHandler := func(status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+	}
+
+	It("delegates to the current handler", func() {
+		handler := handlers.NewReloadableHandler(statusHandler(http.StatusOK))
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		handler.Swap(statusHandler(http.StatusTeapot))
+
+		response = httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		Expect(response.Code).To(Equal(http.StatusTeapot))
+	})
+})
@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads are staged in a session directory beneath Root. The
+// directory name starts with UPLOAD_PREFIX so it is never served or listed.
+const UPLOAD_SESSIONS_DIR = UPLOAD_PREFIX + "sessions"
+
+// UPLOAD_ID_PARAM is the query parameter that addresses an upload session.
+const UPLOAD_ID_PARAM = "upload_id"
+
+// UploadSessionLifetime is how long an upload session may be left idle
+// before it is discarded.
+const UploadSessionLifetime = 7 * 24 * time.Hour
+
+var (
+	errOffsetMismatch = errors.New("upload offset does not match")
+	errUploadTooLarge = errors.New("upload exceeds its declared length")
+)
+
+// uploadSession describes a resumable upload in progress. It is stored as
+// JSON next to the staged data so uploads can be resumed after a restart.
+type uploadSession struct {
+	Path    string  `json:"path"`
+	Length  int64   `json:"length"`
+	Digests Digests `json:"digests,omitempty"`
+	Owner   string  `json:"owner,omitempty"`
+}
+
+func (fs *FileServer) sessionDir(id string) (string, bool) {
+	if decoded, err := hex.DecodeString(id); err != nil || len(decoded) != 16 {
+		return "", false
+	}
+	return filepath.Join(fs.Root, UPLOAD_SESSIONS_DIR, id), true
+}
+
+// isUploadSessionRequest reports whether the request addresses an upload
+// session rather than a blob.
+func isUploadSessionRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost || r.Method == http.MethodPatch || r.URL.Query().Get(UPLOAD_ID_PARAM) != ""
+}
+
+// isReservedPath reports whether upath names, or is beneath, an upload
+// temporary, an upload session, or a metadata or redirect sidecar. They are
+// internal to the server and never served or written by clients.
+func isReservedPath(upath string) bool {
+	for _, element := range strings.Split(upath, "/") {
+		if isHidden(element) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimedSessions are the upload sessions with a PATCH or DELETE in
+// progress. Its mutex is only held to claim or release a session, never
+// while data is received or a blob is committed, and it is separate from the
+// location locks taken by commits so the two cannot deadlock.
+var claimedSessions = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+// claimUploadSession claims the session in dir until the returned function
+// is called. It fails when another request has claimed the session.
+func claimUploadSession(dir string) (func(), bool) {
+	claimedSessions.Lock()
+	defer claimedSessions.Unlock()
+
+	if claimedSessions.dirs[dir] {
+		return nil, false
+	}
+	claimedSessions.dirs[dir] = true
+	return func() {
+		claimedSessions.Lock()
+		defer claimedSessions.Unlock()
+		delete(claimedSessions.dirs, dir)
+	}, true
+}
+
+func (fs *FileServer) serveUploadSession(w http.ResponseWriter, r *http.Request, upath string) {
+	if r.Method == http.MethodPost {
+		fs.createUploadSession(w, r, upath)
+		return
+	}
+
+	id := r.URL.Query().Get(UPLOAD_ID_PARAM)
+	dir, ok := fs.sessionDir(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// HEAD may report the offset while a chunk is being received.
+	if r.Method != http.MethodHead {
+		release, ok := claimUploadSession(dir)
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		defer release()
+	}
+
+	session, offset, err := readUploadSession(dir)
+	if err != nil || session.Path != upath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		fs.appendUploadSession(w, r, dir, session, offset)
+
+	case http.MethodDelete:
+		if err := os.RemoveAll(dir); err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (fs *FileServer) createUploadSession(w http.ResponseWriter, r *http.Request, upath string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	expected, err := requestDigests(r.Header)
+	if err != nil {
+		log.Printf("rejecting upload: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := fs.storage().Stat(upath); err == nil && fs.Overwrite.Policy(upath) == OverwriteReject {
+		sendErrorResponse(w, r, &os.PathError{Op: "create", Path: upath, Err: os.ErrExist})
+		return
+	}
+
+	if err := fs.checkUpload(upath, length); err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	// The quotas are checked again before the blob is assembled; room is
+	// only held while it is stored.
+	_, release, err := fs.reserveQuota(upath, requestUser(r), length)
+	release()
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("failed to create upload session: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	dir, _ := fs.sessionDir(hex.EncodeToString(id))
+
+	session := uploadSession{Path: upath, Length: length, Digests: expected, Owner: requestUser(r)}
+	if err := createUploadSession(dir, &session); err != nil {
+		log.Printf("failed to create upload session: %s", err)
+		os.RemoveAll(dir)
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	query := url.Values{}
+	query.Set(UPLOAD_ID_PARAM, hex.EncodeToString(id))
+	w.Header().Set("Location", hrefFor(upath, false)+"?"+query.Encode())
+	w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// appendUploadSession appends the request body to the staged data. Data
+// received before a dropped connection is kept so the client can resume
+// from the offset reported by HEAD. Once all of the data has been received,
+// the blob is assembled.
+func (fs *FileServer) appendUploadSession(w http.ResponseWriter, r *http.Request, dir string, session *uploadSession, offset int64) {
+	requested, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if requested != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		sendErrorResponse(w, r, errOffsetMismatch)
+		return
+	}
+
+	if err := fs.checkFreeSpace(r.ContentLength); err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	done := fs.Metrics.uploadStarted()
+	defer done()
+
+	offset, err = appendChunk(filepath.Join(dir, "data"), r.Body, session.Length-offset)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		log.Printf("upload to %s interrupted at offset %d: %s", session.Path, offset, err)
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	if offset < session.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	_, release, err := fs.reserveQuota(session.Path, session.Owner, session.Length)
+	defer release()
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	metadata, replaced, err := fs.assembleUpload(dir, session)
+	fs.usageTracker().refresh(fs.storage(), session.Path)
+	if isDigestMismatch(err) {
+		os.RemoveAll(dir)
+	}
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+	os.RemoveAll(dir)
+
+	w.Header().Set("ETag", metadata.ETag())
+	metadata.Digests().SetHeaders(w.Header())
+	if replaced {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// assembleUpload verifies the staged data and commits it to storage.
+func (fs *FileServer) assembleUpload(dir string, session *uploadSession) (*Metadata, bool, error) {
+	staged, err := os.Open(filepath.Join(dir, "data"))
+	if err != nil {
+		return nil, false, err
+	}
+	defer staged.Close()
+
+	digester := newDigester()
+	size, err := io.Copy(digester, staged)
+	if err != nil {
+		return nil, false, err
+	}
+	digests := digester.Digests()
+	if err := digests.Verify(session.Digests); err != nil {
+		return nil, false, err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	storage := fs.storage()
+	upload, err := storage.Create(session.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer upload.Close()
+	if _, err := io.Copy(upload, staged); err != nil {
+		return nil, false, err
+	}
+
+	replaced := false
+	precondition := overwritePrecondition(fs.Overwrite.Policy(session.Path), storage, session.Path, &replaced)
+	metadata := newMetadata(size, digests)
+	metadata.Owner = session.Owner
+	metadata, err = commitUpload(storage, session.Path, upload, metadata, precondition)
+	return metadata, replaced, err
+}
+
+func createUploadSession(dir string, session *uploadSession) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	info, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "session.json"), info, 0644); err != nil {
+		return err
+	}
+
+	data, err := os.OpenFile(filepath.Join(dir, "data"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return data.Close()
+}
+
+// readUploadSession loads a session and the number of bytes received so far.
+func readUploadSession(dir string) (*uploadSession, int64, error) {
+	info, err := ioutil.ReadFile(filepath.Join(dir, "session.json"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	session := &uploadSession{}
+	if err := json.Unmarshal(info, session); err != nil {
+		return nil, 0, err
+	}
+
+	data, err := os.Stat(filepath.Join(dir, "data"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return session, data.Size(), nil
+}
+
+// appendChunk appends up to remaining bytes of body to the staged data and
+// returns the new size of the data. A body larger than remaining is
+// rejected without changing the data.
+func appendChunk(data string, body io.Reader, remaining int64) (int64, error) {
+	f, err := os.OpenFile(data, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(f, io.LimitReader(body, remaining+1))
+	if err == nil && written > remaining {
+		err = errUploadTooLarge
+		if terr := f.Truncate(start); terr != nil {
+			return 0, terr
+		}
+		written = 0
+	}
+
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	return start + written, err
+}
+
+// removeExpiredUploadSessions discards upload sessions that have been idle
+// for longer than UploadSessionLifetime.
+func (fs *FileServer) removeExpiredUploadSessions(now time.Time) error {
+	sessions, err := ioutil.ReadDir(filepath.Join(fs.Root, UPLOAD_SESSIONS_DIR))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		dir := filepath.Join(fs.Root, UPLOAD_SESSIONS_DIR, session.Name())
+		data, err := os.Stat(filepath.Join(dir, "data"))
+		if err == nil && now.Sub(data.ModTime()) < UploadSessionLifetime {
+			continue
+		}
+		log.Printf("removing expired upload session: %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove upload session: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package handlers_test
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("Resumable uploads", func() {
+	var (
+		handler *handlers.FileServer
+		tempDir string
+	)
+
+	serve := func(method, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		return serveRequest(handler, "", method, target, body, headers)
+	}
+
+	create := func(target, length string, headers map[string]string) string {
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers["Upload-Length"] = length
+
+		response := serve(http.MethodPost, target, nil, headers)
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		Expect(response.Header().Get("Upload-Offset")).To(Equal("0"))
+		Expect(response.Header().Get("Location")).To(HavePrefix(target + "?upload_id="))
+		return response.Header().Get("Location")
+	}
+
+	patch := func(session, offset, chunk string) *httptest.ResponseRecorder {
+		return serve(http.MethodPatch, session, strings.NewReader(chunk), map[string]string{"Upload-Offset": offset})
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "resumable")
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = &handlers.FileServer{Root: tempDir}
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("assembles the blob once every chunk has been received", func() {
+		session := create("/dir/blob.tgz", "9", map[string]string{
+			"Digest": "sha-256=wnUq2W7mUuTTf9OFLeYyxQ8ZNJDRMvJ6F5TJhuHxEu8=",
+		})
+
+		response := patch(session, "0", "blob-")
+		Expect(response.Code).To(Equal(http.StatusNoContent))
+		Expect(response.Header().Get("Upload-Offset")).To(Equal("5"))
+
+		response = serve(http.MethodHead, session, nil, nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Header().Get("Upload-Offset")).To(Equal("5"))
+		Expect(response.Header().Get("Upload-Length")).To(Equal("9"))
+
+		_, err := os.Stat(filepath.Join(tempDir, "dir", "blob.tgz"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		response = patch(session, "5", "data")
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		Expect(response.Header().Get("ETag")).To(Equal(`"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`))
+
+		contents, err := ioutil.ReadFile(filepath.Join(tempDir, "dir", "blob.tgz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(BeEquivalentTo("blob-data"))
+
+		Expect(serve(http.MethodHead, session, nil, nil).Code).To(Equal(http.StatusNotFound))
+		sessions, err := ioutil.ReadDir(filepath.Join(tempDir, ".upload-sessions"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sessions).To(BeEmpty())
+	})
+
+	It("rejects a chunk that does not start at the current offset", func() {
+		session := create("/blob.tgz", "9", nil)
+		Expect(patch(session, "0", "blob-").Code).To(Equal(http.StatusNoContent))
+
+		response := patch(session, "0", "blob-")
+		Expect(response.Code).To(Equal(http.StatusConflict))
+		Expect(response.Header().Get("Upload-Offset")).To(Equal("5"))
+	})
+
+	It("rejects data beyond the declared length", func() {
+		session := create("/blob.tgz", "4", nil)
+
+		response := patch(session, "0", "blob-data")
+		Expect(response.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(response.Header().Get("Upload-Offset")).To(Equal("0"))
+	})
+
+	It("discards the session when the assembled blob does not match its digest", func() {
+		session := create("/blob.tgz", "9", map[string]string{
+			"Digest": "sha-256=wnUq2W7mUuTTf9OFLeYyxQ8ZNJDRMvJ6F5TJhuHxEu8=",
+		})
+
+		Expect(patch(session, "0", "blob-date").Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(http.MethodHead, session, nil, nil).Code).To(Equal(http.StatusNotFound))
+
+		_, err := os.Stat(filepath.Join(tempDir, "blob.tgz"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("aborts a session with DELETE", func() {
+		session := create("/blob.tgz", "9", nil)
+		Expect(patch(session, "0", "blob-").Code).To(Equal(http.StatusNoContent))
+
+		Expect(serve(http.MethodDelete, session, nil, nil).Code).To(Equal(http.StatusNoContent))
+		Expect(serve(http.MethodHead, session, nil, nil).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("only resumes a session at the path it was created for", func() {
+		session := create("/blob.tgz", "9", nil)
+		other := strings.Replace(session, "/blob.tgz", "/other.tgz", 1)
+
+		Expect(patch(other, "0", "blob-data").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("refuses to create a session for an existing blob", func() {
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "blob.tgz"), []byte("blob-data"), 0644)).To(Succeed())
+
+		response := serve(http.MethodPost, "/blob.tgz", nil, map[string]string{"Upload-Length": "9"})
+		Expect(response.Code).To(Equal(http.StatusConflict))
+	})
+
+	It("requires the length of the upload", func() {
+		Expect(serve(http.MethodPost, "/blob.tgz", nil, nil).Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("does not serve the staged data", func() {
+		create("/blob.tgz", "9", nil)
+
+		Expect(serve(http.MethodGet, "/.upload-sessions/", nil, nil).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("keeps sessions that can still be resumed when removing stale uploads", func() {
+		session := create("/blob.tgz", "9", nil)
+		Expect(patch(session, "0", "blob-").Code).To(Equal(http.StatusNoContent))
+
+		Expect(handler.RemoveStaleUploads()).To(Succeed())
+
+		Expect(patch(session, "5", "data").Code).To(Equal(http.StatusCreated))
+	})
+
+	It("rejects a chunk while another is being received", func() {
+		session := create("/blob.tgz", "9", nil)
+		reader, writer := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serve(http.MethodPatch, session, reader, map[string]string{"Upload-Offset": "0"})
+		}()
+		_, err := writer.Write([]byte("blob-"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(patch(session, "5", "data").Code).To(Equal(http.StatusConflict))
+		Expect(serve(http.MethodDelete, session, nil, nil).Code).To(Equal(http.StatusConflict))
+		Expect(serve(http.MethodHead, session, nil, nil).Code).To(Equal(http.StatusOK))
+
+		writer.Close()
+		Eventually(done).Should(BeClosed())
+		Expect(patch(session, "5", "data").Code).To(Equal(http.StatusCreated))
+	})
+
+	It("assembles a blob whose path shares a lock with its session", func() {
+		handler.Overwrite = handlers.OverwriteRules{{Prefix: "/", Policy: handlers.OverwriteReplace}}
+		stripe := func(location string) uint32 {
+			h := fnv.New32a()
+			h.Write([]byte(location))
+			return h.Sum32() % 64
+		}
+
+		// Stage a session by hand whose directory hashes to the same
+		// location lock as the blob it assembles.
+		var dir string
+		for i := 0; ; i++ {
+			id := fmt.Sprintf("%032x", i)
+			dir = filepath.Join(tempDir, ".upload-sessions", id)
+			if stripe(dir) == stripe("/blob.tgz") {
+				break
+			}
+		}
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "session.json"), []byte(`{"path": "/blob.tgz", "length": 9}`), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "data"), []byte("blob-"), 0600)).To(Succeed())
+
+		done := make(chan int)
+		go func() {
+			done <- patch("/blob.tgz?upload_id="+filepath.Base(dir), "5", "data").Code
+		}()
+		Eventually(done).Should(Receive(Equal(http.StatusCreated)))
+		Expect(ioutil.ReadFile(filepath.Join(tempDir, "blob.tgz"))).To(BeEquivalentTo("blob-data"))
+	})
+})
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type Role string
+
+const (
+	RoleRead   Role = "read"
+	RoleWrite  Role = "write"
+	RoleDelete Role = "delete"
+	RoleAdmin  Role = "admin"
+)
+
+func ParseRole(name string) (Role, error) {
+	switch role := Role(name); role {
+	case RoleRead, RoleWrite, RoleDelete, RoleAdmin:
+		return role, nil
+	default:
+		return "", fmt.Errorf("unknown role: %q", name)
+	}
+}
+
+// RequiredRole returns the role a user must hold to make a request with the
+// method. Methods the server does not recognize require the admin role.
+func RequiredRole(method string) Role {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return RoleRead
+	case http.MethodPut:
+		return RoleWrite
+	case http.MethodDelete:
+		return RoleDelete
+	default:
+		return RoleAdmin
+	}
+}
+
+type Roles []Role
+
+// Has reports whether role has been granted. The admin role implies all
+// other roles.
+func (roles Roles) Has(role Role) bool {
+	for _, r := range roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
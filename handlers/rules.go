@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Access string
+
+const (
+	AccessAllow Access = "allow"
+	AccessDeny  Access = "deny"
+)
+
+// Special user names that may be used in a rule.
+const (
+	AnonymousUser     = "@anonymous"
+	AuthenticatedUser = "@authenticated"
+)
+
+// Rule controls access to the blobs under a path prefix. A rule applies to a
+// request when the cleaned request path is at or below Prefix and both the
+// method and user are listed. Empty Methods or Users lists match any method
+// or user. Allow rules must list their users so that anonymous access is
+// only granted explicitly, with AnonymousUser.
+type Rule struct {
+	Prefix  string   `json:"prefix"`
+	Methods []string `json:"methods,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	Access  Access   `json:"access"`
+}
+
+func (rule *Rule) Validate() error {
+	if !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("rule prefix must be absolute: %q", rule.Prefix)
+	}
+	switch rule.Access {
+	case AccessAllow, AccessDeny:
+	case "":
+		return errors.New("rule access is required")
+	default:
+		return fmt.Errorf("unknown rule access: %q", rule.Access)
+	}
+	if rule.Access == AccessAllow && len(rule.Users) == 0 {
+		return fmt.Errorf("allow rule for %q must list its users; use %s or %s to allow everyone", rule.Prefix, AuthenticatedUser, AnonymousUser)
+	}
+	return nil
+}
+
+func (rule *Rule) matches(username, method, upath string) bool {
+	if !hasPathPrefix(upath, rule.Prefix) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, method) {
+		return false
+	}
+	if len(rule.Users) == 0 {
+		return true
+	}
+	for _, user := range rule.Users {
+		switch {
+		case user == AnonymousUser && username == "":
+			return true
+		case user == AuthenticatedUser && username != "":
+			return true
+		case user == username && username != "":
+			return true
+		}
+	}
+	return false
+}
+
+// Rules are evaluated in order and the first rule that applies to a request
+// determines its access.
+type Rules []Rule
+
+// Evaluate returns the access of the first rule that applies to the request
+// and whether any rule applied. An empty username denotes an anonymous
+// request.
+func (rules Rules) Evaluate(username, method, upath string) (Access, bool) {
+	for i := range rules {
+		if rules[i].matches(username, method, upath) {
+			return rules[i].Access, true
+		}
+	}
+	return "", false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
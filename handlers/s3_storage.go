@@ -0,0 +1,710 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 multipart upload part sizes. Every part but the last must be at least
+// MinS3PartSize bytes.
+const (
+	DefaultS3PartSize = 16 << 20
+	MinS3PartSize     = 5 << 20
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// defaultS3Client gives up on connections and responses that stall so a
+// service that stops answering fails requests rather than holding them. It
+// has no overall timeout because objects may take any time to stream.
+var defaultS3Client = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+		DisableCompression:    true,
+	},
+}
+
+// S3Storage stores blobs as objects in a bucket of Amazon S3 or of an S3
+// compatible service such as MinIO or Ceph RGW. Objects are addressed with
+// path style URLs and requests are signed with AWS Signature Version 4.
+//
+// Directories are the common prefixes of the objects in the bucket, so an
+// empty directory cannot be stored.
+type S3Storage struct {
+	// Endpoint is the URL of the service, such as "https://s3.amazonaws.com"
+	// or "http://minio.example.com:9000".
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region,omitempty"`
+	Bucket   string `json:"bucket"`
+
+	// Prefix is prepended to the key of every object.
+	Prefix string `json:"prefix,omitempty"`
+
+	// The credentials default to the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables. Requests are not
+	// signed when there are none.
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+
+	// Blobs larger than PartSize are uploaded in parts of PartSize bytes.
+	PartSize int64 `json:"part_size,omitempty"`
+
+	// Client sends the requests. It defaults to a client that times out
+	// connections and responses that stall.
+	Client *http.Client `json:"-"`
+}
+
+func (s *S3Storage) Validate() error {
+	if s.Bucket == "" {
+		return errors.New("s3 bucket is required")
+	}
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("s3 endpoint must be an http or https URL: %q", s.Endpoint)
+	}
+	if s.PartSize != 0 && s.PartSize < MinS3PartSize {
+		return fmt.Errorf("s3 part size must be at least %d bytes", MinS3PartSize)
+	}
+	if (s.AccessKeyID == "") != (s.SecretAccessKey == "") {
+		return errors.New("s3 access key id and secret access key must be configured together")
+	}
+	return nil
+}
+
+// s3Error is an error response from the service.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+	Key     string `xml:"-"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %s: %d %s: %s", e.Key, e.Status, e.Code, e.Message)
+}
+
+// pathError converts the error responses that have a meaning for blobs.
+func (e *s3Error) pathError(op, upath string) error {
+	switch e.Status {
+	case http.StatusNotFound:
+		return &os.PathError{Op: op, Path: upath, Err: os.ErrNotExist}
+	case http.StatusForbidden:
+		return &os.PathError{Op: op, Path: upath, Err: os.ErrPermission}
+	case http.StatusPreconditionFailed:
+		return &os.PathError{Op: op, Path: upath, Err: os.ErrExist}
+	default:
+		return e
+	}
+}
+
+func readS3Error(resp *http.Response, key string) *s3Error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	e := &s3Error{}
+	xml.Unmarshal(body, e)
+	e.Status, e.Key = resp.StatusCode, key
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// isBackendError reports whether err is a failure of the service that
+// stores the blobs rather than of the request.
+func isBackendError(err error) bool {
+	var s3err *s3Error
+	var urlErr *url.Error
+	return errors.As(err, &s3err) || errors.As(err, &urlErr)
+}
+
+func (s *S3Storage) key(upath string) string {
+	return strings.Trim(s.Prefix, "/") + upath
+}
+
+func (s *S3Storage) dirPrefix(upath string) string {
+	key := strings.TrimPrefix(s.key(upath), "/")
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	return key
+}
+
+// Open starts reading the object and takes its size from the response, so
+// a blob that is read from the start costs a single request.
+func (s *S3Storage) Open(upath string) (File, error) {
+	resp, err := s.do(http.MethodGet, s.key(upath), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp, s.key(upath)).pathError("open", upath)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s: response without a content length", s.key(upath))
+	}
+	return &s3File{storage: s, upath: upath, size: resp.ContentLength, etag: resp.Header.Get("ETag"), body: resp.Body}, nil
+}
+
+func (s *S3Storage) Stat(upath string) (os.FileInfo, error) {
+	if upath == "/" {
+		return &fileInfo{name: "/", dir: true}, nil
+	}
+
+	info, _, err := s.head(upath)
+	if !os.IsNotExist(err) {
+		return info, err
+	}
+
+	result, err := s.list(s.dirPrefix(upath), "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: upath, Err: os.ErrNotExist}
+	}
+	return &fileInfo{name: path.Base(upath), dir: true}, nil
+}
+
+func (s *S3Storage) head(upath string) (os.FileInfo, string, error) {
+	resp, err := s.do(http.MethodHead, s.key(upath), nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", readS3Error(resp, s.key(upath)).pathError("stat", upath)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	info := &fileInfo{name: path.Base(upath), size: resp.ContentLength, modTime: modTime}
+	return info, resp.Header.Get("ETag"), nil
+}
+
+func (s *S3Storage) Create(upath string) (Upload, error) {
+	partSize := s.PartSize
+	if partSize == 0 {
+		partSize = DefaultS3PartSize
+	}
+	return &s3Upload{storage: s, upath: upath, key: s.key(upath), partSize: partSize}, nil
+}
+
+// Delete removes an object. Directories only exist while they contain
+// objects so an existing directory is never empty.
+func (s *S3Storage) Delete(upath string) error {
+	info, err := s.Stat(upath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "remove", Path: upath, Err: errNotEmpty}
+	}
+
+	resp, err := s.do(http.MethodDelete, s.key(upath), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, s.key(upath)).pathError("remove", upath)
+	}
+	return nil
+}
+
+func (s *S3Storage) List(upath string) ([]os.FileInfo, error) {
+	prefix := s.dirPrefix(upath)
+
+	var infos []os.FileInfo
+	token := ""
+	for {
+		result, err := s.list(prefix, token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if name == "" {
+				continue
+			}
+			infos = append(infos, &fileInfo{name: name, size: object.Size, modTime: object.LastModified})
+		}
+		for _, common := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/")
+			infos = append(infos, &fileInfo{name: name, dir: true})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if len(infos) == 0 && upath != "/" {
+		return nil, &os.PathError{Op: "open", Path: upath, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+func (s *S3Storage) list(prefix, token string, maxKeys int) (*listBucketResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"delimiter": {"/"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(maxKeys)},
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+
+	result := &listBucketResult{}
+	if err := s.doXML(http.MethodGet, "", query, nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// do sends a signed request for the object with key, or for the bucket when
+// key is empty.
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	objectPath := strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket
+	if key = strings.TrimPrefix(key, "/"); key != "" {
+		objectPath += "/" + key
+	}
+	u := &url.URL{
+		Scheme:   endpoint.Scheme,
+		Host:     endpoint.Host,
+		Path:     objectPath,
+		RawPath:  awsURIEncode(objectPath, false),
+		RawQuery: canonicalQuery(query),
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	accessKey, secretKey := s.AccessKeyID, s.SecretAccessKey
+	if accessKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if accessKey != "" {
+		signV4(req, payloadHash, accessKey, secretKey, region, time.Now())
+	}
+
+	client := s.Client
+	if client == nil {
+		client = defaultS3Client
+	}
+	return client.Do(req)
+}
+
+// doXML sends a request and decodes the XML response into result.
+func (s *S3Storage) doXML(method, key string, query url.Values, header http.Header, body []byte, result interface{}) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, key)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Some operations report errors in the body of a 200 OK response.
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode, Key: key}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// s3File reads an object with ranged GET requests starting at the current
+// offset, so seeking never downloads the skipped bytes. The response that
+// opened the object is kept until a read needs another offset, so seeking to
+// the end to find the size and back costs nothing. The requests are
+// conditional on the ETag the object had when it was opened.
+type s3File struct {
+	storage    *S3Storage
+	upath      string
+	size       int64
+	etag       string
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.body != nil && f.bodyOffset != f.offset {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		header := http.Header{}
+		if f.offset > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		}
+		if f.etag != "" {
+			header.Set("If-Match", f.etag)
+		}
+		key := f.storage.key(f.upath)
+		resp, err := f.storage.do(http.MethodGet, key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			defer resp.Body.Close()
+			return 0, readS3Error(resp, key)
+		}
+		f.body, f.bodyOffset = resp.Body, f.offset
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyOffset = f.offset
+	if err == io.EOF && f.offset < f.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
+
+// s3Upload buffers up to one part in memory. Small blobs are stored with a
+// single PUT when committed; larger blobs are streamed with a multipart
+// upload.
+type s3Upload struct {
+	storage  *S3Storage
+	upath    string
+	key      string
+	partSize int64
+
+	buf      bytes.Buffer
+	uploadID string
+	parts    []completedPart
+	done     bool
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	if u.done {
+		return 0, os.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := int(u.partSize) - u.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		u.buf.Write(p[:n])
+		written += n
+		p = p[n:]
+
+		if int64(u.buf.Len()) == u.partSize && len(p) > 0 {
+			if err := u.flushPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (u *s3Upload) flushPart() error {
+	if u.uploadID == "" {
+		result := struct {
+			UploadID string `xml:"UploadId"`
+		}{}
+		err := u.storage.doXML(http.MethodPost, u.key, url.Values{"uploads": {""}}, nil, nil, &result)
+		if err != nil {
+			return err
+		}
+		u.uploadID = result.UploadID
+	}
+
+	number := len(u.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {u.uploadID}}
+	resp, err := u.storage.do(http.MethodPut, u.key, query, nil, u.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, u.key)
+	}
+
+	u.parts = append(u.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	u.buf.Reset()
+	return nil
+}
+
+// Commit stores the object. A create only commit is conditional on the
+// object not existing; the object is also checked beforehand in case the
+// service ignores the condition.
+func (u *s3Upload) Commit(replace bool) error {
+	if u.done {
+		return os.ErrClosed
+	}
+
+	header := http.Header{}
+	if !replace {
+		if _, _, err := u.storage.head(u.upath); err == nil {
+			return &os.PathError{Op: "create", Path: u.upath, Err: os.ErrExist}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		header.Set("If-None-Match", "*")
+	}
+
+	var err error
+	if u.uploadID == "" {
+		err = u.putObject(header)
+	} else {
+		err = u.completeMultipart(header)
+	}
+	if e, ok := err.(*s3Error); ok {
+		return e.pathError("create", u.upath)
+	}
+	if err != nil {
+		return err
+	}
+	u.done = true
+	return nil
+}
+
+func (u *s3Upload) putObject(header http.Header) error {
+	resp, err := u.storage.do(http.MethodPut, u.key, nil, header, u.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, u.key)
+	}
+	return nil
+}
+
+func (u *s3Upload) completeMultipart(header http.Header) error {
+	if u.buf.Len() > 0 {
+		if err := u.flushPart(); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+	return u.storage.doXML(http.MethodPost, u.key, url.Values{"uploadId": {u.uploadID}}, header, body, nil)
+}
+
+// Close aborts a multipart upload that was not committed so the service
+// does not keep its parts.
+func (u *s3Upload) Close() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+	u.buf.Reset()
+	if u.uploadID == "" {
+		return nil
+	}
+
+	resp, err := u.storage.do(http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return readS3Error(resp, u.key)
+	}
+	return nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req. Every
+// header already set on the request is signed along with the host.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes a query string in the canonical form used by
+// Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent encodes every byte but the unreserved characters
+// and, unless encodeSlash is set, slashes.
+func awsURIEncode(s string, encodeSlash bool) string {
+	buf := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
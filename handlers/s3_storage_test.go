@@ -0,0 +1,429 @@
+package handlers_test
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// fakeS3 implements the subset of the S3 API used by S3Storage for a
+// single bucket.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	requests []*http.Request
+	nextID   int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access-key/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		f.list(w, r.URL.Query())
+		return
+	}
+
+	key, query := parts[1], r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	object, exists := f.objects[key]
+
+	switch {
+	case r.Method == http.MethodPost && query.Get("uploadId") == "":
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+
+	case r.Method == http.MethodPost:
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, f.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = data
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		f.objects[key] = body
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case !exists:
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+
+	default:
+		etag := fmt.Sprintf(`"%x"`, len(object))
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+
+		status := http.StatusOK
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+			object = object[start:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		w.WriteHeader(status)
+		w.Write(object)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+
+	seen := map[string]bool{}
+	var entries []string
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := key
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			entry = key[:len(prefix)+i+1]
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+
+	start := sort.SearchStrings(entries, query.Get("continuation-token"))
+	if token := query.Get("continuation-token"); token != "" && start < len(entries) && entries[start] == token {
+		start++
+	}
+	entries = entries[start:]
+
+	fmt.Fprint(w, "<ListBucketResult>")
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", entries[maxKeys-1])
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, "/") {
+			fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", entry)
+		} else {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2020-01-02T03:04:05.000Z</LastModified></Contents>", entry, len(f.objects[entry]))
+		}
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) methods() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var methods []string
+	for _, r := range f.requests {
+		methods = append(methods, r.Method+" "+r.URL.RawQuery)
+	}
+	return methods
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("the default client was used")
+}
+
+var _ = Describe("S3Storage", func() {
+	var (
+		fake    *fakeS3
+		server  *httptest.Server
+		storage *handlers.S3Storage
+	)
+
+	BeforeEach(func() {
+		fake = newFakeS3("blobs")
+		server = httptest.NewServer(fake)
+		storage = &handlers.S3Storage{
+			Endpoint:        server.URL,
+			Bucket:          "blobs",
+			Prefix:          "bosh",
+			AccessKeyID:     "access-key",
+			SecretAccessKey: "secret-key",
+		}
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	create := func(upath, content string, replace bool) error {
+		upload, err := storage.Create(upath)
+		Expect(err).NotTo(HaveOccurred())
+		defer upload.Close()
+
+		_, err = upload.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+		return upload.Commit(replace)
+	}
+
+	It("stores blobs under the prefix", func() {
+		Expect(create("/dir/blob.tgz", "blob-data", false)).To(Succeed())
+		Expect(fake.objects).To(HaveKeyWithValue("bosh/dir/blob.tgz", []byte("blob-data")))
+
+		info, err := storage.Stat("/dir/blob.tgz")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeEquivalentTo(9))
+		Expect(info.IsDir()).To(BeFalse())
+
+		info, err = storage.Stat("/dir")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.IsDir()).To(BeTrue())
+
+		_, err = storage.Stat("/missing")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("does not replace existing blobs unless asked to", func() {
+		Expect(create("/blob.tgz", "blob-data", false)).To(Succeed())
+		Expect(os.IsExist(create("/blob.tgz", "new-data", false))).To(BeTrue())
+
+		Expect(create("/blob.tgz", "new-data", true)).To(Succeed())
+		Expect(fake.objects["bosh/blob.tgz"]).To(BeEquivalentTo("new-data"))
+	})
+
+	It("streams large blobs with a multipart upload", func() {
+		storage.PartSize = 4
+		Expect(create("/blob.tgz", "blob-data", false)).To(Succeed())
+
+		Expect(fake.objects["bosh/blob.tgz"]).To(BeEquivalentTo("blob-data"))
+		Expect(fake.methods()).To(ContainElement("POST uploads="))
+		Expect(fake.methods()).To(ContainElement("PUT partNumber=3&uploadId=1"))
+		Expect(fake.uploads).To(BeEmpty())
+	})
+
+	It("aborts a multipart upload that is not committed", func() {
+		storage.PartSize = 4
+		upload, err := storage.Create("/blob.tgz")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = upload.Write([]byte("blob-data"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.uploads).To(HaveLen(1))
+
+		Expect(upload.Close()).To(Succeed())
+		Expect(fake.uploads).To(BeEmpty())
+		Expect(fake.objects).To(BeEmpty())
+	})
+
+	It("lists directories across pages", func() {
+		for i := 0; i < 1005; i++ {
+			fake.objects[fmt.Sprintf("bosh/dir/blob-%04d", i)] = []byte("x")
+		}
+		fake.objects["bosh/dir/nested/blob"] = []byte("x")
+
+		infos, err := storage.List("/dir")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(HaveLen(1006))
+		Expect(infos[0].Name()).To(Equal("blob-0000"))
+		Expect(infos[1005].Name()).To(Equal("nested"))
+		Expect(infos[1005].IsDir()).To(BeTrue())
+	})
+
+	It("does not send requests with the default HTTP client", func() {
+		defaultClient := http.DefaultClient
+		defer func() { http.DefaultClient = defaultClient }()
+		http.DefaultClient = &http.Client{Transport: failingTransport{}}
+
+		Expect(create("/blob.tgz", "blob-data", false)).To(Succeed())
+		_, err := storage.Stat("/blob.tgz")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("deletes blobs", func() {
+		Expect(create("/blob.tgz", "blob-data", false)).To(Succeed())
+
+		Expect(storage.Delete("/blob.tgz")).To(Succeed())
+		Expect(fake.objects).To(BeEmpty())
+		Expect(os.IsNotExist(storage.Delete("/blob.tgz"))).To(BeTrue())
+	})
+
+	Describe("a FileServer backed by S3Storage", func() {
+		var handler *handlers.FileServer
+
+		serve := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+			return serveRequest(handler, "", method, target, strings.NewReader(body), headers)
+		}
+
+		BeforeEach(func() {
+			handler = &handlers.FileServer{Storage: storage}
+		})
+
+		It("serves ranges of blobs without downloading the rest", func() {
+			Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			response := serve(http.MethodGet, "/blob.tgz", "", map[string]string{"Range": "bytes=5-"})
+			Expect(response.Code).To(Equal(http.StatusPartialContent))
+			Expect(response.Body.String()).To(Equal("data"))
+			Expect(response.Header().Get("ETag")).To(Equal(`"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`))
+
+			var ranges []string
+			for _, r := range fake.requests {
+				if r.Header.Get("Range") != "" {
+					ranges = append(ranges, r.Header.Get("Range"))
+				}
+			}
+			Expect(ranges).To(Equal([]string{"bytes=5-"}))
+		})
+
+		It("serves a blob without asking for its size again when opening it", func() {
+			Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+			fake.requests = nil
+
+			response := serve(http.MethodGet, "/blob.tgz", "", nil)
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(Equal("blob-data"))
+
+			var requests []string
+			for _, r := range fake.requests {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+			}
+			Expect(requests).To(Equal([]string{
+				"GET /blobs/bosh/blob.tgz.redirect",
+				"HEAD /blobs/bosh/blob.tgz",
+				"GET /blobs/bosh/blob.tgz.metadata",
+				"GET /blobs/bosh/blob.tgz",
+			}))
+		})
+
+		It("fails with 403 Forbidden when the service denies access", func() {
+			storage.AccessKeyID, storage.SecretAccessKey = "", ""
+			os.Unsetenv("AWS_ACCESS_KEY_ID")
+
+			Expect(serve(http.MethodPut, "/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("lists directories", func() {
+			Expect(serve(http.MethodPut, "/dir/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			response := serve(http.MethodGet, "/dir/?digests", "", map[string]string{"Accept": "application/json"})
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(ContainSubstring(`"name":"blob.tgz"`))
+			Expect(response.Body.String()).To(ContainSubstring(`"digest":"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`))
+		})
+
+		It("deletes collections over WebDAV", func() {
+			handler.WebDAV = true
+			Expect(serve(http.MethodPut, "/dir/a.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+			Expect(serve(http.MethodPut, "/dir/nested/b.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			Expect(serve(http.MethodDelete, "/dir", "", nil).Code).To(Equal(http.StatusNoContent))
+			Expect(fake.objects).To(BeEmpty())
+		})
+
+		It("moves collections over WebDAV", func() {
+			handler.WebDAV = true
+			Expect(serve(http.MethodPut, "/dir/a.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			response := serve("MOVE", "/dir", "", map[string]string{"Destination": "/moved"})
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(fake.objects).To(HaveKeyWithValue("bosh/moved/a.tgz", []byte("blob-data")))
+			Expect(fake.objects).To(HaveKey("bosh/moved/a.tgz.metadata"))
+			Expect(fake.objects).NotTo(HaveKey("bosh/dir/a.tgz"))
+			Expect(serve(http.MethodGet, "/moved/a.tgz", "", nil).Body.String()).To(Equal("blob-data"))
+		})
+
+		It("moves redirects over WebDAV", func() {
+			handler.WebDAV = true
+			Expect(serve(http.MethodPut, "/dir/a.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+			fake.objects["bosh/dir/a.tgz.redirect"] = []byte("http://example.com/a.tgz")
+			fake.objects["bosh/dir/b.tgz.redirect"] = []byte("http://example.com/b.tgz")
+
+			response := serve("MOVE", "/dir", "", map[string]string{"Destination": "/moved"})
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(fake.objects).To(HaveKeyWithValue("bosh/moved/a.tgz.redirect", []byte("http://example.com/a.tgz")))
+			Expect(fake.objects).To(HaveKeyWithValue("bosh/moved/b.tgz.redirect", []byte("http://example.com/b.tgz")))
+			Expect(fake.objects).NotTo(HaveKey("bosh/dir/a.tgz.redirect"))
+			Expect(serve(http.MethodGet, "/moved/b.tgz", "", nil).Code).To(Equal(http.StatusTemporaryRedirect))
+		})
+
+		It("fails with 502 Bad Gateway when the service is unavailable", func() {
+			server.Close()
+			Expect(serve(http.MethodGet, "/blob.tgz", "", nil).Code).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("requires a bucket and an endpoint", func() {
+			Expect((&handlers.S3Storage{Endpoint: "https://s3.amazonaws.com"}).Validate()).To(MatchError("s3 bucket is required"))
+			Expect((&handlers.S3Storage{Bucket: "blobs", Endpoint: "s3.amazonaws.com"}).Validate()).To(HaveOccurred())
+			Expect(storage.Validate()).To(Succeed())
+		})
+
+		It("requires parts of at least 5 MiB", func() {
+			storage.PartSize = 1 << 20
+			Expect(storage.Validate()).To(MatchError(ContainSubstring("part size")))
+		})
+	})
+})
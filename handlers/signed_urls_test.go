@@ -0,0 +1,143 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("URLSigner", func() {
+	var (
+		signer *handlers.URLSigner
+		u      *url.URL
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		signer = &handlers.URLSigner{Key: []byte("secret")}
+		now = time.Now()
+
+		var err error
+		u, err = url.Parse("http://example.com/release-a/blob.tgz")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	request := func(method string, u *url.URL) *http.Request {
+		req, err := http.NewRequest(method, u.String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		return req
+	}
+
+	It("adds an expiry and signature to the URL", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+
+		Expect(u.Query()).To(HaveKey("expires"))
+		Expect(u.Query()).To(HaveKey("signature"))
+	})
+
+	It("verifies signed URLs", func() {
+		signer.Sign("PUT", u, now.Add(time.Hour))
+
+		Expect(signer.Verify(request("PUT", u), now)).To(BeTrue())
+	})
+
+	It("allows HEAD with a URL signed for GET", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+
+		Expect(signer.Verify(request("HEAD", u), now)).To(BeTrue())
+	})
+
+	It("rejects other methods", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+
+		Expect(signer.Verify(request("PUT", u), now)).To(BeFalse())
+		Expect(signer.Verify(request("DELETE", u), now)).To(BeFalse())
+	})
+
+	It("rejects other paths", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+		u.Path = "/release-a/other.tgz"
+
+		Expect(signer.Verify(request("GET", u), now)).To(BeFalse())
+	})
+
+	It("rejects expired URLs", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+
+		Expect(signer.Verify(request("GET", u), now.Add(2*time.Hour))).To(BeFalse())
+	})
+
+	It("rejects URLs with added query parameters", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+		u.RawQuery += "&usage"
+
+		Expect(signer.Verify(request("GET", u), now)).To(BeFalse())
+	})
+
+	It("signs the query of the URL", func() {
+		u.RawQuery = "upload_id=1234"
+		signer.Sign("PATCH", u, now.Add(time.Hour))
+		Expect(signer.Verify(request("PATCH", u), now)).To(BeTrue())
+
+		query := u.Query()
+		query.Set("upload_id", "5678")
+		u.RawQuery = query.Encode()
+		Expect(signer.Verify(request("PATCH", u), now)).To(BeFalse())
+	})
+
+	It("rejects URLs with a tampered expiry", func() {
+		signer.Sign("GET", u, now.Add(time.Hour))
+		query := u.Query()
+		query.Set("expires", "99999999999")
+		u.RawQuery = query.Encode()
+
+		Expect(signer.Verify(request("GET", u), now)).To(BeFalse())
+	})
+
+	It("rejects URLs signed with another key", func() {
+		other := &handlers.URLSigner{Key: []byte("other-secret")}
+		other.Sign("GET", u, now.Add(time.Hour))
+
+		Expect(signer.Verify(request("GET", u), now)).To(BeFalse())
+	})
+
+	Context("when used by the AuthenticationHandler", func() {
+		var (
+			handler  *handlers.AuthenticationHandler
+			response *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			response = httptest.NewRecorder()
+			handler = &handlers.AuthenticationHandler{
+				Signer: signer,
+				Rules: handlers.Rules{
+					{Prefix: "/release-a", Users: []string{handlers.AnonymousUser}, Access: handlers.AccessDeny},
+				},
+				Delegate: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}),
+			}
+		})
+
+		It("accepts a valid signature in place of credentials", func() {
+			signer.Sign("PUT", u, time.Now().Add(time.Hour))
+
+			handler.ServeHTTP(response, request("PUT", u))
+			Expect(response.Code).To(Equal(http.StatusOK))
+		})
+
+		It("rejects an invalid signature", func() {
+			signer.Sign("PUT", u, time.Now().Add(-time.Hour))
+
+			handler.ServeHTTP(response, request("PUT", u))
+			Expect(response.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+})
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Storage holds the blobs served by a FileServer. Paths are cleaned, rooted
+// request paths such as "/dir/blob.tgz". Sidecars such as metadata and
+// redirects are stored as blobs of their own next to the blob they describe.
+//
+// Directories are created as blobs are created in them. WebDAV also uses
+// the following methods when the storage implements them:
+//
+//	Mkdir(upath string) error      creates an empty directory
+//	Rename(from, to string) error  moves a blob or directory atomically
+//	RemoveAll(upath string) error  removes a directory and its contents
+type Storage interface {
+	// Open opens the blob at upath for reading.
+	Open(upath string) (File, error)
+
+	// Stat describes the blob or directory at upath.
+	Stat(upath string) (os.FileInfo, error)
+
+	// Create stages a new blob for upath. Nothing is visible at upath
+	// until the upload is committed.
+	Create(upath string) (Upload, error)
+
+	// Delete removes the blob or empty directory at upath.
+	Delete(upath string) error
+
+	// List returns the blobs and directories in the directory at upath.
+	List(upath string) ([]os.FileInfo, error)
+}
+
+// File is the content of a blob opened for reading.
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Upload is a blob being written to storage.
+type Upload interface {
+	io.Writer
+
+	// Commit makes the written content visible at the path the upload was
+	// created for. Unless replace is set, Commit fails with an error that
+	// satisfies os.IsExist when a blob already exists at the path.
+	Commit(replace bool) error
+
+	// Close discards the content unless it has been committed.
+	Close() error
+}
+
+type directoryMaker interface {
+	Mkdir(upath string) error
+}
+
+type renamer interface {
+	Rename(from, to string) error
+}
+
+type allRemover interface {
+	RemoveAll(upath string) error
+}
+
+// readBlob returns the content of a small blob such as a sidecar.
+func readBlob(storage Storage, upath string) ([]byte, error) {
+	blob, err := storage.Open(upath)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return ioutil.ReadAll(blob)
+}
+
+// LocalStorage stores blobs as files beneath Root.
+type LocalStorage struct {
+	Root string
+}
+
+func (ls *LocalStorage) path(upath string) string {
+	return filepath.Join(ls.Root, filepath.FromSlash(upath))
+}
+
+func (ls *LocalStorage) Open(upath string) (File, error) {
+	return os.Open(ls.path(upath))
+}
+
+func (ls *LocalStorage) Stat(upath string) (os.FileInfo, error) {
+	return os.Stat(ls.path(upath))
+}
+
+// Create streams the blob into a temporary file in the directory of the blob
+// so that committing it is a single link or rename.
+func (ls *LocalStorage) Create(upath string) (Upload, error) {
+	location := ls.path(upath)
+	dir, name := filepath.Split(location)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	temp, err := ioutil.TempFile(dir, UPLOAD_PREFIX+name+".")
+	if err != nil {
+		return nil, err
+	}
+	return &localUpload{temp: temp, location: location}, nil
+}
+
+func (ls *LocalStorage) Delete(upath string) error {
+	return os.Remove(ls.path(upath))
+}
+
+// List returns the regular files and directories in a directory. Symbolic
+// links are described by their targets.
+func (ls *LocalStorage) List(upath string) ([]os.FileInfo, error) {
+	location := ls.path(upath)
+	infos, err := ioutil.ReadDir(location)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(filepath.Join(location, info.Name())); err != nil {
+				continue
+			}
+		}
+		if info.IsDir() || info.Mode().IsRegular() {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (ls *LocalStorage) Mkdir(upath string) error {
+	return os.Mkdir(ls.path(upath), 0755)
+}
+
+func (ls *LocalStorage) Rename(from, to string) error {
+	return os.Rename(ls.path(from), ls.path(to))
+}
+
+func (ls *LocalStorage) RemoveAll(upath string) error {
+	return os.RemoveAll(ls.path(upath))
+}
+
+type localUpload struct {
+	temp      *os.File
+	location  string
+	committed bool
+}
+
+func (u *localUpload) Write(p []byte) (int, error) {
+	return u.temp.Write(p)
+}
+
+// ReadFrom lets io.Copy use the fast paths of the operating system when the
+// blob is copied from another file.
+func (u *localUpload) ReadFrom(r io.Reader) (int64, error) {
+	return u.temp.ReadFrom(r)
+}
+
+// Commit flushes the blob to disk before moving it into place. A hard link,
+// unlike rename, fails when the target exists so concurrent uploads to the
+// same path cannot clobber each other.
+func (u *localUpload) Commit(replace bool) error {
+	err := u.temp.Chmod(0644)
+	if err == nil {
+		err = u.temp.Sync()
+	}
+	if cerr := u.temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		err = os.Rename(u.temp.Name(), u.location)
+	} else {
+		err = os.Link(u.temp.Name(), u.location)
+	}
+	if err != nil {
+		return err
+	}
+	u.committed = true
+
+	return syncDir(filepath.Dir(u.location))
+}
+
+// Close removes the temporary file, which is still linked after a create
+// only commit.
+func (u *localUpload) Close() error {
+	u.temp.Close()
+	err := os.Remove(u.temp.Name())
+	if u.committed || os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// fileInfo describes blobs and directories of storage without files.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,229 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("Storage", func() {
+	describeStorage := func(name string, newStorage func() (handlers.Storage, func())) {
+		Describe(name, func() {
+			var (
+				storage handlers.Storage
+				cleanup func()
+			)
+
+			create := func(upath, content string, replace bool) error {
+				upload, err := storage.Create(upath)
+				Expect(err).NotTo(HaveOccurred())
+				defer upload.Close()
+
+				_, err = upload.Write([]byte(content))
+				Expect(err).NotTo(HaveOccurred())
+				return upload.Commit(replace)
+			}
+
+			read := func(upath string) string {
+				blob, err := storage.Open(upath)
+				Expect(err).NotTo(HaveOccurred())
+				defer blob.Close()
+
+				content, err := ioutil.ReadAll(blob)
+				Expect(err).NotTo(HaveOccurred())
+				return string(content)
+			}
+
+			BeforeEach(func() {
+				storage, cleanup = newStorage()
+			})
+
+			AfterEach(func() {
+				cleanup()
+			})
+
+			It("stores blobs in directories", func() {
+				Expect(create("/dir/blob.tgz", "blob-data", false)).To(Succeed())
+				Expect(read("/dir/blob.tgz")).To(Equal("blob-data"))
+
+				info, err := storage.Stat("/dir/blob.tgz")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Name()).To(Equal("blob.tgz"))
+				Expect(info.Size()).To(BeEquivalentTo(9))
+				Expect(info.IsDir()).To(BeFalse())
+
+				info, err = storage.Stat("/dir")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.IsDir()).To(BeTrue())
+			})
+
+			It("does not expose a blob until it is committed", func() {
+				upload, err := storage.Create("/blob.tgz")
+				Expect(err).NotTo(HaveOccurred())
+				_, err = upload.Write([]byte("blob-data"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = storage.Stat("/blob.tgz")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				Expect(upload.Close()).To(Succeed())
+				_, err = storage.Stat("/blob.tgz")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("only replaces a blob when asked to", func() {
+				Expect(create("/blob.tgz", "blob-data", false)).To(Succeed())
+
+				err := create("/blob.tgz", "new-data", false)
+				Expect(os.IsExist(err)).To(BeTrue())
+				Expect(read("/blob.tgz")).To(Equal("blob-data"))
+
+				Expect(create("/blob.tgz", "new-data", true)).To(Succeed())
+				Expect(read("/blob.tgz")).To(Equal("new-data"))
+			})
+
+			It("lists the members of a directory by name", func() {
+				Expect(create("/dir/b", "b", false)).To(Succeed())
+				Expect(create("/dir/a", "a", false)).To(Succeed())
+				Expect(create("/dir/nested/c", "c", false)).To(Succeed())
+
+				infos, err := storage.List("/dir")
+				Expect(err).NotTo(HaveOccurred())
+
+				var names []string
+				for _, info := range infos {
+					names = append(names, info.Name())
+				}
+				Expect(names).To(Equal([]string{"a", "b", "nested"}))
+				Expect(infos[2].IsDir()).To(BeTrue())
+			})
+
+			It("deletes blobs and empty directories", func() {
+				Expect(create("/dir/blob.tgz", "blob-data", false)).To(Succeed())
+
+				Expect(storage.Delete("/dir")).NotTo(Succeed())
+				Expect(storage.Delete("/dir/blob.tgz")).To(Succeed())
+				Expect(storage.Delete("/dir")).To(Succeed())
+
+				_, err := storage.Stat("/dir")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				Expect(os.IsNotExist(storage.Delete("/dir"))).To(BeTrue())
+			})
+
+			It("reports missing blobs", func() {
+				_, err := storage.Open("/missing")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				_, err = storage.List("/missing")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+	}
+
+	describeStorage("LocalStorage", func() (handlers.Storage, func()) {
+		tempDir, err := ioutil.TempDir("", "storage")
+		Expect(err).NotTo(HaveOccurred())
+		return &handlers.LocalStorage{Root: tempDir}, func() { os.RemoveAll(tempDir) }
+	})
+
+	describeStorage("MemoryStorage", func() (handlers.Storage, func()) {
+		return handlers.NewMemoryStorage(), func() {}
+	})
+
+	describeStorage("CompressedStorage", func() (handlers.Storage, func()) {
+		rules := handlers.CompressionRules{{Prefix: "/", Algorithm: handlers.CompressionZstd}}
+		return &handlers.CompressedStorage{Backend: handlers.NewMemoryStorage(), Rules: rules}, func() {}
+	})
+
+	describeStorage("EncryptedStorage", func() (handlers.Storage, func()) {
+		keys, err := handlers.NewKeyring([]string{"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="})
+		Expect(err).NotTo(HaveOccurred())
+		return &handlers.EncryptedStorage{Backend: handlers.NewMemoryStorage(), Keys: keys}, func() {}
+	})
+
+	describeStorage("ContentAddressedStorage", func() (handlers.Storage, func()) {
+		tempDir, err := ioutil.TempDir("", "staging")
+		Expect(err).NotTo(HaveOccurred())
+		storage := &handlers.ContentAddressedStorage{Backend: handlers.NewMemoryStorage(), StagingDir: tempDir}
+		return storage, func() { os.RemoveAll(tempDir) }
+	})
+
+	Describe("a FileServer backed by MemoryStorage", func() {
+		var handler *handlers.FileServer
+
+		serve := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+			return serveRequest(handler, "", method, target, strings.NewReader(body), headers)
+		}
+
+		BeforeEach(func() {
+			handler = &handlers.FileServer{Storage: handlers.NewMemoryStorage()}
+			log.SetOutput(GinkgoWriter)
+		})
+
+		It("stores and serves blobs", func() {
+			response := serve(http.MethodPut, "/dir/blob.tgz", "blob-data", map[string]string{
+				"Content-MD5": "crA1DQD/v7i7cd8Z4fWSCQ==",
+			})
+			Expect(response.Code).To(Equal(http.StatusCreated))
+
+			response = serve(http.MethodGet, "/dir/blob.tgz", "", nil)
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(Equal("blob-data"))
+			Expect(response.Header().Get("ETag")).To(Equal(`"c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"`))
+			Expect(response.Header().Get("X-Checksum-Md5")).To(Equal("72b0350d00ffbfb8bb71df19e1f59209"))
+
+			response = serve(http.MethodGet, "/dir/blob.tgz", "", map[string]string{"Range": "bytes=5-"})
+			Expect(response.Code).To(Equal(http.StatusPartialContent))
+			Expect(response.Body.String()).To(Equal("data"))
+
+			Expect(serve(http.MethodPut, "/dir/blob.tgz", "new-data", nil).Code).To(Equal(http.StatusConflict))
+
+			Expect(serve(http.MethodDelete, "/dir/blob.tgz", "", nil).Code).To(Equal(http.StatusNoContent))
+			Expect(serve(http.MethodGet, "/dir/blob.tgz", "", nil).Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("follows redirects", func() {
+			upload, err := handler.Storage.Create("/moved.tgz.redirect")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = upload.Write([]byte("http://example.com/elsewhere"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(upload.Commit(false)).To(Succeed())
+			upload.Close()
+			Expect(serve(http.MethodPut, "/moved.tgz.redirect", "http://example.com/other", nil).Code).To(Equal(http.StatusNotFound))
+
+			response := serve(http.MethodGet, "/moved.tgz", "", nil)
+			Expect(response.Code).To(Equal(http.StatusTemporaryRedirect))
+			Expect(response.Header().Get("Location")).To(Equal("http://example.com/elsewhere"))
+		})
+
+		It("lists directories without sidecars", func() {
+			Expect(serve(http.MethodPut, "/dir/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			response := serve(http.MethodGet, "/dir/", "", map[string]string{"Accept": "application/json"})
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(ContainSubstring(`"name":"blob.tgz"`))
+			Expect(response.Body.String()).NotTo(ContainSubstring(".metadata"))
+		})
+
+		It("moves collections in WebDAV mode by copying them", func() {
+			handler.WebDAV = true
+			Expect(serve(handlers.MethodMkcol, "/src", "", nil).Code).To(Equal(http.StatusCreated))
+			Expect(serve(http.MethodPut, "/src/blob.tgz", "blob-data", nil).Code).To(Equal(http.StatusCreated))
+
+			response := serve(handlers.MethodMove, "/src", "", map[string]string{"Destination": "/dst"})
+			Expect(response.Code).To(Equal(http.StatusCreated))
+
+			Expect(serve(http.MethodGet, "/dst/blob.tgz", "", nil).Body.String()).To(Equal("blob-data"))
+			Expect(serve(http.MethodGet, "/src/blob.tgz", "", nil).Code).To(Equal(http.StatusNotFound))
+			Expect(serve(http.MethodGet, "/src/", "", nil).Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Token is a long lived API token. Only the SHA-256 of the token is stored so
+// the token file does not contain usable credentials.
+type Token struct {
+	Name      string     `json:"name"`
+	SHA256    string     `json:"sha256"`
+	Roles     Roles      `json:"roles"`
+	Prefixes  []string   `json:"prefixes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (t *Token) Validate() error {
+	if t.Name == "" {
+		return errors.New("token name is required")
+	}
+	if decoded, err := hex.DecodeString(t.SHA256); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("token %q: sha256 must be a hex encoded SHA-256 digest", t.Name)
+	}
+	if len(t.Roles) == 0 {
+		return fmt.Errorf("token %q: at least one role is required", t.Name)
+	}
+	for _, role := range t.Roles {
+		if _, err := ParseRole(string(role)); err != nil {
+			return fmt.Errorf("token %q: %s", t.Name, err)
+		}
+	}
+	for _, prefix := range t.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("token %q: prefix must be absolute: %q", t.Name, prefix)
+		}
+	}
+	return nil
+}
+
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// Covers reports whether upath is within the prefixes the token is scoped
+// to. A token without prefixes covers every path.
+func (t *Token) Covers(upath string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range t.Prefixes {
+		if hasPathPrefix(upath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens holds API tokens indexed by the hex encoded SHA-256 of the token.
+type Tokens map[string]*Token
+
+func NewTokens(tokens []Token) (Tokens, error) {
+	indexed := Tokens{}
+	for i := range tokens {
+		token := &tokens[i]
+		if err := token.Validate(); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(token.SHA256)
+		if _, ok := indexed[key]; ok {
+			return nil, fmt.Errorf("token %q: duplicate token", token.Name)
+		}
+		indexed[key] = token
+	}
+	return indexed, nil
+}
+
+// LoadTokens reads a JSON token file of the form {"tokens": [...]}.
+func LoadTokens(path string) (Tokens, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tokenFile struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err := json.NewDecoder(file).Decode(&tokenFile); err != nil {
+		return nil, err
+	}
+
+	return NewTokens(tokenFile.Tokens)
+}
+
+// Lookup returns the token matching the presented secret.
+func (tokens Tokens) Lookup(secret string) (*Token, bool) {
+	sum := sha256.Sum256([]byte(secret))
+	token, ok := tokens[hex.EncodeToString(sum[:])]
+	return token, ok
+}
+
+func hasPathPrefix(upath, prefix string) bool {
+	prefix = path.Clean(prefix)
+	return prefix == "/" || upath == prefix || strings.HasPrefix(upath, prefix+"/")
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const UPLOAD_PREFIX = ".upload-"
+
+// receiveUpload streams body into storage and commits it at upath once the
+// body has been completely received and matches the expected digests. The
+// staged content is always discarded on failure so a failed or interrupted
+// upload never leaves a partial blob behind. The metadata of the new blob,
+// which is owned by owner, is recorded in its sidecar.
+//
+// Without a precondition, the upload only creates new blobs. Otherwise an
+// existing blob is replaced if the precondition, which is called with the
+// metadata of the received content while no other conditional write of
+// upath can commit, succeeds. A precondition that returns errBlobUnchanged
+// keeps the existing blob.
+func receiveUpload(storage Storage, upath, owner string, body io.Reader, expected Digests, precondition func(*Metadata) error) (*Metadata, error) {
+	if _, err := storage.Stat(upath); err == nil && precondition == nil {
+		return nil, &os.PathError{Op: "create", Path: upath, Err: os.ErrExist}
+	}
+
+	upload, err := storage.Create(upath)
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Close()
+
+	digester := newDigester()
+	size, err := io.Copy(io.MultiWriter(upload, digester), body)
+	digests := digester.Digests()
+	if err == nil {
+		err = digests.Verify(expected)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := newMetadata(size, digests)
+	metadata.Owner = owner
+	return commitUpload(storage, upath, upload, metadata, precondition)
+}
+
+// commitUpload commits a completely received and verified upload at upath
+// and records its metadata. The precondition is applied as described for
+// receiveUpload.
+func commitUpload(storage Storage, upath string, upload Upload, metadata *Metadata, precondition func(*Metadata) error) (*Metadata, error) {
+	if precondition == nil {
+		if err := upload.Commit(false); err != nil {
+			return nil, err
+		}
+	} else {
+		unlock := lockLocation(upath)
+		defer unlock()
+
+		err := precondition(metadata)
+		if err == errBlobUnchanged {
+			return metadata, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The old metadata is removed first so it is never served with
+		// the new blob.
+		if err := removeMetadata(storage, upath); err != nil {
+			return nil, err
+		}
+		if err := upload.Commit(true); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeMetadata(storage, upath, metadata); err != nil {
+		log.Printf("failed to record metadata for %s: %s", upath, err)
+	}
+	return metadata, nil
+}
+
+// RemoveStaleUploads deletes upload sessions that have expired and the
+// temporary upload files under Root left behind by a server that exited
+// while uploads were in progress. Sessions that may still be resumed are
+// kept. It must not be called while the server is handling requests.
+func (fs *FileServer) RemoveStaleUploads() error {
+	if err := fs.removeExpiredUploadSessions(time.Now()); err != nil {
+		return err
+	}
+
+	root := fs.Root
+	if local, ok := fs.storage().(*LocalStorage); ok {
+		root = local.Root
+	}
+	if root == "" {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path == filepath.Join(root, UPLOAD_SESSIONS_DIR) {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && strings.HasPrefix(info.Name(), UPLOAD_PREFIX) {
+			log.Printf("removing stale upload: %s", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
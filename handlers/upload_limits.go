@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	errBlobTooLarge = errors.New("blob exceeds the maximum upload size")
+	errLowDiskSpace = errors.New("free disk space is below the minimum")
+)
+
+// UploadLimitRule sets the maximum size of blobs uploaded beneath a path
+// prefix. A MaxSize of zero is unlimited.
+type UploadLimitRule struct {
+	Prefix  string `json:"prefix"`
+	MaxSize int64  `json:"max_size"`
+}
+
+func (rule *UploadLimitRule) Validate() error {
+	if !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("upload limit prefix must be absolute: %q", rule.Prefix)
+	}
+	if rule.MaxSize < 0 {
+		return errors.New("maximum upload size cannot be negative")
+	}
+	return nil
+}
+
+// UploadLimitRules are evaluated in order and the first rule whose prefix
+// contains the path decides its maximum upload size.
+type UploadLimitRules []UploadLimitRule
+
+// MaxSize returns the maximum size of a blob uploaded to upath, or fallback
+// when no rule applies.
+func (rules UploadLimitRules) MaxSize(upath string, fallback int64) int64 {
+	for i := range rules {
+		if hasPathPrefix(upath, rules[i].Prefix) {
+			return rules[i].MaxSize
+		}
+	}
+	return fallback
+}
+
+func (fs *FileServer) maxUploadSize(upath string) int64 {
+	return fs.UploadLimits.MaxSize(upath, fs.MaxUploadSize)
+}
+
+// checkUpload fails before an upload of size bytes, or of an unknown size
+// when size is negative, is received when the blob would be larger than the
+// maximum upload size for upath or would leave too little free disk space.
+func (fs *FileServer) checkUpload(upath string, size int64) error {
+	if max := fs.maxUploadSize(upath); max > 0 && size > max {
+		return errBlobTooLarge
+	}
+	return fs.checkFreeSpace(size)
+}
+
+// limitUploadBody stops reading the request body once it exceeds the
+// maximum upload size for upath.
+func (fs *FileServer) limitUploadBody(w http.ResponseWriter, r *http.Request, upath string) {
+	if max := fs.maxUploadSize(upath); max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+}
+
+// checkFreeSpace fails when storing size more bytes would leave less than
+// MinFreeSpace bytes free on the file system of Root. When the free space
+// cannot be determined, uploads are allowed.
+func (fs *FileServer) checkFreeSpace(size int64) error {
+	if fs.MinFreeSpace <= 0 || fs.Root == "" {
+		return nil
+	}
+
+	free, err := freeSpace(fs.Root)
+	if err != nil {
+		log.Printf("failed to determine free disk space: %s", err)
+		return nil
+	}
+	if size < 0 {
+		size = 0
+	}
+	if free-size < fs.MinFreeSpace {
+		return errLowDiskSpace
+	}
+	return nil
+}
+
+// isBodyTooLarge reports whether err was returned by a request body that
+// exceeded its http.MaxBytesReader limit.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
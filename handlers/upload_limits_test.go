@@ -0,0 +1,101 @@
+package handlers_test
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("Upload limits", func() {
+	var (
+		tempDir string
+		handler *handlers.FileServer
+	)
+
+	serve := func(method, target string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		return serveRequest(handler, "", method, target, body, headers)
+	}
+
+	put := func(target, content string) int {
+		return serve(http.MethodPut, target, strings.NewReader(content), nil).Code
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "upload-limits")
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = &handlers.FileServer{Root: tempDir}
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Context("when a maximum upload size is configured", func() {
+		BeforeEach(func() {
+			handler.MaxUploadSize = 8
+			handler.UploadLimits = handlers.UploadLimitRules{
+				{Prefix: "/releases/", MaxSize: 16},
+				{Prefix: "/unlimited/", MaxSize: 0},
+			}
+		})
+
+		It("refuses uploads whose Content-Length exceeds the limit with 413 Payload Too Large", func() {
+			Expect(put("/blob.tgz", "012345678")).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(put("/blob.tgz", "01234567")).To(Equal(http.StatusCreated))
+		})
+
+		It("stops uploads of unknown length once they exceed the limit", func() {
+			body := io.MultiReader(strings.NewReader("01234"), strings.NewReader("56789"))
+			Expect(serve(http.MethodPut, "/blob.tgz", body, nil).Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(filepath.Join(tempDir, "blob.tgz")).NotTo(BeAnExistingFile())
+		})
+
+		It("applies the limit of the first matching prefix", func() {
+			Expect(put("/releases/blob.tgz", "0123456789abcdef")).To(Equal(http.StatusCreated))
+			Expect(put("/releases/big.tgz", "0123456789abcdefg")).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(put("/unlimited/blob.tgz", strings.Repeat("x", 1024))).To(Equal(http.StatusCreated))
+		})
+
+		It("refuses resumable uploads whose length exceeds the limit", func() {
+			response := serve(http.MethodPost, "/blob.tgz", nil, map[string]string{"Upload-Length": "9"})
+			Expect(response.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+	})
+
+	Context("when a minimum amount of free space is configured", func() {
+		It("accepts uploads while enough space remains", func() {
+			handler.MinFreeSpace = 1
+			Expect(put("/blob.tgz", "blob-data")).To(Equal(http.StatusCreated))
+		})
+
+		It("refuses uploads with 507 Insufficient Storage once space runs low", func() {
+			handler.MinFreeSpace = 1 << 62
+			Expect(put("/blob.tgz", "blob-data")).To(Equal(http.StatusInsufficientStorage))
+			Expect(filepath.Join(tempDir, "blob.tgz")).NotTo(BeAnExistingFile())
+
+			response := serve(http.MethodPost, "/blob.tgz", nil, map[string]string{"Upload-Length": "9"})
+			Expect(response.Code).To(Equal(http.StatusInsufficientStorage))
+		})
+	})
+
+	Describe("UploadLimitRule", func() {
+		It("requires an absolute prefix and a size that is not negative", func() {
+			Expect((&handlers.UploadLimitRule{Prefix: "/", MaxSize: 1}).Validate()).To(Succeed())
+			Expect((&handlers.UploadLimitRule{Prefix: "releases/", MaxSize: 1}).Validate()).To(MatchError(ContainSubstring("absolute")))
+			Expect((&handlers.UploadLimitRule{Prefix: "/", MaxSize: -1}).Validate()).To(MatchError("maximum upload size cannot be negative"))
+		})
+	})
+})
@@ -0,0 +1,1146 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAV methods defined by RFC 4918.
+const (
+	MethodOptions   = "OPTIONS"
+	MethodPropfind  = "PROPFIND"
+	MethodProppatch = "PROPPATCH"
+	MethodMkcol     = "MKCOL"
+	MethodCopy      = "COPY"
+	MethodMove      = "MOVE"
+	MethodLock      = "LOCK"
+	MethodUnlock    = "UNLOCK"
+)
+
+const davAllow = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE"
+
+var (
+	errBadGateway          = errors.New("destination is on another server")
+	errReservedDestination = errors.New("destination is reserved by the server")
+)
+
+// isWebDAVMethod reports whether the method is only served in WebDAV mode.
+func isWebDAVMethod(method string) bool {
+	switch method {
+	case MethodOptions, MethodPropfind, MethodProppatch, MethodMkcol, MethodCopy, MethodMove,
+		MethodLock, MethodUnlock:
+		return true
+	default:
+		return false
+	}
+}
+
+// isHidden reports whether name is a sidecar or temporary file that is an
+// implementation detail of the store rather than a resource.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, UPLOAD_PREFIX) ||
+		strings.HasSuffix(name, METADATA_SUFFIX) ||
+		strings.HasSuffix(name, REDIRECT_SUFFIX) ||
+		strings.HasSuffix(name, COMPRESSION_SUFFIX) ||
+		strings.HasSuffix(name, POINTER_SUFFIX)
+}
+
+// destinationPath returns the cleaned path of the Destination header of a
+// COPY or MOVE request.
+func destinationPath(r *http.Request) (string, error) {
+	destination := r.Header.Get("Destination")
+	if destination == "" {
+		return "", errors.New("missing Destination header")
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", errBadGateway
+	}
+
+	upath := cleanPath(u.Path)
+	if strings.Contains(upath, "..") || strings.Contains(upath, "\x00") {
+		return "", fmt.Errorf("invalid destination: %q", destination)
+	}
+	if isReservedPath(upath) {
+		return "", errReservedDestination
+	}
+	return upath, nil
+}
+
+func (fs *FileServer) serveWebDAV(w http.ResponseWriter, r *http.Request, upath string) {
+	switch r.Method {
+	case MethodOptions:
+		if fs.Locks != nil {
+			w.Header().Set("DAV", "1, 2")
+			w.Header().Set("Allow", davAllow+", LOCK, UNLOCK")
+		} else {
+			w.Header().Set("DAV", "1")
+			w.Header().Set("Allow", davAllow)
+		}
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.WriteHeader(http.StatusOK)
+
+	case MethodPropfind:
+		fs.propfind(w, r, upath)
+
+	case MethodProppatch:
+		fs.proppatch(w, r, upath)
+
+	case MethodMkcol:
+		fs.mkcol(w, r, upath)
+
+	case MethodCopy, MethodMove:
+		fs.copyMove(w, r, upath)
+
+	case MethodLock, MethodUnlock:
+		if fs.Locks == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method == MethodLock {
+			fs.lock(w, r, upath)
+		} else {
+			fs.unlock(w, r, upath)
+		}
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// propNames collects the names of the child elements of a DAV:prop element.
+type propNames []xml.Name
+
+func (pn *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			*pn = append(*pn, token.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     propNames `xml:"DAV: prop"`
+}
+
+type proppatchRequest struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+	Remove []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: remove"`
+}
+
+// readXMLBody decodes an optional XML request body. It reports false when
+// the request has no body.
+func readXMLBody(r *http.Request, v interface{}) (bool, error) {
+	if r.Body == nil {
+		return false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return false, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false, nil
+	}
+	return true, xml.Unmarshal(body, v)
+}
+
+// davProperty renders one live property of a resource.
+type davProperty func(info os.FileInfo, metadata *Metadata) (string, bool)
+
+var davProperties = map[string]davProperty{
+	"resourcetype": func(info os.FileInfo, _ *Metadata) (string, bool) {
+		if info.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	},
+	"displayname": func(info os.FileInfo, _ *Metadata) (string, bool) {
+		return escapeXML(info.Name()), true
+	},
+	"getcontentlength": func(info os.FileInfo, _ *Metadata) (string, bool) {
+		if info.IsDir() {
+			return "", false
+		}
+		return fmt.Sprintf("%d", info.Size()), true
+	},
+	"getlastmodified": func(info os.FileInfo, _ *Metadata) (string, bool) {
+		return info.ModTime().UTC().Format(http.TimeFormat), true
+	},
+	"getcontenttype": func(info os.FileInfo, _ *Metadata) (string, bool) {
+		if info.IsDir() {
+			return "", false
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(info.Name()))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return escapeXML(contentType), true
+	},
+	"getetag": func(info os.FileInfo, metadata *Metadata) (string, bool) {
+		if metadata == nil {
+			return "", false
+		}
+		return escapeXML(metadata.ETag()), true
+	},
+}
+
+// davPropertyOrder is the order live properties are reported in.
+var davPropertyOrder = []string{
+	"resourcetype", "displayname", "getcontentlength", "getlastmodified", "getcontenttype", "getetag",
+}
+
+func (fs *FileServer) propfind(w http.ResponseWriter, r *http.Request, upath string) {
+	depth := r.Header.Get("Depth")
+	switch depth {
+	case "0", "1":
+	case "", "infinity":
+		writeDAVError(w, http.StatusForbidden, "<D:propfind-finite-depth/>")
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	request := propfindRequest{}
+	hasBody, err := readXMLBody(r, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !hasBody {
+		request.AllProp = &struct{}{}
+	}
+
+	storage := fs.storage()
+	info, err := storage.Stat(upath)
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	var ms multistatus
+	fs.propfindResponse(&ms, &request, upath, info)
+
+	if depth == "1" && info.IsDir() {
+		entries, err := storage.List(upath)
+		if err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+		for _, entry := range entries {
+			if isHidden(entry.Name()) {
+				continue
+			}
+			fs.propfindResponse(&ms, &request, path.Join(upath, entry.Name()), entry)
+		}
+	}
+
+	ms.send(w)
+}
+
+func (fs *FileServer) propfindResponse(ms *multistatus, request *propfindRequest, upath string, info os.FileInfo) {
+	var metadata *Metadata
+	if !info.IsDir() {
+		metadata, _ = readMetadata(fs.storage(), upath, info)
+	}
+
+	href := hrefFor(upath, info.IsDir())
+	found := &bytes.Buffer{}
+	missing := &bytes.Buffer{}
+
+	lockProperties := fs.lockProperties(upath)
+
+	switch {
+	case request.PropName != nil:
+		for _, name := range davPropertyOrder {
+			if _, ok := davProperties[name](info, metadata); ok {
+				fmt.Fprintf(found, "<D:%s/>", name)
+			}
+		}
+		for _, name := range lockPropertyOrder {
+			if _, ok := lockProperties[name]; ok {
+				fmt.Fprintf(found, "<D:%s/>", name)
+			}
+		}
+
+	case request.AllProp != nil:
+		for _, name := range davPropertyOrder {
+			if value, ok := davProperties[name](info, metadata); ok {
+				writeProperty(found, name, value)
+			}
+		}
+		for _, name := range lockPropertyOrder {
+			if value, ok := lockProperties[name]; ok {
+				writeProperty(found, name, value)
+			}
+		}
+
+	default:
+		for _, name := range request.Prop {
+			if name.Space == "DAV:" {
+				if property, ok := davProperties[name.Local]; ok {
+					if value, ok := property(info, metadata); ok {
+						writeProperty(found, name.Local, value)
+						continue
+					}
+				}
+				if value, ok := lockProperties[name.Local]; ok {
+					writeProperty(found, name.Local, value)
+					continue
+				}
+			}
+			writeEmptyProperty(missing, name)
+		}
+	}
+
+	ms.addPropstat(href, found.String(), missing.String())
+}
+
+func (fs *FileServer) proppatch(w http.ResponseWriter, r *http.Request, upath string) {
+	info, err := fs.storage().Stat(upath)
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	request := proppatchRequest{}
+	if _, err := readXMLBody(r, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Properties are not stored so every update is refused.
+	forbidden := &bytes.Buffer{}
+	for _, set := range request.Set {
+		for _, name := range set.Prop {
+			writeEmptyProperty(forbidden, name)
+		}
+	}
+	for _, remove := range request.Remove {
+		for _, name := range remove.Prop {
+			writeEmptyProperty(forbidden, name)
+		}
+	}
+
+	var ms multistatus
+	ms.addResponse(hrefFor(upath, info.IsDir()), fmt.Sprintf(
+		"<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 403 Forbidden</D:status></D:propstat>",
+		forbidden.String(),
+	))
+	ms.send(w)
+}
+
+func (fs *FileServer) mkcol(w http.ResponseWriter, r *http.Request, upath string) {
+	if r.ContentLength > 0 || len(r.TransferEncoding) > 0 {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	storage := fs.storage()
+	if _, err := storage.Stat(upath); err == nil {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if info, err := storage.Stat(path.Dir(upath)); err != nil || !info.IsDir() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// Storage without directories of their own cannot hold an empty
+	// collection.
+	maker, ok := storage.(directoryMaker)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := maker.Mkdir(upath); err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (fs *FileServer) copyMove(w http.ResponseWriter, r *http.Request, upath string) {
+	destination, err := destinationPath(r)
+	if err == errBadGateway {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if err == errReservedDestination {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	overwrite := true
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	storage := fs.storage()
+	info, err := storage.Stat(upath)
+	if err != nil {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	depth := r.Header.Get("Depth")
+	switch {
+	case depth == "" || depth == "infinity":
+	case depth == "0" && r.Method == MethodCopy:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if destination == upath || strings.HasPrefix(destination, upath+"/") || upath == "/" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if parent, err := storage.Stat(path.Dir(destination)); err != nil || !parent.IsDir() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// The blobs stored at the destination are subject to the same limits
+	// and quotas as uploads. They are checked before anything is changed.
+	t := &transfer{fs: fs, owner: requestUser(r)}
+	defer t.release()
+	_, renames := storage.(renamer)
+	if !info.IsDir() || depth != "0" {
+		err := walkBlobs(storage, upath, info, func(source string, blob os.FileInfo) error {
+			target := path.Join(destination, strings.TrimPrefix(source, upath))
+			if r.Method == MethodMove && renames {
+				return t.renaming(storage, source, target, blob)
+			}
+			return t.copying(target, blob.Size())
+		})
+		if err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	status := http.StatusCreated
+	if _, err := storage.Stat(destination); err == nil {
+		if !overwrite {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err := removeResource(storage, destination); err != nil {
+			fs.usageTracker().refresh(storage, destination)
+			sendErrorResponse(w, r, err)
+			return
+		}
+		status = http.StatusNoContent
+	}
+
+	if r.Method == MethodMove {
+		err = moveResource(storage, upath, destination, info, requestUser(r))
+		if err == nil && fs.Locks != nil {
+			fs.Locks.Remove(upath, true)
+		}
+		fs.usageTracker().refresh(storage, upath)
+	} else {
+		err = copyResource(storage, upath, destination, info, depth != "0", requestUser(r))
+	}
+	fs.usageTracker().refresh(storage, destination)
+	if err != nil {
+		log.Printf("%s to %s failed: %s", r.Method, destination, err)
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// transfer subjects the blobs stored by a COPY or MOVE to the upload limits
+// and quotas of their destination, holding room for them until they have
+// been counted.
+type transfer struct {
+	fs       *FileServer
+	owner    string
+	releases []func()
+}
+
+// copying fails when an upload of size bytes to destination would be
+// refused.
+func (t *transfer) copying(destination string, size int64) error {
+	if err := t.fs.checkUpload(destination, size); err != nil {
+		return err
+	}
+	return t.reserve(t.fs.Quotas.Applicable(destination, t.owner), destination, t.owner, size)
+}
+
+// renaming fails when the blob at source is larger than the uploads
+// destination allows or the quotas that apply to destination but not to
+// source leave no room for it. Renaming a blob keeps its owner and uses no
+// more disk space.
+func (t *transfer) renaming(storage Storage, source, destination string, info os.FileInfo) error {
+	if max := t.fs.maxUploadSize(destination); max > 0 && info.Size() > max {
+		return errBlobTooLarge
+	}
+
+	owner := blobOwner(storage, source, info)
+	var rules QuotaRules
+	for _, rule := range t.fs.Quotas.Applicable(destination, owner) {
+		if !rule.appliesTo(source, owner) {
+			rules = append(rules, rule)
+		}
+	}
+	return t.reserve(rules, destination, owner, info.Size())
+}
+
+func (t *transfer) reserve(rules QuotaRules, upath, owner string, size int64) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	reserved, err := t.fs.usageTracker().reserve(t.fs.storage(), rules, upath, owner, size)
+	if err != nil {
+		return err
+	}
+	t.releases = append(t.releases, reserved.release)
+	return nil
+}
+
+func (t *transfer) release() {
+	for _, release := range t.releases {
+		release()
+	}
+}
+
+// walkBlobs calls fn for the blob at upath or for each blob beneath it.
+func walkBlobs(storage Storage, upath string, info os.FileInfo, fn func(string, os.FileInfo) error) error {
+	if !info.IsDir() {
+		return fn(upath, info)
+	}
+
+	entries, err := storage.List(upath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if isHidden(entry.Name()) {
+			continue
+		}
+		if err := walkBlobs(storage, path.Join(upath, entry.Name()), entry, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeResource deletes a blob along with its metadata and redirect or a
+// collection and all of its members.
+func removeResource(storage Storage, upath string) error {
+	info, err := storage.Stat(upath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := storage.Delete(upath); err != nil {
+			return err
+		}
+		if err := removeMetadata(storage, upath); err != nil {
+			return err
+		}
+		err := storage.Delete(upath + REDIRECT_SUFFIX)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if remover, ok := storage.(allRemover); ok {
+		return remover.RemoveAll(upath)
+	}
+	return removeAll(storage, upath)
+}
+
+func removeAll(storage Storage, upath string) error {
+	entries, err := storage.List(upath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		member := path.Join(upath, entry.Name())
+		if entry.IsDir() {
+			err = removeAll(storage, member)
+		} else {
+			err = storage.Delete(member)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Storage whose directories are only the prefixes of their members,
+	// such as S3Storage, drops a directory along with its last member.
+	err = storage.Delete(upath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// moveResource renames a resource when the storage supports it and
+// otherwise copies it before removing the source.
+func moveResource(storage Storage, source, destination string, info os.FileInfo, owner string) error {
+	mover, ok := storage.(renamer)
+	if !ok {
+		if err := copyResource(storage, source, destination, info, true, owner); err != nil {
+			return err
+		}
+		return removeResource(storage, source)
+	}
+
+	if err := mover.Rename(source, destination); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	for _, suffix := range []string{METADATA_SUFFIX, REDIRECT_SUFFIX} {
+		err := mover.Rename(source+suffix, destination+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyResource copies a blob along with its redirect or a collection and,
+// when recursive is set, all of its members.
+func copyResource(storage Storage, source, destination string, info os.FileInfo, recursive bool, owner string) error {
+	if !info.IsDir() {
+		if err := copyBlob(storage, source, destination, owner); err != nil {
+			return err
+		}
+		return copyRedirect(storage, source, destination)
+	}
+
+	if maker, ok := storage.(directoryMaker); ok {
+		if err := maker.Mkdir(destination); err != nil {
+			return err
+		}
+	}
+	if !recursive {
+		return nil
+	}
+
+	entries, err := storage.List(source)
+	if err != nil {
+		return err
+	}
+	blobs := map[string]bool{}
+	for _, entry := range entries {
+		blobs[entry.Name()] = !entry.IsDir()
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		blob := strings.TrimSuffix(name, REDIRECT_SUFFIX)
+		switch {
+		case blob != name && !blobs[blob]:
+			// A redirect without a blob is copied on its own.
+			err = copyRedirect(storage, path.Join(source, blob), path.Join(destination, blob))
+		case isHidden(name):
+			continue
+		default:
+			err = copyResource(storage, path.Join(source, name), path.Join(destination, name), entry, true, owner)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRedirect copies the redirect of the blob at source, if there is one,
+// to destination.
+func copyRedirect(storage Storage, source, destination string) error {
+	redirect, err := readBlob(storage, source+REDIRECT_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	upload, err := storage.Create(destination + REDIRECT_SUFFIX)
+	if err != nil {
+		return err
+	}
+	defer upload.Close()
+
+	if _, err := upload.Write(redirect); err != nil {
+		return err
+	}
+	return upload.Commit(true)
+}
+
+func copyBlob(storage Storage, source, destination, owner string) error {
+	input, err := storage.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	_, err = receiveUpload(storage, destination, owner, input, nil, nil)
+	return err
+}
+
+func hrefFor(upath string, collection bool) string {
+	href := (&url.URL{Path: upath}).EscapedPath()
+	if collection && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func escapeXML(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+func writeProperty(buf *bytes.Buffer, name, value string) {
+	if value == "" {
+		fmt.Fprintf(buf, "<D:%s/>", name)
+		return
+	}
+	fmt.Fprintf(buf, "<D:%s>%s</D:%s>", name, value, name)
+}
+
+func writeEmptyProperty(buf *bytes.Buffer, name xml.Name) {
+	if name.Space == "DAV:" {
+		fmt.Fprintf(buf, "<D:%s/>", name.Local)
+		return
+	}
+	fmt.Fprintf(buf, `<x:%s xmlns:x="%s"/>`, name.Local, escapeXML(name.Space))
+}
+
+func writeDAVError(w http.ResponseWriter, status int, condition string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:error xmlns:D="DAV:">%s</D:error>`, condition)
+}
+
+// multistatus accumulates the responses of a 207 Multi-Status body.
+type multistatus struct {
+	responses bytes.Buffer
+}
+
+func (ms *multistatus) addResponse(href, body string) {
+	fmt.Fprintf(&ms.responses, "<D:response><D:href>%s</D:href>%s</D:response>", escapeXML(href), body)
+}
+
+func (ms *multistatus) addPropstat(href, found, missing string) {
+	body := ""
+	if found != "" {
+		body += fmt.Sprintf("<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", found)
+	}
+	if missing != "" {
+		body += fmt.Sprintf("<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>", missing)
+	}
+	ms.addResponse(href, body)
+}
+
+func (ms *multistatus) send(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:multistatus xmlns:D="DAV:">%s</D:multistatus>`, ms.responses.String())
+}
+
+type lockInfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	LockScope struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	LockType struct {
+		Write *struct{} `xml:"DAV: write"`
+	} `xml:"DAV: locktype"`
+	Owner struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+const supportedLocks = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+	"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"
+
+// lockPropertyOrder is the order lock properties are reported in.
+var lockPropertyOrder = []string{"supportedlock", "lockdiscovery"}
+
+// lockProperties returns the lock properties of upath when locking is
+// enabled.
+func (fs *FileServer) lockProperties(upath string) map[string]string {
+	if fs.Locks == nil {
+		return nil
+	}
+
+	discovery := &bytes.Buffer{}
+	for _, lock := range fs.Locks.Discover(upath, time.Now()) {
+		writeActiveLock(discovery, &lock)
+	}
+	return map[string]string{
+		"supportedlock": supportedLocks,
+		"lockdiscovery": discovery.String(),
+	}
+}
+
+func (fs *FileServer) lock(w http.ResponseWriter, r *http.Request, upath string) {
+	timeout, err := parseLockTimeout(r.Header.Get("Timeout"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	info := lockInfo{}
+	hasBody, err := readXMLBody(r, &info)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+
+	// A LOCK without a body refreshes the lock named in the If header.
+	if !hasBody {
+		lists, err := parseIfHeader(r.Header.Get("If"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tokens := submittedTokens(lists)
+		if len(tokens) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock, err := fs.Locks.Refresh(tokens[0], upath, timeout, now)
+		if err != nil {
+			writeDAVError(w, http.StatusPreconditionFailed, "<D:lock-token-matches-request-uri/>")
+			return
+		}
+		writeLockDiscovery(w, http.StatusOK, lock)
+		return
+	}
+
+	scope := info.LockScope
+	if info.LockType.Write == nil || (scope.Exclusive == nil) == (scope.Shared == nil) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	infinite := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		infinite = false
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Locking an unmapped path creates an empty blob.
+	storage := fs.storage()
+	create := false
+	if stat, err := storage.Stat(upath); err == nil {
+		infinite = infinite && stat.IsDir()
+	} else if os.IsNotExist(err) {
+		if parent, err := storage.Stat(path.Dir(upath)); err != nil || !parent.IsDir() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		create, infinite = true, false
+	} else {
+		sendErrorResponse(w, r, err)
+		return
+	}
+
+	if create {
+		if err := fs.checkUpload(upath, 0); err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+		_, release, err := fs.reserveQuota(upath, requestUser(r), 0)
+		defer release()
+		if err != nil {
+			sendErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	lock, err := fs.Locks.Create(Lock{
+		Path:     upath,
+		Shared:   scope.Shared != nil,
+		Infinite: infinite,
+		Owner:    strings.TrimSpace(info.Owner.InnerXML),
+		Timeout:  timeout,
+	}, now)
+	if err == errLockConflict {
+		writeDAVError(w, http.StatusLocked, fmt.Sprintf(
+			"<D:no-conflicting-lock><D:href>%s</D:href></D:no-conflicting-lock>",
+			escapeXML(hrefFor(lock.Path, false)),
+		))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to lock %s: %s", upath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if create {
+		_, err = receiveUpload(storage, upath, requestUser(r), strings.NewReader(""), nil, nil)
+		fs.usageTracker().refresh(storage, upath)
+		if err != nil {
+			fs.Locks.Unlock(lock.Token, upath, now)
+			sendErrorResponse(w, r, err)
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Lock-Token", "<"+lock.Token+">")
+	writeLockDiscovery(w, status, lock)
+}
+
+func (fs *FileServer) unlock(w http.ResponseWriter, r *http.Request, upath string) {
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := fs.Locks.Unlock(token[1:len(token)-1], upath, time.Now()); err != nil {
+		writeDAVError(w, http.StatusConflict, "<D:lock-token-matches-request-uri/>")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockTarget is a path modified by a request. Recursive targets also modify
+// everything beneath the path.
+type lockTarget struct {
+	upath     string
+	recursive bool
+}
+
+// lockTargets returns the paths a request modifies. Creating or removing a
+// resource also modifies the membership of its parent collection.
+func (fs *FileServer) lockTargets(r *http.Request, upath string) []lockTarget {
+	var targets []lockTarget
+	modify := func(upath string, recursive, membership bool) {
+		targets = append(targets, lockTarget{upath, recursive})
+		if membership && upath != "/" {
+			targets = append(targets, lockTarget{path.Dir(upath), false})
+		}
+	}
+	exists := func(upath string) bool {
+		_, err := fs.storage().Stat(upath)
+		return err == nil
+	}
+
+	if isUploadSessionRequest(r) {
+		// Upload sessions only modify the blob once they are complete.
+		if r.Method != http.MethodHead {
+			modify(upath, false, !exists(upath))
+		}
+		return targets
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		modify(upath, false, !exists(upath))
+	case http.MethodDelete:
+		modify(upath, true, true)
+	case MethodMkcol:
+		modify(upath, false, true)
+	case MethodProppatch:
+		modify(upath, false, false)
+	case MethodCopy, MethodMove:
+		if r.Method == MethodMove {
+			modify(upath, true, true)
+		}
+		if destination, err := destinationPath(r); err == nil {
+			modify(destination, true, true)
+		}
+	case MethodLock:
+		if !exists(upath) && upath != "/" {
+			targets = append(targets, lockTarget{path.Dir(upath), false})
+		}
+	}
+	return targets
+}
+
+// checkLocks evaluates the If header of a request and ensures the tokens of
+// the locks on every path it modifies were submitted. It responds to the
+// request and returns false when the request must not proceed.
+func (fs *FileServer) checkLocks(w http.ResponseWriter, r *http.Request, upath string) bool {
+	now := time.Now()
+
+	var tokens []string
+	if header := r.Header.Get("If"); header != "" {
+		lists, err := parseIfHeader(header)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		if !fs.evaluateIf(lists, upath, now) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return false
+		}
+		tokens = submittedTokens(lists)
+	}
+
+	for _, target := range fs.lockTargets(r, upath) {
+		if lock, locked := fs.Locks.Conflict(target.upath, target.recursive, tokens, now); locked {
+			writeDAVError(w, http.StatusLocked, fmt.Sprintf(
+				"<D:lock-token-submitted><D:href>%s</D:href></D:lock-token-submitted>",
+				escapeXML(hrefFor(lock.Path, false)),
+			))
+			return false
+		}
+	}
+	return true
+}
+
+// evaluateIf reports whether any list of the If header is true.
+func (fs *FileServer) evaluateIf(lists []ifList, upath string, now time.Time) bool {
+	for _, list := range lists {
+		resource := upath
+		if list.resource != "" {
+			u, err := url.Parse(list.resource)
+			if err != nil {
+				continue
+			}
+			resource = cleanPath(u.Path)
+		}
+
+		matched := true
+		for _, condition := range list.conditions {
+			var result bool
+			if condition.token != "" {
+				result = fs.Locks.Holds(condition.token, resource, now)
+			} else {
+				result = condition.etag == fs.currentETag(resource)
+			}
+			if result == condition.not {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FileServer) currentETag(upath string) string {
+	storage := fs.storage()
+	info, err := storage.Stat(upath)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	metadata, err := blobMetadata(storage, upath, info)
+	if err != nil {
+		return ""
+	}
+	return metadata.ETag()
+}
+
+// parseLockTimeout parses the Timeout header of a LOCK request. The first
+// supported timeout is used and zero is returned when none is requested.
+func parseLockTimeout(header string) (time.Duration, error) {
+	if header == "" {
+		return 0, nil
+	}
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "Infinite" {
+			return MaxLockTimeout, nil
+		}
+		if strings.HasPrefix(value, "Second-") {
+			seconds, err := strconv.ParseUint(value[len("Second-"):], 10, 32)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(seconds) * time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported timeout: %q", header)
+}
+
+func writeActiveLock(buf *bytes.Buffer, lock *Lock) {
+	scope, depth := "exclusive", "0"
+	if lock.Shared {
+		scope = "shared"
+	}
+	if lock.Infinite {
+		depth = "infinity"
+	}
+
+	fmt.Fprintf(buf, "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:%s/></D:lockscope><D:depth>%s</D:depth>", scope, depth)
+	if lock.Owner != "" {
+		fmt.Fprintf(buf, "<D:owner>%s</D:owner>", lock.Owner)
+	}
+	fmt.Fprintf(buf, "<D:timeout>Second-%d</D:timeout>", int64(lock.Timeout/time.Second))
+	fmt.Fprintf(buf, "<D:locktoken><D:href>%s</D:href></D:locktoken>", escapeXML(lock.Token))
+	fmt.Fprintf(buf, "<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>", escapeXML(hrefFor(lock.Path, false)))
+}
+
+func writeLockDiscovery(w http.ResponseWriter, status int, lock *Lock) {
+	discovery := &bytes.Buffer{}
+	writeActiveLock(discovery, lock)
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>`, discovery.String())
+}
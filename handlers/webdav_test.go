@@ -0,0 +1,541 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+var _ = Describe("FileServer in WebDAV mode", func() {
+	var (
+		handler  *handlers.FileServer
+		response *httptest.ResponseRecorder
+
+		tempDir string
+	)
+
+	newRequest := func(method, target, body string) *http.Request {
+		var req *http.Request
+		var err error
+		if body == "" {
+			req, err = http.NewRequest(method, "http://example.com"+target, nil)
+		} else {
+			req, err = http.NewRequest(method, "http://example.com"+target, strings.NewReader(body))
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return req
+	}
+
+	put := func(target, body string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, newRequest(http.MethodPut, target, body))
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "webdav")
+		Expect(err).NotTo(HaveOccurred())
+
+		response = httptest.NewRecorder()
+		handler = &handlers.FileServer{
+			Root:   tempDir,
+			WebDAV: true,
+		}
+
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Describe("OPTIONS", func() {
+		It("advertises class 1 compliance", func() {
+			handler.ServeHTTP(response, newRequest("OPTIONS", "/", ""))
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Header().Get("DAV")).To(Equal("1"))
+			Expect(response.Header().Get("Allow")).To(ContainSubstring("PROPFIND"))
+		})
+	})
+
+	Describe("PROPFIND", func() {
+		BeforeEach(func() {
+			put("/dir/file.txt", "blob-data")
+			err := ioutil.WriteFile(filepath.Join(tempDir, "dir", "other.txt.redirect"), []byte("http://example.com"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("describes the members of a collection at depth 1", func() {
+			req := newRequest("PROPFIND", "/dir", "")
+			req.Header.Set("Depth", "1")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusMultiStatus))
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("<D:href>/dir/</D:href>"))
+			Expect(body).To(ContainSubstring("<D:collection/>"))
+			Expect(body).To(ContainSubstring("<D:href>/dir/file.txt</D:href>"))
+			Expect(body).To(ContainSubstring("<D:getcontentlength>9</D:getcontentlength>"))
+			Expect(body).To(ContainSubstring(`<D:getetag>&#34;`))
+			Expect(body).NotTo(ContainSubstring(".metadata"))
+			Expect(body).NotTo(ContainSubstring(".redirect"))
+		})
+
+		It("only describes the resource at depth 0", func() {
+			req := newRequest("PROPFIND", "/dir", "")
+			req.Header.Set("Depth", "0")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusMultiStatus))
+			Expect(response.Body.String()).NotTo(ContainSubstring("file.txt"))
+		})
+
+		It("reports requested properties that do not exist as not found", func() {
+			req := newRequest("PROPFIND", "/dir/file.txt", `<?xml version="1.0"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/><quota-used-bytes/></prop></propfind>`)
+			req.Header.Set("Depth", "0")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusMultiStatus))
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("<D:prop><D:getcontentlength>9</D:getcontentlength></D:prop><D:status>HTTP/1.1 200 OK</D:status>"))
+			Expect(body).To(ContainSubstring("<D:prop><D:quota-used-bytes/></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>"))
+			Expect(body).NotTo(ContainSubstring("getlastmodified"))
+		})
+
+		It("refuses infinite depth", func() {
+			handler.ServeHTTP(response, newRequest("PROPFIND", "/dir", ""))
+
+			Expect(response.Code).To(Equal(http.StatusForbidden))
+			Expect(response.Body.String()).To(ContainSubstring("propfind-finite-depth"))
+		})
+
+		It("fails with 404 when the resource does not exist", func() {
+			req := newRequest("PROPFIND", "/missing", "")
+			req.Header.Set("Depth", "0")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("MKCOL", func() {
+		It("creates a collection", func() {
+			handler.ServeHTTP(response, newRequest("MKCOL", "/dir", ""))
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(filepath.Join(tempDir, "dir")).To(BeADirectory())
+		})
+
+		It("fails with 405 when the resource exists", func() {
+			put("/file.txt", "blob-data")
+
+			handler.ServeHTTP(response, newRequest("MKCOL", "/file.txt", ""))
+
+			Expect(response.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+
+		It("fails with 409 when the parent does not exist", func() {
+			handler.ServeHTTP(response, newRequest("MKCOL", "/missing/dir", ""))
+
+			Expect(response.Code).To(Equal(http.StatusConflict))
+		})
+
+		It("fails with 415 when a body is provided", func() {
+			handler.ServeHTTP(response, newRequest("MKCOL", "/dir", "<mkcol/>"))
+
+			Expect(response.Code).To(Equal(http.StatusUnsupportedMediaType))
+		})
+	})
+
+	Describe("COPY", func() {
+		BeforeEach(func() {
+			put("/dir/file.txt", "blob-data")
+		})
+
+		It("copies a blob and its metadata", func() {
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "http://example.com/copy.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "copy.txt"))).To(BeEquivalentTo("blob-data"))
+			Expect(filepath.Join(tempDir, "copy.txt.metadata")).To(BeARegularFile())
+			Expect(filepath.Join(tempDir, "dir", "file.txt")).To(BeARegularFile())
+		})
+
+		It("copies a collection recursively", func() {
+			req := newRequest("COPY", "/dir", "")
+			req.Header.Set("Destination", "/copy")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "copy", "file.txt"))).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("overwrites an existing destination", func() {
+			put("/copy.txt", "old-data")
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/copy.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusNoContent))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "copy.txt"))).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("fails with 412 when the destination exists and overwrite is disabled", func() {
+			put("/copy.txt", "old-data")
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/copy.txt")
+			req.Header.Set("Overwrite", "F")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusPreconditionFailed))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "copy.txt"))).To(BeEquivalentTo("old-data"))
+		})
+
+		It("fails with 409 when the destination parent does not exist", func() {
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/missing/copy.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusConflict))
+		})
+
+		It("fails with 400 without a destination", func() {
+			handler.ServeHTTP(response, newRequest("COPY", "/dir/file.txt", ""))
+
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("fails with 403 when the destination is a sidecar", func() {
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/dir/other.txt.metadata")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusForbidden))
+			Expect(filepath.Join(tempDir, "dir", "other.txt.metadata")).NotTo(BeAnExistingFile())
+		})
+
+		It("fails with 413 when the blob is larger than uploads to the destination", func() {
+			handler.UploadLimits = handlers.UploadLimitRules{{Prefix: "/small/", MaxSize: 4}}
+			Expect(os.Mkdir(filepath.Join(tempDir, "small"), 0755)).To(Succeed())
+			req := newRequest("COPY", "/dir", "")
+			req.Header.Set("Destination", "/small/dir")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(filepath.Join(tempDir, "small", "dir")).NotTo(BeAnExistingFile())
+		})
+
+		It("fails with 507 when the copy would exceed a quota", func() {
+			handler.Quotas = handlers.QuotaRules{{Prefix: "/dir/", MaxBytes: 16}}
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/dir/copy.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusInsufficientStorage))
+			Expect(filepath.Join(tempDir, "dir", "copy.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("fails with 502 when the destination is on another server", func() {
+			req := newRequest("COPY", "/dir/file.txt", "")
+			req.Header.Set("Destination", "http://elsewhere.example.com/copy.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	Describe("MOVE", func() {
+		BeforeEach(func() {
+			put("/dir/file.txt", "blob-data")
+		})
+
+		It("moves a blob and its metadata", func() {
+			req := newRequest("MOVE", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/moved.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "moved.txt"))).To(BeEquivalentTo("blob-data"))
+			Expect(filepath.Join(tempDir, "moved.txt.metadata")).To(BeARegularFile())
+			Expect(filepath.Join(tempDir, "dir", "file.txt")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(tempDir, "dir", "file.txt.metadata")).NotTo(BeAnExistingFile())
+		})
+
+		It("moves the redirect of a blob", func() {
+			redirect := filepath.Join(tempDir, "dir", "file.txt.redirect")
+			Expect(ioutil.WriteFile(redirect, []byte("http://example.com/elsewhere"), 0644)).To(Succeed())
+			req := newRequest("MOVE", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/moved.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "moved.txt.redirect"))).To(BeEquivalentTo("http://example.com/elsewhere"))
+			Expect(redirect).NotTo(BeAnExistingFile())
+		})
+
+		It("does not count a blob renamed within a quota twice", func() {
+			handler.Quotas = handlers.QuotaRules{{Prefix: "/dir/", MaxBytes: 10}}
+			req := newRequest("MOVE", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/dir/moved.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusCreated))
+		})
+
+		It("fails with 507 when the move would exceed a quota of the destination", func() {
+			handler.Quotas = handlers.QuotaRules{{Prefix: "/full/", MaxBytes: 4}}
+			Expect(os.Mkdir(filepath.Join(tempDir, "full"), 0755)).To(Succeed())
+			req := newRequest("MOVE", "/dir/file.txt", "")
+			req.Header.Set("Destination", "/full/file.txt")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusInsufficientStorage))
+			Expect(filepath.Join(tempDir, "dir", "file.txt")).To(BeARegularFile())
+		})
+
+		It("refuses to move a collection into itself", func() {
+			req := newRequest("MOVE", "/dir", "")
+			req.Header.Set("Destination", "/dir/nested")
+
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("DELETE", func() {
+		It("removes a collection and its members", func() {
+			put("/dir/file.txt", "blob-data")
+
+			handler.ServeHTTP(response, newRequest(http.MethodDelete, "/dir", ""))
+
+			Expect(response.Code).To(Equal(http.StatusNoContent))
+			Expect(filepath.Join(tempDir, "dir")).NotTo(BeAnExistingFile())
+		})
+
+		It("removes the redirect of a blob", func() {
+			put("/file.txt", "blob-data")
+			redirect := filepath.Join(tempDir, "file.txt.redirect")
+			Expect(ioutil.WriteFile(redirect, []byte("http://example.com/elsewhere"), 0644)).To(Succeed())
+
+			handler.ServeHTTP(response, newRequest(http.MethodDelete, "/file.txt", ""))
+
+			Expect(response.Code).To(Equal(http.StatusNoContent))
+			Expect(redirect).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("locking", func() {
+		const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>ci-job-1</D:owner>
+</D:lockinfo>`
+
+		var token string
+
+		statusFor := func(req *http.Request) int {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		BeforeEach(func() {
+			handler.Locks = handlers.NewLockManager()
+			put("/dir/file.txt", "blob-data")
+
+			req := newRequest("LOCK", "/dir/file.txt", lockBody)
+			req.Header.Set("Timeout", "Second-600")
+			handler.ServeHTTP(response, req)
+
+			Expect(response.Code).To(Equal(http.StatusOK))
+			token = strings.Trim(response.Header().Get("Lock-Token"), "<>")
+			Expect(token).To(HavePrefix("opaquelocktoken:"))
+		})
+
+		It("describes the lock", func() {
+			body := response.Body.String()
+			Expect(body).To(ContainSubstring("<D:exclusive/>"))
+			Expect(body).To(ContainSubstring("<D:owner>ci-job-1</D:owner>"))
+			Expect(body).To(ContainSubstring("<D:timeout>Second-600</D:timeout>"))
+			Expect(body).To(ContainSubstring("<D:href>" + token + "</D:href>"))
+		})
+
+		It("advertises class 2 compliance", func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, newRequest("OPTIONS", "/", ""))
+
+			Expect(rec.Header().Get("DAV")).To(Equal("1, 2"))
+			Expect(rec.Header().Get("Allow")).To(ContainSubstring("LOCK"))
+		})
+
+		It("reports the lock in PROPFIND", func() {
+			req := newRequest("PROPFIND", "/dir/file.txt", "")
+			req.Header.Set("Depth", "0")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			Expect(rec.Body.String()).To(ContainSubstring("<D:lockdiscovery><D:activelock>"))
+			Expect(rec.Body.String()).To(ContainSubstring("<D:supportedlock>"))
+		})
+
+		It("refuses a conflicting lock", func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, newRequest("LOCK", "/dir/file.txt", lockBody))
+
+			Expect(rec.Code).To(Equal(http.StatusLocked))
+			Expect(rec.Body.String()).To(ContainSubstring("no-conflicting-lock"))
+		})
+
+		It("rejects writes without the lock token", func() {
+			for _, method := range []string{http.MethodPut, http.MethodDelete, "MOVE"} {
+				req := newRequest(method, "/dir/file.txt", "other-data")
+				req.Header.Set("Destination", "/moved.txt")
+
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				Expect(rec.Code).To(Equal(http.StatusLocked), method)
+				Expect(rec.Body.String()).To(ContainSubstring("<D:lock-token-submitted><D:href>/dir/file.txt</D:href>"))
+			}
+
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dir", "file.txt"))).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("rejects deleting the parent without the lock token", func() {
+			Expect(statusFor(newRequest(http.MethodDelete, "/dir", ""))).To(Equal(http.StatusLocked))
+		})
+
+		It("allows writes that submit the lock token", func() {
+			req := newRequest("COPY", "/dir", "")
+			req.Header.Set("Destination", "/copy")
+			Expect(statusFor(req)).To(Equal(http.StatusCreated))
+
+			req = newRequest(http.MethodDelete, "/dir/file.txt", "")
+			req.Header.Set("If", "</dir/file.txt> (<"+token+">)")
+			Expect(statusFor(req)).To(Equal(http.StatusNoContent))
+
+			Expect(statusFor(newRequest(http.MethodPut, "/dir/file.txt", "data"))).To(Equal(http.StatusCreated))
+		})
+
+		It("fails with 412 when the If header is false", func() {
+			req := newRequest(http.MethodPut, "/dir/file.txt", "new-data")
+			req.Header.Set("If", "(<opaquelocktoken:unknown>)")
+			Expect(statusFor(req)).To(Equal(http.StatusPreconditionFailed))
+
+			req = newRequest(http.MethodPut, "/dir/file.txt", "new-data")
+			req.Header.Set("If", `(<`+token+`> ["not-the-etag"])`)
+			Expect(statusFor(req)).To(Equal(http.StatusPreconditionFailed))
+		})
+
+		It("refreshes the lock", func() {
+			req := newRequest("LOCK", "/dir/file.txt", "")
+			req.Header.Set("If", "(<"+token+">)")
+			req.Header.Set("Timeout", "Second-1200")
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("<D:timeout>Second-1200</D:timeout>"))
+		})
+
+		It("unlocks with the lock token", func() {
+			req := newRequest("UNLOCK", "/dir/file.txt", "")
+			req.Header.Set("Lock-Token", "<opaquelocktoken:unknown>")
+			Expect(statusFor(req)).To(Equal(http.StatusConflict))
+
+			req = newRequest("UNLOCK", "/dir/file.txt", "")
+			req.Header.Set("Lock-Token", "<"+token+">")
+			Expect(statusFor(req)).To(Equal(http.StatusNoContent))
+
+			Expect(statusFor(newRequest(http.MethodDelete, "/dir/file.txt", ""))).To(Equal(http.StatusNoContent))
+		})
+
+		It("creates an empty blob when locking an unmapped path", func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, newRequest("LOCK", "/dir/new.txt", lockBody))
+
+			Expect(rec.Code).To(Equal(http.StatusCreated))
+			Expect(ioutil.ReadFile(filepath.Join(tempDir, "dir", "new.txt"))).To(BeEmpty())
+		})
+
+		It("allows writes by either holder of two shared locks", func() {
+			sharedBody := strings.Replace(lockBody, "<D:exclusive/>", "<D:shared/>", 1)
+			put("/shared.txt", "blob-data")
+
+			var tokens []string
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, newRequest("LOCK", "/shared.txt", sharedBody))
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				tokens = append(tokens, strings.Trim(rec.Header().Get("Lock-Token"), "<>"))
+			}
+
+			Expect(statusFor(newRequest(http.MethodPut, "/shared.txt", "new-data"))).To(Equal(http.StatusLocked))
+			for _, shared := range tokens {
+				req := newRequest(http.MethodPut, "/shared.txt", "new-data")
+				req.Header.Set("If", "(<"+shared+">)")
+				Expect(statusFor(req)).NotTo(Equal(http.StatusLocked))
+			}
+
+			req := newRequest(http.MethodDelete, "/shared.txt", "")
+			req.Header.Set("If", "(<"+tokens[1]+">)")
+			Expect(statusFor(req)).To(Equal(http.StatusNoContent))
+		})
+
+		It("fails with 507 when creating the blob would exceed a quota", func() {
+			handler.Quotas = handlers.QuotaRules{{Prefix: "/dir/", MaxObjects: 1}}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, newRequest("LOCK", "/dir/new.txt", lockBody))
+
+			Expect(rec.Code).To(Equal(http.StatusInsufficientStorage))
+			Expect(filepath.Join(tempDir, "dir", "new.txt")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("when WebDAV is disabled", func() {
+		BeforeEach(func() {
+			handler.WebDAV = false
+		})
+
+		It("rejects WebDAV methods", func() {
+			for _, method := range []string{"OPTIONS", "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE"} {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, newRequest(method, "/dir", ""))
+				Expect(rec.Code).To(Equal(http.StatusBadRequest), method)
+			}
+		})
+	})
+})
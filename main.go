@@ -2,20 +2,115 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/sykesm/dav-blobstore/handlers"
 )
 
 type Config struct {
-	BlobsPath  string            `json:"blobs_path"`
-	PublicRead bool              `json:"public_read"`
-	CertFile   string            `json:"cert_file,omitempty"`
-	KeyFile    string            `json:"key_file,omitempty"`
-	Users      map[string]string `json:"users"`
+	BlobsPath    string          `json:"blobs_path"`
+	PublicRead   bool            `json:"public_read"`
+	CertFile     string          `json:"cert_file,omitempty"`
+	KeyFile      string          `json:"key_file,omitempty"`
+	Users        map[string]User `json:"users"`
+	HtpasswdFile string          `json:"htpasswd_file,omitempty"`
+	Rules        handlers.Rules  `json:"rules,omitempty"`
+	TokensFile   string          `json:"tokens_file,omitempty"`
+
+	Overwrite handlers.OverwriteRules `json:"overwrite,omitempty"`
+	Quotas    handlers.QuotaRules     `json:"quotas,omitempty"`
+
+	MaxUploadSize int64                     `json:"max_upload_size,omitempty"`
+	UploadLimits  handlers.UploadLimitRules `json:"upload_limits,omitempty"`
+	MinFreeSpace  int64                     `json:"min_free_space,omitempty"`
+
+	S3               *handlers.S3Storage `json:"s3,omitempty"`
+	ContentAddressed bool                `json:"content_addressed,omitempty"`
+
+	Compression handlers.CompressionRules `json:"compression,omitempty"`
+	Encryption  *Encryption               `json:"encryption,omitempty"`
+
+	ClientCAFile string                    `json:"client_ca_file,omitempty"`
+	ClientAuth   string                    `json:"client_auth,omitempty"`
+	ClientCerts  handlers.CertificateUsers `json:"client_certs,omitempty"`
+
+	URLSigningKey string `json:"url_signing_key,omitempty"`
+
+	MetricsAddress string `json:"metrics_address,omitempty"`
+
+	WebDAV          bool `json:"webdav,omitempty"`
+	DisableListings bool `json:"disable_listings,omitempty"`
+
+	ReadTimeout     Duration `json:"read_timeout,omitempty"`
+	WriteTimeout    Duration `json:"write_timeout,omitempty"`
+	IdleTimeout     Duration `json:"idle_timeout,omitempty"`
+	ShutdownTimeout Duration `json:"shutdown_timeout,omitempty"`
+}
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// Client certificate authentication modes.
+const (
+	ClientAuthOptional         = "optional"
+	ClientAuthRequire          = "require"
+	ClientAuthRequireForWrites = "require_for_writes"
+)
+
+// User holds the password and roles of an authorized user. A user may also
+// be configured with just a password string, in which case the user is
+// allowed to make any request.
+type User struct {
+	Password string   `json:"password"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+func (u *User) UnmarshalJSON(data []byte) error {
+	var password string
+	if err := json.Unmarshal(data, &password); err == nil {
+		*u = User{Password: password}
+		return nil
+	}
+
+	type user User
+	return json.Unmarshal(data, (*user)(u))
+}
+
+// Encryption configures the keys that blobs are encrypted with at rest,
+// either in a key file or as a keyring in the configuration. The first key
+// encrypts new blobs and the others only decrypt existing blobs.
+type Encryption struct {
+	KeyFile string   `json:"key_file,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+}
+
+// Duration is a time.Duration that is configured as a string such as "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
 }
 
 var configFile = flag.String(
@@ -30,6 +125,12 @@ var listenAddress = flag.String(
 	"The host:port address to bind to",
 )
 
+var watchInterval = flag.Duration(
+	"watchInterval",
+	0,
+	"How often to check the configuration files for changes; 0 disables watching",
+)
+
 func main() {
 	flag.Parse()
 
@@ -38,25 +139,288 @@ func main() {
 		log.Fatalf("failed to load config data: %s", err)
 	}
 
-	if config.BlobsPath == "" {
-		log.Fatal("blobs path is required")
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "sign":
+			if err := signCommand(config, flag.Args()[1:], os.Stdout); err != nil {
+				log.Fatalf("failed to sign url: %s", err)
+			}
+		case "reencrypt":
+			if err := reencryptCommand(config, flag.Args()[1:], os.Stdout); err != nil {
+				log.Fatalf("failed to reencrypt blobs: %s", err)
+			}
+		default:
+			log.Fatalf("unknown command: %s", flag.Arg(0))
+		}
+		return
 	}
 
-	fileServer := &handlers.AuthenticationHandler{
-		PublicRead: config.PublicRead,
-		Authorized: config.Users,
-		Delegate: &handlers.FileServer{
-			Root: config.BlobsPath,
-		},
+	var metricsServer *http.Server
+	var metrics *handlers.Metrics
+	if config.MetricsAddress != "" {
+		metricsServer, metrics = newMetricsServer(config.MetricsAddress)
 	}
 
-	if config.CertFile != "" && config.KeyFile != "" {
-		err = http.ListenAndServeTLS(*listenAddress, config.CertFile, config.KeyFile, fileServer)
-	} else {
-		err = http.ListenAndServe(*listenAddress, fileServer)
+	storage, err := blobStorage(config)
+	if err != nil {
+		log.Fatal(err)
 	}
+	state := &serverState{
+		storage: storage,
+		locks:   handlers.NewLockManager(),
+		usage:   &handlers.UsageTracker{},
+		metrics: metrics,
+	}
+	handler, err := newHandler(config, state)
 	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.SetFileServer(handler.Delegate.(*handlers.FileServer))
+
+	if err := handler.Delegate.(*handlers.FileServer).RemoveStaleUploads(); err != nil {
+		log.Printf("failed to remove stale uploads: %s", err)
+	}
+	if metrics != nil {
+		// The storage usage is only exported once it has been counted. The
+		// count is taken in the background without holding up requests or
+		// scrapes; only uploads that a quota applies to wait for it.
+		go func() {
+			if _, err := handler.Delegate.(*handlers.FileServer).Usage(); err != nil {
+				log.Printf("failed to determine storage usage: %s", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:         *listenAddress,
+		ReadTimeout:  time.Duration(config.ReadTimeout),
+		WriteTimeout: time.Duration(config.WriteTimeout),
+		IdleTimeout:  time.Duration(config.IdleTimeout),
+	}
+
+	var tlsStore *tlsConfigStore
+	if tlsEnabled(config) {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			log.Fatalf("failed to configure tls: %s", err)
+		}
+		tlsStore = &tlsConfigStore{}
+		tlsStore.Store(tlsConfig)
+		server.TLSConfig = tlsStore.ServerConfig()
+	} else if err := checkClientCertConfig(config); err != nil {
+		log.Fatalf("failed to configure client certificates: %s", err)
+	}
+
+	reloadable := handlers.NewReloadableHandler(handler)
+	tracker := &requestTracker{handler: metrics.Instrument(reloadable)}
+	server.Handler = tracker
+
+	reloader := &reloader{
+		configFile: *configFile,
+		config:     config,
+		current:    handler,
+		handler:    reloadable,
+		state:      state,
+		tlsStore:   tlsStore,
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go reloader.handleSignals(hangups)
+
+	if *watchInterval > 0 {
+		go reloader.watch(time.NewTicker(*watchInterval).C)
+	}
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+
+	serveErrors := make(chan error, 2)
+	if metricsServer != nil {
+		go func() {
+			serveErrors <- metricsServer.ListenAndServe()
+		}()
+	}
+	go func() {
+		if tlsStore != nil {
+			serveErrors <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErrors <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErrors:
 		log.Fatalf("listen and serve failed: %s", err)
+	case sig := <-terminate:
+		log.Printf("received %s; shutting down", sig)
+		shutdownTimeout := time.Duration(reloader.Config().ShutdownTimeout)
+		if shutdownTimeout == 0 {
+			shutdownTimeout = defaultShutdownTimeout
+		}
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		shutdown(server, tracker, shutdownTimeout)
+	}
+}
+
+// serverState outlives configuration reloads so that they do not swap the
+// storage under requests in progress, lose WebDAV locks, rescan the storage
+// usage, or reset metrics.
+type serverState struct {
+	storage handlers.Storage
+	locks   *handlers.LockManager
+	usage   *handlers.UsageTracker
+	metrics *handlers.Metrics
+}
+
+// newHandler builds the request handling chain described by config around
+// the shared state.
+func newHandler(config *Config, state *serverState) (*handlers.AuthenticationHandler, error) {
+	users, err := loadUsers(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %s", err)
+	}
+
+	roles, err := loadRoles(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load roles: %s", err)
+	}
+
+	for i := range config.Rules {
+		if err := config.Rules[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid access rule: %s", err)
+		}
+	}
+
+	for i := range config.Overwrite {
+		if err := config.Overwrite[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid overwrite policy: %s", err)
+		}
+	}
+
+	if config.MaxUploadSize < 0 || config.MinFreeSpace < 0 {
+		return nil, errors.New("max_upload_size and min_free_space cannot be negative")
+	}
+	for i := range config.UploadLimits {
+		if err := config.UploadLimits[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid upload limit: %s", err)
+		}
+	}
+
+	for i := range config.Quotas {
+		if err := config.Quotas[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid quota: %s", err)
+		}
+	}
+
+	var tokens handlers.Tokens
+	if config.TokensFile != "" {
+		tokens, err = handlers.LoadTokens(config.TokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tokens: %s", err)
+		}
+	}
+
+	for _, user := range config.ClientCerts {
+		if err := user.Validate(); err != nil {
+			return nil, fmt.Errorf("failed to configure client certificates: %s", err)
+		}
+	}
+
+	fileServer := &handlers.FileServer{
+		Root:            config.BlobsPath,
+		Storage:         state.storage,
+		Overwrite:       config.Overwrite,
+		Quotas:          config.Quotas,
+		MaxUploadSize:   config.MaxUploadSize,
+		UploadLimits:    config.UploadLimits,
+		MinFreeSpace:    config.MinFreeSpace,
+		WebDAV:          config.WebDAV,
+		DisableListings: config.DisableListings,
+		UsageTracker:    state.usage,
+		Metrics:         state.metrics,
+	}
+	if config.WebDAV {
+		// Locks are only enforced while WebDAV is enabled; they are kept
+		// in case it is enabled again by a later reload.
+		fileServer.Locks = state.locks
+	}
+
+	handler := &handlers.AuthenticationHandler{
+		PublicRead: config.PublicRead,
+		Authorized: users,
+		Roles:      roles,
+		Rules:      config.Rules,
+		Tokens:     tokens,
+		Delegate:   fileServer,
+
+		CertificateUsers:            config.ClientCerts,
+		RequireCertificateForWrites: config.ClientAuth == ClientAuthRequireForWrites,
+		Metrics:                     state.metrics,
+	}
+	if config.URLSigningKey != "" {
+		handler.Signer = &handlers.URLSigner{Key: []byte(config.URLSigningKey)}
+	}
+
+	return handler, nil
+}
+
+// blobStorage returns the storage configured for blobs. Blobs are compressed
+// before they are deduplicated and encrypted last, so identical blobs are
+// still stored once. The storage settings cannot be changed by reloading the
+// configuration.
+func blobStorage(config *Config) (handlers.Storage, error) {
+	if config.BlobsPath == "" {
+		return nil, errors.New("blobs path is required")
+	}
+
+	for i := range config.Compression {
+		if err := config.Compression[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid compression rule: %s", err)
+		}
+	}
+
+	if config.S3 != nil {
+		if err := config.S3.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid s3 storage: %s", err)
+		}
+	}
+
+	storage := baseStorage(config)
+	if config.Encryption != nil {
+		keys, err := loadKeyring(config.Encryption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load encryption keys: %s", err)
+		}
+		storage = &handlers.EncryptedStorage{Backend: storage, Keys: keys}
+	}
+	if config.ContentAddressed {
+		storage = &handlers.ContentAddressedStorage{Backend: storage, StagingDir: config.BlobsPath}
+	}
+	if len(config.Compression) > 0 {
+		storage = &handlers.CompressedStorage{Backend: storage, Rules: config.Compression}
+	}
+	return storage, nil
+}
+
+// baseStorage returns the storage that holds the blobs as they are stored.
+func baseStorage(config *Config) handlers.Storage {
+	if config.S3 != nil {
+		return config.S3
+	}
+	return &handlers.LocalStorage{Root: config.BlobsPath}
+}
+
+func loadKeyring(encryption *Encryption) (*handlers.Keyring, error) {
+	switch {
+	case encryption.KeyFile != "" && len(encryption.Keys) > 0:
+		return nil, errors.New("key_file and keys cannot both be configured")
+	case encryption.KeyFile != "":
+		return handlers.LoadKeyring(encryption.KeyFile)
+	default:
+		return handlers.NewKeyring(encryption.Keys)
 	}
 }
 
@@ -75,3 +439,42 @@ func loadConfig(configFile string) (*Config, error) {
 
 	return &config, nil
 }
+
+func loadUsers(config *Config) (map[string]string, error) {
+	users := map[string]string{}
+	if config.HtpasswdFile != "" {
+		htpasswdUsers, err := handlers.LoadHtpasswd(config.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		for user, password := range htpasswdUsers {
+			users[user] = password
+		}
+	}
+
+	for name, user := range config.Users {
+		if _, ok := users[name]; ok {
+			log.Printf("user %q in config overrides the htpasswd entry", name)
+		}
+		users[name] = user.Password
+	}
+
+	return users, nil
+}
+
+func loadRoles(config *Config) (map[string]handlers.Roles, error) {
+	roles := map[string]handlers.Roles{}
+	for name, user := range config.Users {
+		if len(user.Roles) == 0 {
+			continue
+		}
+		for _, roleName := range user.Roles {
+			role, err := handlers.ParseRole(roleName)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %s", name, err)
+			}
+			roles[name] = append(roles[name], role)
+		}
+	}
+	return roles, nil
+}
@@ -1,17 +1,29 @@
 package main_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -19,6 +31,7 @@ import (
 	"github.com/onsi/gomega/gexec"
 
 	"github.com/sykesm/dav-blobstore"
+	"github.com/sykesm/dav-blobstore/handlers"
 )
 
 var _ = Describe("main", func() {
@@ -28,6 +41,7 @@ var _ = Describe("main", func() {
 		tempDir        string
 		configFilePath string
 		serverConfig   *main.Config
+		extraArgs      []string
 
 		session *gexec.Session
 	)
@@ -48,14 +62,16 @@ var _ = Describe("main", func() {
 
 		configFilePath = filepath.Join(tempDir, "config.json")
 		marshalToFile(configFilePath, serverConfig)
+
+		extraArgs = nil
 	})
 
 	JustBeforeEach(func() {
-		command := exec.Command(
-			davServerPath,
+		args := append([]string{
 			"--configFile", configFilePath,
 			"--listenAddress", listenAddress,
-		)
+		}, extraArgs...)
+		command := exec.Command(davServerPath, args...)
 
 		var err error
 		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
@@ -99,8 +115,8 @@ var _ = Describe("main", func() {
 	Context("when public read is disabled", func() {
 		BeforeEach(func() {
 			serverConfig.PublicRead = false
-			serverConfig.Users = map[string]string{
-				"user": "password",
+			serverConfig.Users = map[string]main.User{
+				"user": {Password: "password"},
 			}
 			marshalToFile(configFilePath, serverConfig)
 		})
@@ -124,6 +140,1016 @@ var _ = Describe("main", func() {
 		})
 	})
 
+	Context("when users are configured with roles", func() {
+		BeforeEach(func() {
+			config := fmt.Sprintf(`{
+				"blobs_path": %q,
+				"users": {
+					"legacy": "password",
+					"auditor": {"password": "password", "roles": ["read"]}
+				}
+			}`, tempDir)
+			err := ioutil.WriteFile(configFilePath, []byte(config), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("restricts users to their roles", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			u.User = url.UserPassword("auditor", "password")
+			resp, err := http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("allows users configured with only a password to make any request", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			u.User = url.UserPassword("legacy", "password")
+			req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		})
+
+		Context("when a role is not recognized", func() {
+			BeforeEach(func() {
+				serverConfig.Users = map[string]main.User{
+					"user": {Password: "password", Roles: []string{"superuser"}},
+				}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to load roles"))
+			})
+		})
+	})
+
+	Context("when access rules are configured", func() {
+		BeforeEach(func() {
+			serverConfig.Rules = handlers.Rules{
+				{Prefix: "/config.json", Users: []string{handlers.AnonymousUser}, Access: handlers.AccessDeny},
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("applies the rules to requests", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			resp, err := http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		Context("when a rule is invalid", func() {
+			BeforeEach(func() {
+				serverConfig.Rules = handlers.Rules{{Prefix: "/private", Access: "maybe"}}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("invalid access rule"))
+			})
+		})
+	})
+
+	Context("when overwrite policies are configured", func() {
+		BeforeEach(func() {
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.Overwrite = handlers.OverwriteRules{
+				{Prefix: "/", Policy: handlers.OverwriteIdempotent},
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("accepts identical uploads of an existing blob", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+
+			contents, err := ioutil.ReadFile(configFilePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader(string(contents)))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		})
+
+		Context("when a policy is invalid", func() {
+			BeforeEach(func() {
+				serverConfig.Overwrite = handlers.OverwriteRules{{Prefix: "/", Policy: "sometimes"}}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("invalid overwrite policy"))
+			})
+		})
+	})
+
+	Context("when s3 storage is configured", func() {
+		var (
+			objects map[string][]byte
+			bucket  *httptest.Server
+		)
+
+		BeforeEach(func() {
+			objects = map[string][]byte{}
+			var mu sync.Mutex
+			bucket = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				object, ok := objects[r.URL.Path]
+				switch {
+				case r.URL.Path == "/blobs":
+					fmt.Fprint(w, "<ListBucketResult></ListBucketResult>")
+				case r.Method == http.MethodPut:
+					objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+				case !ok:
+					w.WriteHeader(http.StatusNotFound)
+				default:
+					w.Header().Set("Content-Length", fmt.Sprint(len(object)))
+					w.Write(object)
+				}
+			}))
+
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.S3 = &handlers.S3Storage{
+				Endpoint:        bucket.URL,
+				Bucket:          "blobs",
+				Prefix:          "bosh",
+				AccessKeyID:     "access-key",
+				SecretAccessKey: "secret-key",
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		AfterEach(func() {
+			bucket.Close()
+		})
+
+		It("stores blobs in the bucket", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+			u.Path = "/dir/blob.tgz"
+
+			req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader("blob-data"))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(objects).To(HaveKeyWithValue("/blobs/bosh/dir/blob.tgz", []byte("blob-data")))
+
+			resp, err = http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(BeEquivalentTo("blob-data"))
+		})
+
+		Context("when the bucket is missing", func() {
+			BeforeEach(func() {
+				serverConfig.S3.Bucket = ""
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("invalid s3 storage: s3 bucket is required"))
+			})
+		})
+	})
+
+	Context("when content addressed storage is enabled", func() {
+		BeforeEach(func() {
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.ContentAddressed = true
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("stores identical blobs once", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+
+			for _, upath := range []string{"/a/blob.tgz", "/b/blob.tgz"} {
+				u.Path = upath
+				req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader("blob-data"))
+				Expect(err).NotTo(HaveOccurred())
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			}
+
+			digest := "c2752ad96ee652e4d37fd3852de632c50f193490d132f27a1794c986e1f112ef"
+			refs, err := ioutil.ReadFile(filepath.Join(tempDir, handlers.CONTENT_DIR, digest[:2], digest+".refs"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(refs).To(BeEquivalentTo("2"))
+
+			resp, err := http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(body).To(BeEquivalentTo("blob-data"))
+		})
+	})
+
+	Context("when a metrics address is configured", func() {
+		var metricsAddress string
+
+		BeforeEach(func() {
+			metricsAddress = fmt.Sprintf("127.0.0.1:%d", 19000+GinkgoParallelNode())
+			serverConfig.MetricsAddress = metricsAddress
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("serves prometheus metrics on the metrics address", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			Eventually(dial("tcp", metricsAddress)).Should(Succeed())
+
+			resp, err := http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			scrape := func() string {
+				resp, err := http.Get("http://" + metricsAddress + "/metrics")
+				Expect(err).NotTo(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				return string(body)
+			}
+			Eventually(scrape).Should(ContainSubstring("dav_blobstore_storage_blobs 1"))
+			body := scrape()
+			Expect(body).To(ContainSubstring(`dav_blobstore_requests_total{method="GET",status="200"} 1`))
+			Expect(body).To(ContainSubstring("go_goroutines"))
+
+			u.Path = "/metrics"
+			resp, err = http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("when upload limits are configured", func() {
+		BeforeEach(func() {
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.MaxUploadSize = 8
+			serverConfig.UploadLimits = handlers.UploadLimitRules{{Prefix: "/large/", MaxSize: 0}}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("refuses uploads that are too large", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+
+			put := func(upath, content string) int {
+				u.Path = upath
+				req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader(content))
+				Expect(err).NotTo(HaveOccurred())
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			Expect(put("/small.tgz", "0123456789")).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(put("/large/blob.tgz", "0123456789")).To(Equal(http.StatusCreated))
+		})
+
+		Context("when a limit is invalid", func() {
+			BeforeEach(func() {
+				serverConfig.UploadLimits = handlers.UploadLimitRules{{Prefix: "large/"}}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("invalid upload limit"))
+			})
+		})
+	})
+
+	Context("when quotas are configured", func() {
+		BeforeEach(func() {
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.Quotas = handlers.QuotaRules{{Prefix: "/limited/", MaxBytes: 10}}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("refuses uploads that exceed a quota", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+
+			put := func(upath, content string) int {
+				u.Path = upath
+				req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader(content))
+				Expect(err).NotTo(HaveOccurred())
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			Expect(put("/limited/a.tgz", "01234567")).To(Equal(http.StatusCreated))
+			Expect(put("/limited/b.tgz", "01234567")).To(Equal(http.StatusInsufficientStorage))
+			Expect(put("/unlimited/b.tgz", "01234567")).To(Equal(http.StatusCreated))
+		})
+
+		Context("when a quota is invalid", func() {
+			BeforeEach(func() {
+				serverConfig.Quotas = handlers.QuotaRules{{Prefix: "/limited/"}}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("invalid quota"))
+			})
+		})
+	})
+
+	Context("when compression is configured", func() {
+		BeforeEach(func() {
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.Compression = handlers.CompressionRules{
+				{Prefix: "/src/", Algorithm: handlers.CompressionGzip},
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("stores blobs compressed", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+			u.Path = "/src/main.go"
+
+			content := strings.Repeat("package main\n", 100)
+			req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader(content))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			info, err := os.Stat(filepath.Join(tempDir, "src", "main.go"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<", len(content)))
+
+			resp, err = http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal(content))
+		})
+
+		Context("when a rule is invalid", func() {
+			BeforeEach(func() {
+				serverConfig.Compression = handlers.CompressionRules{{Prefix: "/src/", Algorithm: "brotli"}}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("invalid compression rule"))
+			})
+		})
+	})
+
+	Context("when encryption is configured", func() {
+		const (
+			oldKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+			newKey = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+		)
+
+		var blobsPath string
+
+		BeforeEach(func() {
+			blobsPath = filepath.Join(tempDir, "blobs")
+			Expect(os.Mkdir(blobsPath, 0755)).To(Succeed())
+
+			serverConfig.BlobsPath = blobsPath
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			serverConfig.Encryption = &main.Encryption{Keys: []string{oldKey}}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		reencrypt := func() *gexec.Session {
+			command := exec.Command(davServerPath, "--configFile", configFilePath, "reencrypt")
+			reencryption, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(reencryption, 5*time.Second).Should(gexec.Exit())
+			return reencryption
+		}
+
+		It("stores blobs encrypted and re-encrypts them with a new key", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+			u.Path = "/blob.tgz"
+
+			req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader("licensed-binary"))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			stored, err := ioutil.ReadFile(filepath.Join(blobsPath, "blob.tgz"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(stored)).NotTo(ContainSubstring("licensed-binary"))
+
+			serverConfig.Encryption.Keys = []string{newKey, oldKey}
+			marshalToFile(configFilePath, serverConfig)
+			reencryption := reencrypt()
+			Expect(reencryption.ExitCode()).To(Equal(0))
+			Expect(reencryption.Out).To(gbytes.Say("reencrypted /blob.tgz\n"))
+			Expect(reencryption.Out).To(gbytes.Say("reencrypted 2 blobs"))
+
+			serverConfig.Encryption.Keys = []string{newKey}
+			marshalToFile(configFilePath, serverConfig)
+			reencryption = reencrypt()
+			Expect(reencryption.ExitCode()).To(Equal(0))
+			Expect(reencryption.Out).To(gbytes.Say("reencrypted 0 blobs"))
+		})
+
+		Context("when a key is invalid", func() {
+			BeforeEach(func() {
+				serverConfig.Encryption.Keys = []string{"not-a-key"}
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to load encryption keys"))
+			})
+		})
+	})
+
+	Context("when uploading in chunks", func() {
+		BeforeEach(func() {
+			serverConfig.Users = map[string]main.User{"user": {Password: "password"}}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("assembles the blob from its chunks", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+			u.Path = "/chunked.tgz"
+
+			req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Upload-Length", "9")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			session, err := u.Parse(resp.Header.Get("Location"))
+			Expect(err).NotTo(HaveOccurred())
+
+			patch := func(offset, chunk string) int {
+				req, err := http.NewRequest(http.MethodPatch, session.String(), strings.NewReader(chunk))
+				Expect(err).NotTo(HaveOccurred())
+				req.Header.Set("Upload-Offset", offset)
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).NotTo(HaveOccurred())
+				return resp.StatusCode
+			}
+			Expect(patch("0", "blob-")).To(Equal(http.StatusNoContent))
+			Expect(patch("5", "data")).To(Equal(http.StatusCreated))
+
+			contents, err := ioutil.ReadFile(filepath.Join(tempDir, "chunked.tgz"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(BeEquivalentTo("blob-data"))
+		})
+	})
+
+	Context("when a tokens file is configured", func() {
+		BeforeEach(func() {
+			tokensPath := filepath.Join(tempDir, "tokens.json")
+			err := ioutil.WriteFile(tokensPath, []byte(`{
+				"tokens": [{
+					"name": "ci",
+					"sha256": "a1d5601d3a081aea3a98b7dc5b6f20045eee286ab647e9660eed6958ef7ce8e5",
+					"roles": ["read", "delete"],
+					"expires_at": "2100-01-01T00:00:00Z"
+				}]
+			}`), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			serverConfig.TokensFile = tokensPath
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("authenticates requests with bearer tokens", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer ci-secret-token")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		})
+
+		Context("when the tokens file is invalid", func() {
+			BeforeEach(func() {
+				err := ioutil.WriteFile(serverConfig.TokensFile, []byte(`{"tokens": [{"name": "ci"}]}`), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to load tokens"))
+			})
+		})
+	})
+
+	Context("when client certificates are configured", func() {
+		var (
+			serverCAs  *x509.CertPool
+			clientCert tls.Certificate
+		)
+
+		clientFor := func(certs ...tls.Certificate) *http.Client {
+			return &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: serverCAs, Certificates: certs},
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			u.Scheme = "https"
+
+			serverCA := newTestCA("Server CA")
+			serverCAs = x509.NewCertPool()
+			serverCAs.AddCert(serverCA.cert)
+
+			serverConfig.CertFile = filepath.Join(tempDir, "server.pem")
+			serverConfig.KeyFile = filepath.Join(tempDir, "server.key")
+			serverCA.issueToFiles("test-server", serverConfig.CertFile, serverConfig.KeyFile)
+
+			clientCA := newTestCA("Client CA")
+			serverConfig.ClientCAFile = filepath.Join(tempDir, "client-ca.pem")
+			err := ioutil.WriteFile(serverConfig.ClientCAFile, clientCA.certPEM(), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			clientCertPath := filepath.Join(tempDir, "client.pem")
+			clientKeyPath := filepath.Join(tempDir, "client.key")
+			clientCA.issueToFiles("ci-runner", clientCertPath, clientKeyPath)
+			clientCert, err = tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			serverConfig.ClientAuth = main.ClientAuthRequireForWrites
+			serverConfig.ClientCerts = handlers.CertificateUsers{
+				"ci-runner": {Name: "ci"},
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("allows anonymous reads without a certificate", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			resp, err := clientFor().Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("allows writes authenticated by a client certificate", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			u.Path = "/blob"
+			req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader("blob-data"))
+			Expect(err).NotTo(HaveOccurred())
+
+			resp, err := clientFor(clientCert).Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+
+		It("rejects writes without a client certificate", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			u.Path = "/blob"
+			req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader("blob-data"))
+			Expect(err).NotTo(HaveOccurred())
+
+			resp, err := clientFor().Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("reloads the server certificate when it receives SIGHUP", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			newServerCA := newTestCA("New Server CA")
+			newServerCA.issueToFiles("test-server", serverConfig.CertFile, serverConfig.KeyFile)
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("tls certificate reloaded"))
+
+			_, err := clientFor().Get(u.String())
+			Expect(err).To(HaveOccurred())
+
+			serverCAs = x509.NewCertPool()
+			serverCAs.AddCert(newServerCA.cert)
+			resp, err := clientFor().Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("does not report an unchanged certificate as reloaded", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("configuration reloaded with no changes"))
+			Expect(string(session.Err.Contents())).NotTo(ContainSubstring("tls certificate reloaded"))
+		})
+
+		It("negotiates HTTP/2", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig:   &tls.Config{RootCAs: serverCAs},
+					ForceAttemptHTTP2: true,
+				},
+			}
+			resp, err := client.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.ProtoMajor).To(Equal(2))
+		})
+
+		Context("when client certificates are required", func() {
+			BeforeEach(func() {
+				serverConfig.ClientAuth = main.ClientAuthRequire
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("rejects connections without a client certificate", func() {
+				Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+				_, err := clientFor().Get(u.String())
+				Expect(err).To(HaveOccurred())
+
+				resp, err := clientFor(clientCert).Get(u.String())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when TLS is not enabled", func() {
+			BeforeEach(func() {
+				serverConfig.CertFile = ""
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to configure client certificates"))
+			})
+		})
+	})
+
+	Context("when a url signing key is configured", func() {
+		BeforeEach(func() {
+			serverConfig.PublicRead = false
+			serverConfig.URLSigningKey = "secret"
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("accepts URLs minted by the sign command", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			command := exec.Command(davServerPath, "--configFile", configFilePath, "sign", "-method", "GET", "-expires", "5m", u.String())
+			signSession, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(signSession, 5*time.Second).Should(gexec.Exit(0))
+
+			signedURL := strings.TrimSpace(string(signSession.Out.Contents()))
+			Expect(signedURL).To(HavePrefix(u.String() + "?"))
+
+			resp, err := http.Get(signedURL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			resp, err = http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("when users are loaded from an htpasswd file", func() {
+		BeforeEach(func() {
+			htpasswdPath := filepath.Join(tempDir, "htpasswd")
+			err := ioutil.WriteFile(htpasswdPath, []byte("user:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			serverConfig.PublicRead = false
+			serverConfig.HtpasswdFile = htpasswdPath
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("authenticates the htpasswd users", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			u.User = url.UserPassword("user", "password")
+
+			resp, err := http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		Context("when the htpasswd file is missing", func() {
+			BeforeEach(func() {
+				serverConfig.HtpasswdFile = filepath.Join(tempDir, "missing")
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("fails with an error message", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to load users"))
+			})
+		})
+	})
+
+	Context("when webdav is enabled", func() {
+		BeforeEach(func() {
+			serverConfig.WebDAV = true
+			serverConfig.Users = map[string]main.User{
+				"user": {Password: "password"},
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		It("answers PROPFIND requests", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			req, err := http.NewRequest("PROPFIND", u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Depth", "0")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusMultiStatus))
+		})
+
+		It("keeps locks when the configuration is reloaded", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+
+			req, err := http.NewRequest("LOCK", u.String(), strings.NewReader(
+				`<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`,
+			))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Lock-Token")).NotTo(BeEmpty())
+
+			serverConfig.Users["new-user"] = main.User{Password: "password"}
+			marshalToFile(configFilePath, serverConfig)
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("users added: new-user"))
+
+			req, err = http.NewRequest(http.MethodDelete, u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusLocked))
+		})
+
+		It("does not enforce locks once webdav is disabled", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			u.User = url.UserPassword("user", "password")
+			u.Path = "/blob"
+
+			req, err := http.NewRequest("LOCK", u.String(), strings.NewReader(
+				`<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`,
+			))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			serverConfig.WebDAV = false
+			marshalToFile(configFilePath, serverConfig)
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("webdav changed to false"))
+
+			req, err = http.NewRequest(http.MethodDelete, u.String(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		})
+	})
+
+	Describe("reloading the configuration", func() {
+		var statusAs func(username string) func() int
+
+		BeforeEach(func() {
+			serverConfig.PublicRead = false
+			serverConfig.Users = map[string]main.User{
+				"user": {Password: "password"},
+			}
+			marshalToFile(configFilePath, serverConfig)
+
+			statusAs = func(username string) func() int {
+				return func() int {
+					authURL := *u
+					authURL.User = url.UserPassword(username, "password")
+
+					resp, err := http.Get(authURL.String())
+					Expect(err).NotTo(HaveOccurred())
+					resp.Body.Close()
+					return resp.StatusCode
+				}
+			}
+		})
+
+		It("reloads users when it receives SIGHUP", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+			Expect(statusAs("new-user")()).To(Equal(http.StatusForbidden))
+
+			serverConfig.Users = map[string]main.User{
+				"new-user": {Password: "password"},
+			}
+			marshalToFile(configFilePath, serverConfig)
+			session.Signal(syscall.SIGHUP)
+
+			Eventually(session.Err).Should(gbytes.Say("users added: new-user"))
+			Expect(statusAs("new-user")()).To(Equal(http.StatusOK))
+			Expect(statusAs("user")()).To(Equal(http.StatusForbidden))
+		})
+
+		It("reloads public_read when it receives SIGHUP", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			serverConfig.PublicRead = true
+			marshalToFile(configFilePath, serverConfig)
+			session.Signal(syscall.SIGHUP)
+
+			Eventually(session.Err).Should(gbytes.Say("public_read changed to true"))
+			resp, err := http.Get(u.String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("keeps the current configuration when the new one is invalid", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			err := ioutil.WriteFile(configFilePath, []byte("!!invalid-json!!"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			session.Signal(syscall.SIGHUP)
+
+			Eventually(session.Err).Should(gbytes.Say("configuration reload failed"))
+			Expect(statusAs("user")()).To(Equal(http.StatusOK))
+		})
+
+		It("refuses to change the blobs path", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			serverConfig.BlobsPath = filepath.Join(tempDir, "other-blobs")
+			marshalToFile(configFilePath, serverConfig)
+			session.Signal(syscall.SIGHUP)
+
+			Eventually(session.Err).Should(gbytes.Say("configuration reload failed: changing blobs_path requires a restart"))
+			Expect(statusAs("user")()).To(Equal(http.StatusOK))
+		})
+
+		It("refuses to change the server timeouts", func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			serverConfig.ReadTimeout = main.Duration(time.Minute)
+			marshalToFile(configFilePath, serverConfig)
+			session.Signal(syscall.SIGHUP)
+
+			Eventually(session.Err).Should(gbytes.Say("configuration reload failed: changing read_timeout requires a restart"))
+			Expect(statusAs("user")()).To(Equal(http.StatusOK))
+		})
+
+		Context("when watching for changes", func() {
+			BeforeEach(func() {
+				extraArgs = []string{"--watchInterval", "50ms"}
+			})
+
+			It("reloads when the configuration file changes", func() {
+				Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+				serverConfig.Users = map[string]main.User{
+					"user":     {Password: "password"},
+					"new-user": {Password: "password"},
+				}
+				marshalToFile(configFilePath, serverConfig)
+
+				Eventually(session.Err).Should(gbytes.Say("users added: new-user"))
+				Expect(statusAs("new-user")()).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Describe("shutting down", func() {
+		var (
+			bodyWriter *io.PipeWriter
+			responses  chan *http.Response
+		)
+
+		BeforeEach(func() {
+			serverConfig.ShutdownTimeout = main.Duration(5 * time.Second)
+			serverConfig.Users = map[string]main.User{
+				"user": {Password: "password"},
+			}
+			marshalToFile(configFilePath, serverConfig)
+		})
+
+		JustBeforeEach(func() {
+			Eventually(dial("tcp", listenAddress)).Should(Succeed())
+
+			var bodyReader *io.PipeReader
+			bodyReader, bodyWriter = io.Pipe()
+
+			u.Path = "/blob"
+			u.User = url.UserPassword("user", "password")
+			req, err := http.NewRequest(http.MethodPut, u.String(), bodyReader)
+			Expect(err).NotTo(HaveOccurred())
+			req.ContentLength = int64(len("blob-data"))
+
+			responses = make(chan *http.Response, 1)
+			go func() {
+				defer GinkgoRecover()
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					responses <- resp
+				}
+				close(responses)
+			}()
+
+			_, err = bodyWriter.Write([]byte("blob-"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() ([]string, error) {
+				return filepath.Glob(filepath.Join(tempDir, ".upload-blob.*"))
+			}).Should(HaveLen(1))
+		})
+
+		It("waits for in-flight uploads to complete", func() {
+			session.Terminate()
+			Eventually(session.Err).Should(gbytes.Say("shutting down"))
+
+			_, err := bodyWriter.Write([]byte("data"))
+			Expect(err).NotTo(HaveOccurred())
+			bodyWriter.Close()
+
+			var resp *http.Response
+			Eventually(responses).Should(Receive(&resp))
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+
+			contents, err := ioutil.ReadFile(filepath.Join(tempDir, "blob"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(BeEquivalentTo("blob-data"))
+		})
+
+		It("stops accepting new connections", func() {
+			session.Terminate()
+			Eventually(session.Err).Should(gbytes.Say("shutting down"))
+
+			Eventually(dial("tcp", listenAddress)).ShouldNot(Succeed())
+			bodyWriter.Close()
+		})
+
+		Context("when uploads do not complete before the deadline", func() {
+			BeforeEach(func() {
+				serverConfig.ShutdownTimeout = main.Duration(100 * time.Millisecond)
+				marshalToFile(configFilePath, serverConfig)
+			})
+
+			It("aborts them without leaving partial blobs", func() {
+				session.Terminate()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("aborting"))
+
+				Expect(filepath.Join(tempDir, "blob")).NotTo(BeAnExistingFile())
+				Expect(filepath.Glob(filepath.Join(tempDir, ".upload-*"))).To(BeEmpty())
+				bodyWriter.Close()
+			})
+		})
+	})
+
 	Context("when the configuration file cannot be opened", func() {
 		BeforeEach(func() {
 			err := os.Remove(configFilePath)
@@ -212,3 +1238,61 @@ func dial(network, address string) func() error {
 		return nil
 	}
 }
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(commonName string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issueToFiles writes a certificate and key for commonName, valid for both
+// server and client authentication on 127.0.0.1.
+func (ca *testCA) issueToFiles(commonName, certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	Expect(err).NotTo(HaveOccurred())
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	Expect(err).NotTo(HaveOccurred())
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// newMetricsServer returns a server for the Prometheus metrics endpoint at
+// /metrics on address and the metrics it serves, along with the Go runtime
+// and process metrics.
+func newMetricsServer(address string) (*http.Server, *handlers.Metrics) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	metrics := handlers.NewMetrics(registry)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return &http.Server{Addr: address, Handler: mux}, metrics
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// reencryptCommand encrypts the blobs that are not encrypted with the
+// current key, or not encrypted at all, with the current key so that old
+// keys can be removed from the keyring.
+func reencryptCommand(config *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("usage: reencrypt [PATH]")
+	}
+	if config.Encryption == nil {
+		return errors.New("encryption is not configured")
+	}
+
+	keys, err := loadKeyring(config.Encryption)
+	if err != nil {
+		return fmt.Errorf("failed to load encryption keys: %s", err)
+	}
+	storage := &handlers.EncryptedStorage{Backend: baseStorage(config), Keys: keys}
+
+	upath := "/"
+	if flags.NArg() == 1 {
+		upath = path.Clean("/" + flags.Arg(0))
+	}
+
+	count := 0
+	err = storage.Reencrypt(upath, func(upath string) {
+		count++
+		fmt.Fprintf(out, "reencrypted %s\n", upath)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "reencrypted %d blobs\n", count)
+	return err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// reloader rebuilds the handler chain and TLS configuration from the
+// configuration file and swaps them in without interrupting requests.
+type reloader struct {
+	configFile string
+	handler    *handlers.ReloadableHandler
+	tlsStore   *tlsConfigStore
+	state      *serverState
+
+	mu      sync.Mutex
+	config  *Config
+	current *handlers.AuthenticationHandler
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := loadConfig(r.configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config data: %s", err)
+	}
+
+	if setting := restartSetting(r.config, config); setting != "" {
+		return fmt.Errorf("changing %s requires a restart", setting)
+	}
+
+	handler, err := newHandler(config, r.state)
+	if err != nil {
+		return err
+	}
+
+	if tlsEnabled(config) != (r.tlsStore != nil) {
+		return errors.New("enabling or disabling tls requires a restart")
+	}
+	certificateChanged := false
+	if r.tlsStore != nil {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return fmt.Errorf("failed to configure tls: %s", err)
+		}
+		certificateChanged = !reflect.DeepEqual(r.tlsStore.Load().Certificates[0].Certificate, tlsConfig.Certificates[0].Certificate)
+		r.tlsStore.Store(tlsConfig)
+	} else if err := checkClientCertConfig(config); err != nil {
+		return fmt.Errorf("failed to configure client certificates: %s", err)
+	}
+
+	r.handler.Swap(handler)
+	r.state.metrics.SetFileServer(handler.Delegate.(*handlers.FileServer))
+
+	changes := describeChanges(r.config, config, r.current, handler)
+	if certificateChanged {
+		changes = append(changes, fmt.Sprintf("tls certificate reloaded from %s", config.CertFile))
+	}
+	r.config, r.current = config, handler
+
+	if len(changes) == 0 {
+		log.Printf("configuration reloaded with no changes")
+	}
+	for _, change := range changes {
+		log.Printf("configuration reloaded: %s", change)
+	}
+	return nil
+}
+
+func (r *reloader) Config() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+func (r *reloader) handleSignals(signals <-chan os.Signal) {
+	for range signals {
+		log.Printf("reloading configuration from %s", r.configFile)
+		if err := r.reload(); err != nil {
+			log.Printf("configuration reload failed: %s", err)
+		}
+	}
+}
+
+// watch reloads the configuration whenever the configuration file, or a
+// file it refers to, has been modified when checked on a tick.
+func (r *reloader) watch(ticks <-chan time.Time) {
+	last := r.fingerprint()
+	for range ticks {
+		current := r.fingerprint()
+		if current == last {
+			continue
+		}
+		last = current
+
+		log.Printf("configuration files changed; reloading")
+		if err := r.reload(); err != nil {
+			log.Printf("configuration reload failed: %s", err)
+		}
+	}
+}
+
+func (r *reloader) fingerprint() string {
+	r.mu.Lock()
+	files := []string{
+		r.configFile,
+		r.config.HtpasswdFile,
+		r.config.TokensFile,
+		r.config.CertFile,
+		r.config.KeyFile,
+		r.config.ClientCAFile,
+	}
+	r.mu.Unlock()
+
+	var parts []string
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			parts = append(parts, file+":missing")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(parts, "|")
+}
+
+// restartSetting returns the name of a setting that differs between the
+// configurations but cannot be changed without restarting the server, or an
+// empty string.
+func restartSetting(oldConfig, newConfig *Config) string {
+	switch {
+	case oldConfig.BlobsPath != newConfig.BlobsPath:
+		return "blobs_path"
+	case !reflect.DeepEqual(oldConfig.S3, newConfig.S3):
+		return "s3"
+	case oldConfig.ContentAddressed != newConfig.ContentAddressed:
+		return "content_addressed"
+	case !reflect.DeepEqual(oldConfig.Compression, newConfig.Compression):
+		return "compression"
+	case !reflect.DeepEqual(oldConfig.Encryption, newConfig.Encryption):
+		return "encryption"
+	case oldConfig.MetricsAddress != newConfig.MetricsAddress:
+		return "metrics_address"
+	case oldConfig.ReadTimeout != newConfig.ReadTimeout:
+		return "read_timeout"
+	case oldConfig.WriteTimeout != newConfig.WriteTimeout:
+		return "write_timeout"
+	case oldConfig.IdleTimeout != newConfig.IdleTimeout:
+		return "idle_timeout"
+	}
+	return ""
+}
+
+// describeChanges summarizes the differences between two configurations
+// without revealing any credentials.
+func describeChanges(oldConfig, newConfig *Config, oldHandler, newHandler *handlers.AuthenticationHandler) []string {
+	var changes []string
+
+	if oldHandler.PublicRead != newHandler.PublicRead {
+		changes = append(changes, fmt.Sprintf("public_read changed to %t", newHandler.PublicRead))
+	}
+
+	added, removed, modified := diffKeys(oldHandler.Authorized, newHandler.Authorized)
+	changes = appendNames(changes, "users added", added)
+	changes = appendNames(changes, "users removed", removed)
+	changes = appendNames(changes, "user passwords changed", modified)
+
+	added, removed, modified = diffKeys(oldHandler.Roles, newHandler.Roles)
+	changes = appendNames(changes, "user roles changed", append(append(added, removed...), modified...))
+
+	if !reflect.DeepEqual(oldHandler.Rules, newHandler.Rules) {
+		changes = append(changes, fmt.Sprintf("access rules changed (%d rules)", len(newHandler.Rules)))
+	}
+
+	if oldConfig.WebDAV != newConfig.WebDAV {
+		changes = append(changes, fmt.Sprintf("webdav changed to %t", newConfig.WebDAV))
+	}
+
+	if !reflect.DeepEqual(oldConfig.Overwrite, newConfig.Overwrite) {
+		changes = append(changes, fmt.Sprintf("overwrite policies changed (%d rules)", len(newConfig.Overwrite)))
+	}
+
+	if oldConfig.MaxUploadSize != newConfig.MaxUploadSize || !reflect.DeepEqual(oldConfig.UploadLimits, newConfig.UploadLimits) {
+		changes = append(changes, fmt.Sprintf("upload limits changed (%d rules)", len(newConfig.UploadLimits)))
+	}
+	if oldConfig.MinFreeSpace != newConfig.MinFreeSpace {
+		changes = append(changes, fmt.Sprintf("min_free_space changed to %d", newConfig.MinFreeSpace))
+	}
+
+	if !reflect.DeepEqual(oldConfig.Quotas, newConfig.Quotas) {
+		changes = append(changes, fmt.Sprintf("quotas changed (%d rules)", len(newConfig.Quotas)))
+	}
+
+	added, removed, modified = diffKeys(tokenNames(oldHandler.Tokens), tokenNames(newHandler.Tokens))
+	changes = appendNames(changes, "tokens added", added)
+	changes = appendNames(changes, "tokens removed", removed)
+	changes = appendNames(changes, "tokens changed", modified)
+
+	if !reflect.DeepEqual(oldHandler.CertificateUsers, newHandler.CertificateUsers) ||
+		oldConfig.ClientAuth != newConfig.ClientAuth || oldConfig.ClientCAFile != newConfig.ClientCAFile {
+		changes = append(changes, "client certificate settings changed")
+	}
+	if !reflect.DeepEqual(oldHandler.Signer, newHandler.Signer) {
+		changes = append(changes, "url signing key changed")
+	}
+	return changes
+}
+
+func tokenNames(tokens handlers.Tokens) map[string]handlers.Token {
+	names := map[string]handlers.Token{}
+	for _, token := range tokens {
+		names[token.Name] = *token
+	}
+	return names
+}
+
+// diffKeys compares two maps and returns the sorted keys that were added,
+// removed, and whose values changed.
+func diffKeys(oldMap, newMap interface{}) (added, removed, modified []string) {
+	oldValue, newValue := reflect.ValueOf(oldMap), reflect.ValueOf(newMap)
+	for _, key := range newValue.MapKeys() {
+		oldEntry := oldValue.MapIndex(key)
+		switch {
+		case !oldEntry.IsValid():
+			added = append(added, key.String())
+		case !reflect.DeepEqual(oldEntry.Interface(), newValue.MapIndex(key).Interface()):
+			modified = append(modified, key.String())
+		}
+	}
+	for _, key := range oldValue.MapKeys() {
+		if !newValue.MapIndex(key).IsValid() {
+			removed = append(removed, key.String())
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(modified)
+	return added, removed, modified
+}
+
+func appendNames(changes []string, description string, names []string) []string {
+	if len(names) == 0 {
+		return changes
+	}
+	return append(changes, fmt.Sprintf("%s: %s", description, strings.Join(names, ", ")))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestTracker counts the requests being served so that shutdown can wait
+// for their handlers to clean up after aborted uploads.
+type requestTracker struct {
+	handler http.Handler
+	wg      sync.WaitGroup
+}
+
+func (t *requestTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.wg.Add(1)
+	defer t.wg.Done()
+	t.handler.ServeHTTP(w, r)
+}
+
+// shutdown stops accepting connections and waits up to timeout for the
+// requests in flight to complete. Requests still running at the deadline
+// have their connections closed, which fails their uploads and discards the
+// partial data.
+func shutdown(server *http.Server, tracker *requestTracker, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("requests still in flight after %s; aborting them", timeout)
+		server.Close()
+	}
+
+	tracker.wg.Wait()
+	log.Printf("shutdown complete")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sykesm/dav-blobstore/handlers"
+)
+
+// signCommand prints a pre-authorized URL for a blob that can be used
+// without credentials until it expires.
+func signCommand(config *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	method := flags.String("method", "GET", "The HTTP method the URL may be used with")
+	expires := flags.Duration("expires", time.Hour, "How long the URL remains valid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: sign [-method METHOD] [-expires DURATION] URL")
+	}
+	if config.URLSigningKey == "" {
+		return errors.New("url_signing_key is not configured")
+	}
+
+	u, err := url.Parse(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	signer := &handlers.URLSigner{Key: []byte(config.URLSigningKey)}
+	signer.Sign(strings.ToUpper(*method), u, time.Now().Add(*expires))
+
+	_, err = fmt.Fprintln(out, u.String())
+	return err
+}
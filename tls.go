@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+func tlsEnabled(config *Config) bool {
+	return config.CertFile != "" && config.KeyFile != ""
+}
+
+// newTLSConfig loads the server certificate and client CAs named in config.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   serverProtocols,
+	}
+
+	if config.ClientCAFile == "" {
+		return tlsConfig, checkClientCertConfig(config)
+	}
+
+	caBytes, err := ioutil.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", config.ClientCAFile)
+	}
+
+	switch config.ClientAuth {
+	case "", ClientAuthOptional, ClientAuthRequireForWrites:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth mode: %q", config.ClientAuth)
+	}
+
+	return tlsConfig, nil
+}
+
+// checkClientCertConfig ensures client certificate settings are only used
+// along with a client CA and TLS.
+func checkClientCertConfig(config *Config) error {
+	if config.ClientCAFile == "" {
+		if config.ClientAuth != "" || len(config.ClientCerts) > 0 {
+			return errors.New("client_ca_file is required")
+		}
+		return nil
+	}
+	if !tlsEnabled(config) {
+		return errors.New("client certificates require cert_file and key_file")
+	}
+	return nil
+}
+
+// tlsConfigStore holds the current TLS configuration so certificates and
+// client CAs can be replaced without restarting the listener.
+type tlsConfigStore struct {
+	current atomic.Value
+}
+
+func (s *tlsConfigStore) Store(config *tls.Config) {
+	s.current.Store(config)
+}
+
+func (s *tlsConfigStore) Load() *tls.Config {
+	return s.current.Load().(*tls.Config)
+}
+
+// serverProtocols are the application protocols negotiated with clients.
+// The configuration returned for each handshake replaces the listener's, so
+// it must offer HTTP/2 itself.
+var serverProtocols = []string{"h2", "http/1.1"}
+
+// ServerConfig returns a configuration for the listener that defers to the
+// current configuration for every handshake.
+func (s *tlsConfigStore) ServerConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: serverProtocols,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &s.Load().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.Load(), nil
+		},
+	}
+}